@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Policies for audio description and SDH tracks.
+const (
+	policyKeep    = "keep"    // Copy the original, don't add a downmix
+	policyDownmix = "downmix" // Treat like any other track
+	policySpeech  = "speech"  // Downmix with the speech preset
+	policyDrop    = "drop"    // Leave the track out of the output
+)
+
+var (
+	audioDescriptionTitleRe = regexp.MustCompile(`\b((?i:audio[ -]?description|described|descriptive)|AD)\b`)
+	sdhTitleRe              = regexp.MustCompile(`\b(SDH|CC|(?i:hearing[ -]?impaired|closed captions?))\b`)
+)
+
+// isAudioDescription reports whether an audio stream is flagged or titled as
+// an audio description track.
+func isAudioDescription(s ffprobeStream) bool {
+	return s.Disposition["visual_impaired"] == 1 || s.Disposition["descriptions"] == 1 ||
+		audioDescriptionTitleRe.MatchString(s.Tags["title"])
+}
+
+// isSDH reports whether a subtitle stream is flagged or titled as SDH.
+func isSDH(s ffprobeStream) bool {
+	return s.Disposition["hearing_impaired"] == 1 || sdhTitleRe.MatchString(s.Tags["title"])
+}
+
+// validateAccessibilityPolicies checks the -ad-policy and -sdh-policy values.
+func validateAccessibilityPolicies(opts Options) error {
+	switch opts.ADPolicy {
+	case policyKeep, policyDownmix, policySpeech, policyDrop:
+	default:
+		return fmt.Errorf("invalid -ad-policy %q (keep, downmix, speech or drop)", opts.ADPolicy)
+	}
+	switch opts.SDHPolicy {
+	case policyKeep, policyDrop:
+	default:
+		return fmt.Errorf("invalid -sdh-policy %q (keep or drop)", opts.SDHPolicy)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const acoustIDLookupURL = "https://api.acoustid.org/v2/lookup"
+
+// acoustIDMinScore is the lowest match score accepted for tagging; weaker
+// matches are usually a different recording of the same song.
+const acoustIDMinScore = 0.8
+
+// fingerprintLength is how many seconds of audio fpcalc fingerprints.
+const fingerprintLength = "120"
+
+// AcoustIDClient identifies recordings by their Chromaprint fingerprint
+// using the AcoustID web service, which links them to MusicBrainz.
+type AcoustIDClient struct {
+	apiKey string
+	http   *http.Client
+}
+
+// newAcoustIDClient creates a client using the given application API key.
+func newAcoustIDClient(apiKey string) *AcoustIDClient {
+	return &AcoustIDClient{apiKey: apiKey, http: &http.Client{Timeout: 20 * time.Second}}
+}
+
+// MusicRecording is a MusicBrainz recording matched by AcoustID.
+type MusicRecording struct {
+	ID           string
+	Title        string
+	Artist       string
+	Album        string
+	ReleaseGroup string // MusicBrainz release group ID of Album
+	Score        float64
+}
+
+// Tags returns the track tags for the recording. The track title is left
+// alone, since it names the downmix.
+func (r MusicRecording) Tags() map[string]string {
+	tags := map[string]string{"MUSICBRAINZ_RECORDINGID": r.ID}
+	if r.Artist != "" {
+		tags["ARTIST"] = r.Artist
+	}
+	if r.Album != "" {
+		tags["ALBUM"] = r.Album
+		tags["MUSICBRAINZ_RELEASEGROUPID"] = r.ReleaseGroup
+	}
+	return tags
+}
+
+// fingerprintAudio runs Chromaprint's fpcalc over the start of a file and
+// returns the fingerprint and the file's duration in seconds.
+func fingerprintAudio(file string) (string, int, error) {
+	output, err := exec.Command("fpcalc", "-json", "-length", fingerprintLength, file).Output()
+	if err != nil {
+		return "", 0, fmt.Errorf("fpcalc (Chromaprint) failed: %v", err)
+	}
+	var result struct {
+		Duration    float64 `json:"duration"`
+		Fingerprint string  `json:"fingerprint"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return "", 0, fmt.Errorf("parsing fpcalc output failed: %v", err)
+	}
+	return result.Fingerprint, int(result.Duration), nil
+}
+
+// Identify fingerprints an audio file and returns the best matching
+// recording. It reports false if nothing matched well enough.
+func (c *AcoustIDClient) Identify(file string) (MusicRecording, bool, error) {
+	fingerprint, duration, err := fingerprintAudio(file)
+	if err != nil {
+		return MusicRecording{}, false, err
+	}
+
+	// The fingerprint is too long for a GET request
+	resp, err := c.http.PostForm(acoustIDLookupURL, url.Values{
+		"client":      {c.apiKey},
+		"duration":    {strconv.Itoa(duration)},
+		"fingerprint": {fingerprint},
+		"meta":        {"recordings releasegroups"},
+	})
+	if err != nil {
+		return MusicRecording{}, false, fmt.Errorf("AcoustID request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string `json:"status"`
+		Error  struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Results []struct {
+			Score      float64 `json:"score"`
+			Recordings []struct {
+				ID      string `json:"id"`
+				Title   string `json:"title"`
+				Artists []struct {
+					Name       string `json:"name"`
+					JoinPhrase string `json:"joinphrase"`
+				} `json:"artists"`
+				ReleaseGroups []struct {
+					ID    string `json:"id"`
+					Title string `json:"title"`
+				} `json:"releasegroups"`
+			} `json:"recordings"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return MusicRecording{}, false, fmt.Errorf("parsing AcoustID response failed: %v", err)
+	}
+	if result.Status != "ok" {
+		return MusicRecording{}, false, fmt.Errorf("AcoustID lookup failed: %s", result.Error.Message)
+	}
+
+	// Results are sorted by score; take the first one with a recording
+	for _, r := range result.Results {
+		if r.Score < acoustIDMinScore {
+			break
+		}
+		if len(r.Recordings) == 0 {
+			continue
+		}
+		rec := r.Recordings[0]
+		var artist strings.Builder
+		for _, a := range rec.Artists {
+			artist.WriteString(a.Name + a.JoinPhrase)
+		}
+		match := MusicRecording{ID: rec.ID, Title: rec.Title, Artist: artist.String(), Score: r.Score}
+		if len(rec.ReleaseGroups) > 0 {
+			match.Album = rec.ReleaseGroups[0].Title
+			match.ReleaseGroup = rec.ReleaseGroups[0].ID
+		}
+		return match, true, nil
+	}
+	return MusicRecording{}, false, nil
+}
+
+// tagMusicTracks identifies every new track with AcoustID and adds the
+// MusicBrainz tags to it. Lookup failures only leave the track untagged.
+func tagMusicTracks(plan *Plan) {
+	client := newAcoustIDClient(os.Getenv("ACOUSTID_API_KEY"))
+	for i := range plan.Encodes {
+		enc := &plan.Encodes[i]
+		match, ok, err := client.Identify(enc.TempFile)
+		if err != nil {
+			fmt.Printf("Music tagging of track %d failed: %v\n", enc.SourceIndex, err)
+			continue
+		}
+		if !ok {
+			fmt.Printf("No confident AcoustID match for track %d\n", enc.SourceIndex)
+			continue
+		}
+		fmt.Printf("Track %d identified as %s - %s (%.0f%%)\n", enc.SourceIndex, match.Artist, match.Title, match.Score*100)
+		if enc.Metadata == nil {
+			enc.Metadata = make(map[string]string)
+		}
+		for key, value := range match.Tags() {
+			enc.Metadata[key] = value
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// printCommands prints the ffmpeg commands a plan would run, for -dry-run.
+func printCommands(plan *Plan) {
+	quote := func(args []string) string {
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		return strings.Join(quoted, " ")
+	}
+	fmt.Println("Commands:")
+	for _, enc := range plan.Encodes {
+		command := quote(append([]string{ffmpegPath}, encodeCommandArgs(plan, enc, enc.Filter, "warning", enc.TempFile)...))
+		if enc.Decoder != "" {
+			command = enc.Decoder + " | " + command
+		}
+		fmt.Println("  " + command)
+		if enc.Loudnorm != "" {
+			fmt.Printf("    (the filter gets the loudnorm values measured in a first pass, target %s)\n", enc.Loudnorm)
+		}
+	}
+	fmt.Println("  " + quote(append([]string{ffmpegPath}, mergeCommandArgs(plan)...)))
+}
+
+// analyzeResult is one file of an analyze report.
+type analyzeResult struct {
+	File     string   `json:"file"`
+	Status   string   `json:"status"` // needs conversion, converted, no surround or failed
+	Reason   string   `json:"reason,omitempty"`
+	Surround []string `json:"surround,omitempty"` // Surround tracks as "index:layout:language"
+	Size     int64    `json:"size"`
+	Duration float64  `json:"duration,omitempty"` // Seconds
+}
+
+// runAnalyze implements the analyze command: it scans a library and reports
+// which files have surround audio but no enhanced track yet, without
+// changing anything.
+func runAnalyze(args []string) {
+	cmd := flag.NewFlagSet("analyze", flag.ExitOnError)
+	asJSON := cmd.Bool("json", false, "print the report as JSON")
+	markerTag := cmd.String("marker-tag", settingsTag, "audio track tag marking a file as already processed (empty to only check titles)")
+	container := cmd.String("output-container", containerMKV, "container the outputs were written as: mkv, mp4 or same")
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "Usage: go run script.go analyze [options] <dir>")
+		cmd.PrintDefaults()
+	}
+	cmd.Parse(args)
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	files, err := findBatchInputs(cmd.Arg(0), false)
+	if err != nil {
+		fmt.Println("Error scanning directory:", err)
+		os.Exit(1)
+	}
+	results := []analyzeResult{}
+	for _, file := range files {
+		results = append(results, analyzeFile(file, *markerTag, *container))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+		return
+	}
+	printAnalyzeReport(results)
+}
+
+// analyzeFile works out whether a file still needs converting.
+func analyzeFile(file, markerTag, container string) analyzeResult {
+	result := analyzeResult{File: file}
+	if info, err := os.Stat(file); err == nil {
+		result.Size = info.Size()
+	}
+	tracks, err := extractTrackInfo(file)
+	if err != nil {
+		result.Status, result.Reason = "failed", err.Error()
+		return result
+	}
+	for _, t := range tracks {
+		if surroundLayoutRe.MatchString(t.Layout) {
+			result.Surround = append(result.Surround, t.Index+":"+t.Layout+":"+t.Language)
+		}
+	}
+	if len(result.Surround) == 0 {
+		result.Status = "no surround"
+		return result
+	}
+
+	output, err := enhancedOutputPath(file, container)
+	if err != nil {
+		result.Status, result.Reason = "failed", err.Error()
+		return result
+	}
+	err = checkProcessed(file, output, markerTag)
+	if _, processed := err.(processedError); processed {
+		result.Status, result.Reason = "converted", strings.TrimPrefix(err.Error(), "already processed: ")
+		return result
+	}
+	if err != nil {
+		result.Status, result.Reason = "failed", err.Error()
+		return result
+	}
+	result.Status = "needs conversion"
+	result.Duration, _ = probeDuration(file)
+	return result
+}
+
+// printAnalyzeReport prints the analyze results as a table with totals.
+func printAnalyzeReport(results []analyzeResult) {
+	counts := make(map[string]int)
+	var size int64
+	var duration float64
+	fmt.Printf("%-16s %9s %9s  %-24s %s\n", "STATUS", "SIZE", "DURATION", "SURROUND", "FILE")
+	for _, r := range results {
+		counts[r.Status]++
+		length := ""
+		if r.Status == "needs conversion" {
+			size += r.Size
+			duration += r.Duration
+			length = humanDuration(r.Duration)
+		}
+		line := fmt.Sprintf("%-16s %9s %9s  %-24s %s", r.Status, humanSize(r.Size), length, strings.Join(r.Surround, ","), r.File)
+		if r.Reason != "" {
+			line += " (" + strings.SplitN(r.Reason, "\n", 2)[0] + ")"
+		}
+		fmt.Println(line)
+	}
+	fmt.Println()
+	fmt.Printf("%d files: %d need conversion (%s, %s of media), %d converted, %d without surround audio, %d failed\n",
+		len(results), counts["needs conversion"], humanSize(size), humanDuration(duration),
+		counts["converted"], counts["no surround"], counts["failed"])
+}
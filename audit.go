@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// auditLogFileName is the default audit log inside the user config
+// directory, next to the configuration file.
+const auditLogFileName = "mkv-5.1to2.1/audit.jsonl"
+
+// auditEntry records one destructive action: replacing or editing a source
+// in place, or deleting a file.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"` // replace, metadata-edit or delete
+	Path     string    `json:"path"`
+	User     string    `json:"user"`
+	Host     string    `json:"host"`
+	PID      int       `json:"pid"`
+	Checksum string    `json:"checksum,omitempty"` // Of the file before the action, see formatChecksum
+	Settings []string  `json:"settings,omitempty"` // Settings hashes of the new tracks
+	Dropped  []string  `json:"dropped,omitempty"`  // Source streams left out of the result
+	Kept     string    `json:"kept,omitempty"`     // Where the original was kept, if anywhere
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// defaultAuditLog returns the audit log in the user config directory, or ""
+// if there is none.
+func defaultAuditLog() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, auditLogFileName)
+}
+
+// newAuditEntry describes an action on path by the current user and process.
+func newAuditEntry(action, path string) auditEntry {
+	e := auditEntry{Time: time.Now(), Action: action, Path: path, PID: os.Getpid()}
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	}
+	e.Host, _ = os.Hostname()
+	if abs, err := filepath.Abs(path); err == nil {
+		e.Path = abs
+	}
+	return e
+}
+
+// auditPlan records an action on the plan's source in its audit log,
+// including the settings of the new tracks, the streams the result leaves
+// out and a checksum of the source. An empty AuditLog disables this.
+func auditPlan(plan *Plan, action, kept string) error {
+	if plan.AuditLog == "" {
+		return nil
+	}
+	e := newAuditEntry(action, plan.Input)
+	for _, enc := range plan.Encodes {
+		e.Settings = append(e.Settings, fmt.Sprintf("track %d: %s", enc.SourceIndex, settingsHash(enc)))
+	}
+	for _, s := range plan.Streams {
+		if s.Action == "drop" {
+			e.Dropped = append(e.Dropped, fmt.Sprintf("%d %s (%s) %s", s.Index, s.Type, s.Language, s.Title))
+		}
+	}
+	for _, x := range plan.Excluded {
+		e.Dropped = append(e.Dropped, fmt.Sprintf("new track for %d: %s", x.SourceIndex, x.Error))
+	}
+
+	e.Kept = kept
+
+	fmt.Println("Checksumming the original for the audit log...")
+	var err error
+	if e.Checksum, err = hashFile(plan.Input, plan.AuditHash); err != nil {
+		return fmt.Errorf("checksumming %s failed: %v", plan.Input, err)
+	}
+	return appendAudit(plan.AuditLog, e)
+}
+
+// appendAudit appends an entry to the audit log at path. Callers must not go
+// ahead with the action if this fails, so nothing destructive ever happens
+// unrecorded.
+func appendAudit(path string, e auditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("writing audit log failed: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("writing audit log failed: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing audit log failed: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("writing audit log failed: %v", err)
+	}
+	return nil
+}
+
+// auditKept returns where replaceOriginal keeps the original, if anywhere.
+func auditKept(plan *Plan) string {
+	switch {
+	case plan.TrashDir != "":
+		return filepath.Join(plan.TrashDir, filepath.Base(plan.Input))
+	case plan.Backup:
+		return plan.Input + backupSuffix
+	}
+	return ""
+}
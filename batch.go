@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// surroundLayoutRe matches ffprobe channel layouts with more than two channels.
+var surroundLayoutRe = regexp.MustCompile(`^([3-9]\.[01]|quad|hexagonal|octagonal|hexadecagonal)`)
+
+// batchResult is the outcome of one file in a batch run.
+type batchResult struct {
+	File   string
+	Status string // converted, skipped or failed
+	Reason string
+}
+
+// provenanceTag is the global tag on every output, naming its source file.
+const provenanceTag = "MKV21_SOURCE"
+
+// findBatchInputs returns the media files below dir in name order. Outputs of
+// earlier runs are left out unless includeOwn is set.
+func findBatchInputs(dir string, includeOwn bool) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isMediaInput(info.Name()) {
+			return nil
+		}
+		if !includeOwn && isOwnOutput(path) {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// isOwnOutput reports whether a file was written by this tool, by its name
+// or, for renamed files, by its provenance tag.
+func isOwnOutput(file string) bool {
+	if isEnhancedOutput(file) {
+		return true
+	}
+	output, err := exec.Command(ffprobePath, "-loglevel", "error",
+		"-show_entries", "format_tags="+provenanceTag, "-of", "default=nw=1:nk=1", file).Output()
+	return err == nil && strings.TrimSpace(string(output)) != ""
+}
+
+// hasSurroundTrack reports whether any of the tracks needs a downmix.
+func hasSurroundTrack(tracks []TrackInfo) bool {
+	for _, t := range tracks {
+		if surroundLayoutRe.MatchString(t.Layout) {
+			return true
+		}
+	}
+	return false
+}
+
+// runBatch processes every MKV with a surround track below dir. Plans are
+// prepared one after another, since settings are resolved per file, and then
+// run in parallel; all files share one -jobs limit on concurrent encodes. A
+// failing file is recorded and the batch continues. It returns the exit code
+// for the results, see batchExitCode.
+func runBatch(ctx context.Context, dir string, flags *Options, explicit map[string]bool, planOnly bool, stdout io.Writer) int {
+	files, err := findBatchInputs(dir, flags.IncludeOwnOutputs)
+	if err != nil {
+		fmt.Println("Error scanning directory:", err)
+		return exitFailed
+	}
+
+	// The shared limit comes from the flags and the configuration file, as
+	// sidecars can't set -jobs
+	resetSettings(explicit)
+	if err := loadConfig(explicit); err != nil {
+		fmt.Println("Error loading settings:", err)
+		return exitFailed
+	}
+	if err := validateJobs(flags.Jobs); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailed
+	}
+	jobs, workers := newBatchLimiter(flags.Jobs)
+	done := make(chan struct{})
+	if flags.Jobs == jobsAuto {
+		go jobs.adapt(done)
+	}
+
+	files = scheduleByIO(files)
+	results := make([]batchResult, len(files))
+	record := func(i int, result batchResult) {
+		results[i] = result
+		progress.fileDone()
+	}
+	progress.setBatch(len(files))
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, file := range files {
+		pauser.wait()
+		if ctx.Err() != nil {
+			reportUnprocessed(file, "failed", errInterrupted.Error())
+			record(i, batchResult{file, "failed", errInterrupted.Error()})
+			continue
+		}
+		fmt.Printf("[%d/%d] %s\n", i+1, len(files), file)
+		tracks, err := extractTrackInfo(file)
+		if err != nil {
+			reportUnprocessed(file, "failed", err.Error())
+			record(i, batchResult{file, "failed", err.Error()})
+			continue
+		}
+		if !hasSurroundTrack(tracks) {
+			reportUnprocessed(file, "skipped", "no surround audio track")
+			record(i, batchResult{file, "skipped", "no surround audio track"})
+			continue
+		}
+		if planOnly {
+			err := processFile(ctx, file, flags, explicit, true, stdout)
+			if _, processed := err.(processedError); processed {
+				record(i, batchResult{file, "skipped", err.Error()})
+				continue
+			}
+			if err != nil {
+				fmt.Println("Error:", err)
+				record(i, batchResult{file, "failed", err.Error()})
+				continue
+			}
+			record(i, batchResult{file, "planned", ""})
+			continue
+		}
+
+		started := time.Now()
+		plan, opts, err := preparePlan(ctx, file, flags, explicit)
+		if _, processed := err.(processedError); processed {
+			reportUnprocessed(file, "skipped", err.Error())
+			record(i, batchResult{file, "skipped", err.Error()})
+			continue
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			finishUnplannedJob(file, flags, started, err)
+			record(i, batchResult{file, "failed", err.Error()})
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, plan *Plan, opts Options) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := runPlan(ctx, plan, opts, jobs); err != nil {
+				fmt.Printf("Error: %s: %v\n", plan.Input, err)
+				record(i, batchResult{plan.Input, "failed", err.Error()})
+				return
+			}
+			record(i, batchResult{plan.Input, "converted", ""})
+		}(i, plan, opts)
+	}
+	wg.Wait()
+	close(done)
+	printBatchReport(results)
+	return batchExitCode(results, flags.JSON)
+}
+
+// newBatchLimiter returns the encode limiter shared by the files of a batch
+// and how many files may run at once. With -jobs 0 every file gets its own
+// limiter and files run one at a time, as each already encodes all its
+// tracks at once.
+func newBatchLimiter(jobs string) (*jobLimiter, int) {
+	switch n, _ := strconv.Atoi(jobs); {
+	case jobs == jobsAuto:
+		return newJobLimiter(jobs, 0), runtime.NumCPU()
+	case n > 0:
+		return newJobLimiter(jobs, n), n
+	}
+	return nil, 1
+}
+
+// batchStatuses is the order statuses are counted in the final report.
+var batchStatuses = []string{"converted", "planned", "upgraded", "up to date", "outdated", "skipped", "failed"}
+
+// printBatchReport prints the final report of a batch run.
+func printBatchReport(results []batchResult) {
+	counts := make(map[string]int)
+	fmt.Println()
+	fmt.Println("Batch summary:")
+	for _, r := range results {
+		counts[r.Status]++
+		if r.Reason != "" {
+			fmt.Printf("  %-10s %s (%s)\n", r.Status, r.File, strings.SplitN(r.Reason, "\n", 2)[0])
+		} else {
+			fmt.Printf("  %-10s %s\n", r.Status, r.File)
+		}
+	}
+	var totals []string
+	for _, status := range batchStatuses {
+		if counts[status] > 0 || status == "failed" {
+			totals = append(totals, fmt.Sprintf("%d %s", counts[status], status))
+		}
+	}
+	fmt.Println(strings.Join(totals, ", "))
+}
+
+// Exit codes of a run. Without -json, any failed file exits with
+// exitFailed and everything else with exitOK.
+const (
+	exitOK          = 0 // Files were converted and none failed
+	exitFailed      = 1 // Every file that needed converting failed
+	exitNothingToDo = 2 // No file needed converting
+	exitPartial     = 3 // Some files were converted, others failed
+)
+
+// batchExitCode returns the exit code for the results of a batch run, with
+// the granular codes of -json if granular is set.
+func batchExitCode(results []batchResult, granular bool) int {
+	done, failed := 0, 0
+	for _, r := range results {
+		switch r.Status {
+		case "failed":
+			failed++
+		case "converted", "planned", "upgraded", "outdated":
+			done++
+		}
+	}
+	switch {
+	case failed > 0 && (!granular || done == 0):
+		return exitFailed
+	case failed > 0:
+		return exitPartial
+	case granular && done == 0:
+		return exitNothingToDo
+	}
+	return exitOK
+}
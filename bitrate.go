@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// bitrateAuto is the -bitrate value picking each track's bitrate from its
+// source and content.
+const bitrateAuto = "auto"
+
+// Content types told apart by analyzeContent.
+const (
+	contentSpeech = "speech"
+	contentMusic  = "music"
+)
+
+// contentSampleSeconds is how much of a track analyzeContent listens to,
+// taken from the middle of the file.
+const contentSampleSeconds = 120
+
+// speechCentreDominance is how much louder, in dB, the centre channel must
+// be than the louder front channel for a track to count as speech. Dialogue
+// sits in the centre; music and effects spread over the fronts.
+const speechCentreDominance = 8.0
+
+// ac3Bitrates are the bitrates the AC-3 encoder accepts, in kbit/s.
+var ac3Bitrates = []int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640}
+
+// isLosslessSource reports whether a source track is lossless, so its
+// detail survives the downmix and is worth the bits.
+func isLosslessSource(track TrackInfo) bool {
+	switch {
+	case track.Codec == "truehd", track.Codec == "mlp", track.Codec == "flac", track.Codec == "alac",
+		strings.HasPrefix(track.Codec, "pcm_"):
+		return true
+	case track.Codec == "dts":
+		return strings.Contains(track.Profile, "MA")
+	}
+	return false
+}
+
+// autoBitrate picks the bitrate of a new track from the codec's default:
+// speech gets half of it, music three quarters, and lossless or 7.1
+// sources a quarter more, up to the default. Lossless codecs get none.
+func autoBitrate(codec string, track TrackInfo, content string) string {
+	base := parseBitrate(lookupCodec(codec).Bitrate)
+	if base == 0 {
+		return ""
+	}
+	fraction := 0.75
+	if content == contentSpeech {
+		fraction = 0.5
+	}
+	if isLosslessSource(track) || track.Channels >= 8 {
+		fraction += 0.25
+	}
+	kbps := int(math.Round(base*min(fraction, 1)/1000/16)) * 16
+	if lookupCodec(codec).Encoder == "ac3" {
+		closest := ac3Bitrates[0]
+		for _, b := range ac3Bitrates {
+			if math.Abs(float64(b-kbps)) < math.Abs(float64(closest-kbps)) {
+				closest = b
+			}
+		}
+		kbps = closest
+	}
+	return strconv.Itoa(kbps) + "k"
+}
+
+// analyzeContent guesses whether a track is mostly speech or music by
+// comparing the level of its centre channel with the fronts over a sample
+// from the middle of the file. Tracks without a centre count as music.
+func analyzeContent(input string, track TrackInfo, duration float64) (string, error) {
+	if !hasChannel(layoutChannels[track.Layout], "FC") {
+		return contentMusic, nil
+	}
+	start := max(0, duration/2-contentSampleSeconds/2)
+	cmd := exec.Command(ffmpegPath, "-hide_banner", "-nostats",
+		"-ss", strconv.FormatFloat(start, 'f', 0, 64), "-t", strconv.Itoa(contentSampleSeconds),
+		"-i", input, "-map", "0:"+track.Index,
+		"-af", "pan=3c|c0=FC|c1=FL|c2=FR,astats=measure_perchannel=RMS_level:measure_overall=none",
+		"-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("content analysis failed: %v\n%s", err, stderr.String())
+	}
+
+	// astats lists the channels in order: centre, left, right
+	var levels []float64
+	scanner := bufio.NewScanner(&stderr)
+	for scanner.Scan() {
+		_, value, ok := strings.Cut(scanner.Text(), "RMS level dB: ")
+		if !ok {
+			continue
+		}
+		level, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			level = math.Inf(-1) // "-inf" for a silent channel
+		}
+		levels = append(levels, level)
+	}
+	if len(levels) < 3 {
+		return "", fmt.Errorf("content analysis printed no channel levels")
+	}
+	if levels[0]-max(levels[1], levels[2]) >= speechCentreDominance {
+		return contentSpeech, nil
+	}
+	return contentMusic, nil
+}
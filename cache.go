@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fingerprintSeconds is how much of a stream is hashed for its fingerprint.
+const fingerprintSeconds = "60"
+
+// streamFingerprint identifies a source stream by its content rather than
+// its file name: a hash of the first packets plus its duration and codec
+// parameters, so renamed or moved files map to the same fingerprint.
+func streamFingerprint(file string, index int) (string, error) {
+	spec := fmt.Sprintf("0:%d", index)
+	output, err := exec.Command(ffmpegPath, "-loglevel", "error",
+		"-i", file, "-map", spec, "-c", "copy", "-t", fingerprintSeconds,
+		"-f", "hash", "-hash", "sha256", "-").Output()
+	if err != nil {
+		return "", fmt.Errorf("hashing stream %d failed: %v", index, err)
+	}
+
+	params, err := exec.Command(ffprobePath, "-loglevel", "error",
+		"-select_streams", fmt.Sprint(index),
+		"-show_entries", "stream=codec_name,channel_layout,sample_rate,duration:stream_tags=DURATION",
+		"-of", "compact=p=0:nk=1", file).Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe failed with error: %s", err)
+	}
+	return strings.TrimSpace(string(output)) + "|" + strings.TrimSpace(string(params)), nil
+}
+
+// encodeCacheKey combines the source fingerprint with every setting that
+// affects the encoded result.
+func encodeCacheKey(fingerprint string, enc PlanEncode) string {
+	parts := append([]string{fingerprint, enc.Filter, enc.Language, enc.Title}, enc.EncoderArgs...)
+	if enc.Decoder != "" {
+		parts = append(parts, "decoder="+enc.Decoder)
+	}
+	if enc.Loudnorm != "" {
+		parts = append(parts, "loudnorm="+enc.Loudnorm)
+	}
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// cachedTrackPath returns the content-addressed file for an encode.
+func cachedTrackPath(dir, key, ext string) string {
+	return filepath.Join(dir, "mkv21_"+key+ext)
+}
+
+// partialPath returns where an encode is written before it is complete, so
+// a crashed encode is never mistaken for a finished cache entry. The name is
+// unique per host, process and job so neither machines sharing a cache nor
+// parallel jobs encoding the same content collide.
+func partialPath(path, jobID string) string {
+	host, _ := os.Hostname()
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%s-%d-%s.part%s", strings.TrimSuffix(path, ext), host, os.Getpid(), jobID, ext)
+}
+
+// cacheEntry is the manifest stored next to each cached encode. It lets
+// other machines sharing the cache verify an entry before reusing it.
+type cacheEntry struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Filter      string    `json:"filter"`
+	EncoderArgs []string  `json:"encoder_args"`
+	Language    string    `json:"language"`
+	Title       string    `json:"title"`
+	Size        int64     `json:"size"`
+	Host        string    `json:"host"`
+	Created     time.Time `json:"created"`
+}
+
+// cacheManifestPath returns the manifest file of a cached encode.
+func cacheManifestPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+}
+
+// newCacheEntry describes a finished encode.
+func newCacheEntry(enc PlanEncode, size int64) cacheEntry {
+	host, _ := os.Hostname()
+	return cacheEntry{
+		Key:         encodeCacheKey(enc.Fingerprint, enc),
+		Fingerprint: enc.Fingerprint,
+		Filter:      enc.Filter,
+		EncoderArgs: enc.EncoderArgs,
+		Language:    enc.Language,
+		Title:       enc.Title,
+		Size:        size,
+		Host:        host,
+		Created:     time.Now(),
+	}
+}
+
+// writeCacheManifest records a finished encode in the cache.
+func writeCacheManifest(enc PlanEncode, jobID string) error {
+	info, err := os.Stat(enc.TempFile)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(newCacheEntry(enc, info.Size()), "", "  ")
+	if err != nil {
+		return err
+	}
+	path := cacheManifestPath(enc.TempFile)
+	partial := partialPath(path, jobID)
+	if err := os.WriteFile(partial, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// cachedEncodeValid reports whether a usable encode for enc already exists:
+// the file must be complete and its manifest must match the fingerprint and
+// settings exactly. Valid entries are touched so eviction is least recently
+// used.
+func cachedEncodeValid(enc PlanEncode) bool {
+	info, err := os.Stat(enc.TempFile)
+	if err != nil {
+		return false
+	}
+	data, err := os.ReadFile(cacheManifestPath(enc.TempFile))
+	if err != nil {
+		return false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return false
+	}
+
+	want := newCacheEntry(enc, info.Size())
+	if entry.Key != want.Key || entry.Fingerprint != want.Fingerprint || entry.Filter != want.Filter ||
+		entry.Language != want.Language || entry.Title != want.Title || entry.Size != want.Size ||
+		strings.Join(entry.EncoderArgs, "\x00") != strings.Join(want.EncoderArgs, "\x00") {
+		return false
+	}
+
+	now := time.Now()
+	os.Chtimes(enc.TempFile, now, now)
+	return true
+}
+
+// evictCache removes cached encodes not used for maxAge and then the least
+// recently used ones until the cache is at most maxSize bytes. Zero values
+// disable the respective limit.
+func evictCache(dir string, maxAge time.Duration, maxSize int64) error {
+	var files []string
+	for _, ext := range []string{".opus", ".mka"} {
+		matches, err := filepath.Glob(filepath.Join(dir, "mkv21_*"+ext))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+
+	type cached struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var entries []cached
+	var total int64
+	for _, path := range files {
+		if strings.Contains(path, ".part.") {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, cached{path, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+
+	for _, e := range entries {
+		expired := maxAge > 0 && time.Since(e.used) > maxAge
+		oversized := maxSize > 0 && total > maxSize
+		if !expired && !oversized {
+			continue
+		}
+		if err := os.Remove(e.path); err != nil {
+			fmt.Printf("Failed to evict cached track %s: %v\n", e.path, err)
+			continue
+		}
+		os.Remove(cacheManifestPath(e.path))
+		total -= e.size
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// checkpointInterval is how often a running encode persists its progress.
+const checkpointInterval = 5 * time.Second
+
+// checkpointStaleAfter is how long a running checkpoint may go without an
+// update before the encode is considered interrupted.
+const checkpointStaleAfter = time.Minute
+
+// trackCheckpoint is the persisted progress of a single track encode. It is
+// kept next to the encode so a crashed run can still be reported on.
+type trackCheckpoint struct {
+	Input       string    `json:"input"`
+	SourceIndex int       `json:"source_index"`
+	TempFile    string    `json:"temp_file"`
+	State       string    `json:"state"`    // running or failed
+	Position    float64   `json:"position"` // Seconds encoded so far
+	Duration    float64   `json:"duration"` // Seconds of input, 0 if unknown
+	Speed       float64   `json:"speed"`    // Last reported ffmpeg speed
+	Host        string    `json:"host"`
+	PID         int       `json:"pid"`
+	Job         string    `json:"job"`
+	Started     time.Time `json:"started"`
+	Updated     time.Time `json:"updated"`
+
+	path string
+}
+
+// checkpointPath returns the progress file of an encode.
+func checkpointPath(tempFile string) string {
+	return strings.TrimSuffix(tempFile, filepath.Ext(tempFile)) + ".progress"
+}
+
+// newCheckpoint starts tracking the progress of an encode.
+func newCheckpoint(plan *Plan, enc PlanEncode) *trackCheckpoint {
+	host, _ := os.Hostname()
+	now := time.Now()
+	c := &trackCheckpoint{
+		Input:       plan.Input,
+		SourceIndex: enc.SourceIndex,
+		TempFile:    enc.TempFile,
+		State:       "running",
+		Host:        host,
+		PID:         os.Getpid(),
+		Job:         plan.JobID,
+		Duration:    plan.duration,
+		Started:     now,
+		path:        checkpointPath(enc.TempFile),
+	}
+	c.save()
+	return c
+}
+
+// report records the position and speed ffmpeg reported, persisting them at
+// most every checkpointInterval.
+func (c *trackCheckpoint) report(position, speed float64) {
+	c.Position, c.Speed = position, speed
+	if time.Since(c.Updated) >= checkpointInterval {
+		c.save()
+	}
+}
+
+// fail marks the encode as failed, keeping how far it had gotten.
+func (c *trackCheckpoint) fail() {
+	c.State = "failed"
+	c.save()
+}
+
+// finish removes the checkpoint of a completed encode.
+func (c *trackCheckpoint) finish() {
+	os.Remove(c.path)
+}
+
+// save writes the checkpoint. Errors are ignored since progress reporting
+// must never fail an encode.
+func (c *trackCheckpoint) save() {
+	c.Updated = time.Now()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return
+	}
+	partial := partialPath(c.path, c.Job)
+	if os.WriteFile(partial, data, 0644) == nil {
+		os.Rename(partial, c.path)
+	}
+}
+
+// Percent returns how much of the track was encoded, or -1 if unknown.
+func (c *trackCheckpoint) Percent() float64 {
+	if c.Duration <= 0 {
+		return -1
+	}
+	return min(100, c.Position/c.Duration*100)
+}
+
+// Remaining estimates the time left at the last reported speed.
+func (c *trackCheckpoint) Remaining() (time.Duration, bool) {
+	if c.Duration <= 0 || c.Speed <= 0 {
+		return 0, false
+	}
+	return time.Duration((c.Duration - c.Position) / c.Speed * float64(time.Second)), true
+}
+
+// Status describes the checkpoint as seen at now. Running checkpoints that
+// stopped updating belong to a run that crashed or was killed.
+func (c *trackCheckpoint) Status(now time.Time) string {
+	if c.State == "running" && now.Sub(c.Updated) > checkpointStaleAfter {
+		return "interrupted"
+	}
+	return c.State
+}
+
+// readCheckpoints loads all checkpoints found below dir.
+func readCheckpoints(dir string) ([]*trackCheckpoint, error) {
+	var checkpoints []*trackCheckpoint
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".progress") {
+			return err
+		}
+		if strings.Contains(path, ".part.") {
+			return nil // Being rewritten by its job
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		c := &trackCheckpoint{path: path}
+		if json.Unmarshal(data, c) == nil {
+			checkpoints = append(checkpoints, c)
+		}
+		return nil
+	})
+	sort.Slice(checkpoints, func(i, j int) bool {
+		if checkpoints[i].Input != checkpoints[j].Input {
+			return checkpoints[i].Input < checkpoints[j].Input
+		}
+		return checkpoints[i].SourceIndex < checkpoints[j].SourceIndex
+	})
+	return checkpoints, err
+}
+
+// runStatus implements the "status <dir>" command, which reports the progress
+// of running and interrupted encodes from their checkpoints.
+func runStatus(args []string) {
+	cmd := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := cmd.Bool("json", false, "print the checkpoints as JSON")
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "Usage: go run script.go status [options] <dir>")
+		cmd.PrintDefaults()
+	}
+	cmd.Parse(args)
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	checkpoints, err := readCheckpoints(cmd.Arg(0))
+	if err != nil {
+		fmt.Println("Error scanning directory:", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if checkpoints == nil {
+			checkpoints = []*trackCheckpoint{}
+		}
+		enc.Encode(checkpoints)
+		return
+	}
+	if len(checkpoints) == 0 {
+		fmt.Println("No encodes in progress.")
+		return
+	}
+
+	now := time.Now()
+	for _, c := range checkpoints {
+		progress := fmt.Sprintf("%.0fs encoded", c.Position)
+		if pct := c.Percent(); pct >= 0 {
+			progress = fmt.Sprintf("%.1f%%", pct)
+		}
+		status := c.Status(now)
+		line := fmt.Sprintf("%s track %d: %s, %s", c.Input, c.SourceIndex, status, progress)
+		if remaining, ok := c.Remaining(); ok && status == "running" {
+			line += fmt.Sprintf(", %s left at %.1fx", remaining.Round(time.Second), c.Speed)
+		}
+		if status != "running" {
+			line += fmt.Sprintf(" (last update %s on %s)", c.Updated.Format(time.RFC3339), c.Host)
+		}
+		fmt.Println(line)
+	}
+}
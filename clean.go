@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tempTrackRe matches the per-track temporary files written by processTrack,
+// including partial encodes and the names used by older versions, and the
+// speech samples of -langid-cmd.
+var tempTrackRe = regexp.MustCompile(`(_track\d+_enhanced\.opus|mkv21_[0-9a-f]{32}(\.([^/]*\.)?part)?\.(opus|mka|json|progress)|mkv21_[0-9a-f-]{36}_\d+_langid_\d+\.wav)$`)
+
+// orphanMinAge is how long a temporary file must be untouched before it is
+// considered left over from a crashed run rather than part of an active one.
+const orphanMinAge = time.Hour
+
+// staleArtifact is a file found by the clean command.
+type staleArtifact struct {
+	Path   string
+	Size   int64
+	Reason string
+}
+
+// runClean implements the "clean <dir>" command, which removes temporary
+// files, old backups and incomplete outputs left behind by earlier runs.
+func runClean(args []string) {
+	cmd := flag.NewFlagSet("clean", flag.ExitOnError)
+	days := cmd.Int("older-than", 7, "remove .bak backups older than this many days")
+	yes := cmd.Bool("yes", false, "remove without asking for confirmation")
+	auditLog := cmd.String("audit-log", defaultAuditLog(), "record every removal in this JSON lines file; empty disables it")
+	probe := cmd.String("ffprobe-path", ffprobePath, "ffprobe executable used to check enhanced outputs")
+	auditHash := cmd.String("audit-hash", "sha256", "checksum of removed backups in the -audit-log: sha256, sha256-tree, or crc32c and crc64, which are not collision resistant")
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "Usage: go run script.go clean [options] <dir>")
+		cmd.PrintDefaults()
+	}
+	cmd.Parse(args)
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	if err := validateHash("audit-hash", *auditHash); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	// Without a working ffprobe every output would look unreadable
+	ffprobePath = *probe
+	if err := checkFFprobe(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	artifacts, err := findStaleArtifacts(cmd.Arg(0), time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		fmt.Println("Error scanning directory:", err)
+		os.Exit(1)
+	}
+	if len(artifacts) == 0 {
+		fmt.Println("Nothing to clean up.")
+		return
+	}
+
+	var total int64
+	for _, a := range artifacts {
+		fmt.Printf("%s (%s, %.1f MB)\n", a.Path, a.Reason, float64(a.Size)/1e6)
+		total += a.Size
+	}
+	if !*yes && !confirm(fmt.Sprintf("Remove %d files (%.1f MB)?", len(artifacts), float64(total)/1e6)) {
+		fmt.Println("Aborted.")
+		return
+	}
+
+	failed := false
+	for _, a := range artifacts {
+		if err := auditRemoval(*auditLog, *auditHash, a); err != nil {
+			fmt.Printf("Not deleting %s: %v\n", a.Path, err)
+			failed = true
+			continue
+		}
+		if err := os.Remove(a.Path); err != nil {
+			fmt.Printf("Failed to delete %s: %v\n", a.Path, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Printf("Removed %d files.\n", len(artifacts))
+}
+
+// auditRemoval records the removal of an artifact in the audit log. Backups
+// are originals, so their checksum is recorded too.
+func auditRemoval(path, algo string, a staleArtifact) error {
+	if path == "" {
+		return nil
+	}
+	e := newAuditEntry("delete", a.Path)
+	e.Reason = a.Reason
+	if strings.HasSuffix(a.Path, backupSuffix) {
+		var err error
+		if e.Checksum, err = hashFile(a.Path, algo); err != nil {
+			return err
+		}
+	}
+	return appendAudit(path, e)
+}
+
+// findStaleArtifacts walks dir for orphaned temporary tracks, backups older
+// than maxBackupAge and enhanced outputs that are incomplete.
+func findStaleArtifacts(dir string, maxBackupAge time.Duration) ([]staleArtifact, error) {
+	var artifacts []staleArtifact
+	now := time.Now()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		age := now.Sub(info.ModTime())
+
+		switch {
+		case tempTrackRe.MatchString(path) && age > orphanMinAge && !cachedTrack(path):
+			artifacts = append(artifacts, staleArtifact{path, info.Size(), "orphaned temporary track"})
+		case strings.HasSuffix(path, backupSuffix) && age > maxBackupAge:
+			artifacts = append(artifacts, staleArtifact{path, info.Size(), "stale backup"})
+		case isEnhancedOutput(path) && age > orphanMinAge:
+			if reason := incompleteOutputReason(path); reason != "" {
+				artifacts = append(artifacts, staleArtifact{path, info.Size(), reason})
+			}
+		}
+		return nil
+	})
+	return artifacts, err
+}
+
+// cachedTrack reports whether path is a -cache-dir entry, which share the
+// names of temporary tracks: an encode whose manifest matches its size, or
+// the manifest of an existing encode.
+func cachedTrack(path string) bool {
+	track := path
+	if strings.HasSuffix(path, ".json") {
+		track = ""
+		for _, ext := range []string{".opus", ".mka"} {
+			if _, err := os.Stat(strings.TrimSuffix(path, ".json") + ext); err == nil {
+				track = strings.TrimSuffix(path, ".json") + ext
+			}
+		}
+	}
+	if track == "" || strings.Contains(track, ".part") {
+		return false
+	}
+	info, err := os.Stat(track)
+	if err != nil {
+		return false
+	}
+	data, err := os.ReadFile(cacheManifestPath(track))
+	if err != nil {
+		return false
+	}
+	var entry cacheEntry
+	return json.Unmarshal(data, &entry) == nil && entry.Key != "" && entry.Size == info.Size()
+}
+
+// incompleteOutputReason returns why an enhanced output looks incomplete, or
+// "" if it is readable and as long as its source (when the source exists).
+// Only a file ffprobe ran on and rejected counts as unreadable.
+func incompleteOutputReason(output string) string {
+	got, err := probeDuration(output)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "unreadable output"
+	}
+	if err != nil {
+		return ""
+	}
+	source := enhancedSource(output)
+	if source == "" {
+		return ""
+	}
+	want, err := probeDuration(source)
+	if err != nil {
+		return ""
+	}
+	if got < want-durationTolerance*10 {
+		return fmt.Sprintf("truncated output (%.0fs of %.0fs)", got, want)
+	}
+	return ""
+}
+
+// probeDuration returns the container duration of a file in seconds.
+func probeDuration(file string) (float64, error) {
+	output, err := exec.Command(ffprobePath, "-loglevel", "error",
+		"-show_entries", "format=duration", "-of", "default=nw=1:nk=1", file).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed with error: %w", err)
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+}
+
+// confirm asks a yes/no question on stdin, defaulting to no.
+func confirm(question string) bool {
+	fmt.Print(question + " [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// codecProfile describes how new tracks are encoded with one output codec.
+// Adding a codec only needs a new entry in codecProfiles.
+type codecProfile struct {
+	Encoder   string                      // ffmpeg encoder
+	Bitrate   string                      // Default bitrate, empty for lossless codecs
+	Extension string                      // Temporary file extension
+	LFE       bool                        // Can carry a 2.1 layout with its own LFE channel
+	Options   func(opts Options) []string // Encoder options besides codec and bitrate
+}
+
+// codecProfiles are the output codecs selectable with -acodec. Opus is the
+// most efficient; the others are for players without Opus support.
+var codecProfiles = map[string]codecProfile{
+	"opus": {Encoder: "libopus", Bitrate: "320k", Extension: ".opus", Options: func(opts Options) []string {
+		return []string{
+			"-vbr", "on",
+			"-compression_level", strconv.Itoa(opts.CompressionLevel),
+			"-frame_duration", "20",
+			"-application", "audio"}
+	}},
+	"aac":  {Encoder: "aac", Bitrate: "256k", Extension: ".mka", LFE: true},
+	"ac3":  {Encoder: "ac3", Bitrate: "448k", Extension: ".mka", LFE: true, Options: dolbyOptions},
+	"eac3": {Encoder: "eac3", Bitrate: "640k", Extension: ".mka", LFE: true, Options: dolbyOptions},
+	"flac": {Encoder: "flac", Extension: ".mka", Options: func(opts Options) []string {
+		return []string{"-compression_level", strconv.Itoa(min(opts.CompressionLevel, 12))}
+	}},
+}
+
+// dolbyOptions writes the dialogue level receivers normalise AC-3 and E-AC-3
+// to. Without -dialnorm it is the -loudnorm target the tracks were brought
+// to, or ffmpeg's -31, which leaves the level alone. ffmpeg's encoders write
+// no dynamic range compression words, so receivers never compress the
+// downmix; -preset nightmode compresses it when encoding instead.
+func dolbyOptions(opts Options) []string {
+	dialnorm := opts.Dialnorm
+	if dialnorm == 0 && opts.LoudnormTarget != 0 {
+		dialnorm = max(-31, min(-1, int(math.Round(opts.LoudnormTarget))))
+	}
+	if dialnorm == 0 {
+		return nil
+	}
+	return []string{"-dialnorm", strconv.Itoa(dialnorm)}
+}
+
+// lookupCodec returns the profile for an -acodec value: a profile name, the
+// name of a profile's ffmpeg encoder, or any other ffmpeg encoder, which is
+// used with the default bitrate and no further options.
+func lookupCodec(name string) codecProfile {
+	if p, ok := codecProfiles[strings.ToLower(name)]; ok {
+		return p
+	}
+	for _, p := range codecProfiles {
+		if p.Encoder == name {
+			return p
+		}
+	}
+	return codecProfile{Encoder: name, Bitrate: defaultBitrate, Extension: ".mka"}
+}
+
+// codecNames lists the codec profiles for help texts.
+func codecNames() string {
+	var names []string
+	for name := range codecProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// audioEncodeArgs returns the ffmpeg encoder options for enhanced tracks.
+func audioEncodeArgs(opts Options) []string {
+	profile := lookupCodec(opts.AudioCodec)
+	args := []string{"-acodec", profile.Encoder}
+	bitrate := opts.Bitrate
+	if bitrate == "" {
+		bitrate = profile.Bitrate
+	}
+	if bitrate != "" {
+		args = append(args, "-b:a", bitrate)
+	}
+	if profile.Options != nil {
+		args = append(args, profile.Options(opts)...)
+	}
+	return args
+}
+
+// encodeExtension returns the temporary file extension for an -acodec value.
+func encodeExtension(codec string) string {
+	return lookupCodec(codec).Extension
+}
+
+// validateCodec rejects a bitrate for lossless codecs, which would be
+// silently ignored by ffmpeg, and a -dialnorm out of the AC-3 range.
+func validateCodec(opts Options) error {
+	profile := lookupCodec(opts.AudioCodec)
+	if opts.Bitrate != "" && opts.Bitrate != bitrateAuto && profile.Encoder == "flac" {
+		return fmt.Errorf("-bitrate doesn't apply to the lossless %s codec", opts.AudioCodec)
+	}
+	if opts.Dialnorm != 0 && (opts.Dialnorm < -31 || opts.Dialnorm > -1) {
+		return fmt.Errorf("invalid -dialnorm %d: the dialogue level must be between -31 and -1 dB", opts.Dialnorm)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Output containers, selectable with -output-container.
+const (
+	containerMKV  = "mkv"
+	containerMP4  = "mp4"
+	containerSame = "same" // MP4 and M4V sources stay MP4/M4V, everything else becomes MKV
+)
+
+// enhancedSuffix is appended to the source name, before the extension, to
+// name the output.
+const enhancedSuffix = "_enhanced"
+
+// inputExtensions are the file extensions batch runs pick up.
+var inputExtensions = []string{".mkv", ".mp4", ".m4v", ".avi", ".ts"}
+
+// mp4Codecs are the -acodec profiles every MP4 player is expected to handle.
+var mp4Codecs = map[string]bool{"aac": true, "ac3": true, "eac3": true}
+
+// mp4SubtitleCodecs are the subtitle formats the MP4 muxer can copy.
+var mp4SubtitleCodecs = map[string]bool{"mov_text": true, "dvd_subtitle": true}
+
+// isMediaInput reports whether a file has one of the input extensions.
+func isMediaInput(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, e := range inputExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// isEnhancedOutput reports whether a file is named like an output of this
+// tool.
+func isEnhancedOutput(file string) bool {
+	stem := strings.TrimSuffix(file, filepath.Ext(file))
+	return isMediaInput(file) && strings.HasSuffix(strings.ToLower(stem), enhancedSuffix)
+}
+
+// isMatroska reports whether a file is written as Matroska, by its name.
+func isMatroska(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	return ext == ".mkv" || ext == ".mka"
+}
+
+// validateOutputContainer checks an -output-container value.
+func validateOutputContainer(container string) error {
+	switch container {
+	case "", containerMKV, containerMP4, containerSame:
+		return nil
+	}
+	return fmt.Errorf("unknown output container %q (use %s, %s or %s)", container, containerMKV, containerMP4, containerSame)
+}
+
+// probeFormat returns ffprobe's format name for a file, e.g. "matroska,webm"
+// or "mov,mp4,m4a,3gp,3g2,mj2". The extension isn't trusted, since renamed
+// files are common.
+func probeFormat(file string) (string, error) {
+	output, err := exec.Command(ffprobePath, "-loglevel", "error",
+		"-show_entries", "format=format_name", "-of", "default=nw=1:nk=1", file).Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe failed with error: %s", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// containerFamily maps an ffprobe format name to the input containers this
+// tool handles, or "" for anything else.
+func containerFamily(format string) string {
+	for _, name := range strings.Split(format, ",") {
+		switch name {
+		case "matroska":
+			return containerMKV
+		case "mp4", "mov":
+			return containerMP4
+		case "avi":
+			return "avi"
+		case "mpegts":
+			return "ts"
+		}
+	}
+	return ""
+}
+
+// enhancedOutputPath returns the output file for an input: its name with
+// enhancedSuffix and the extension of the output container. With "same",
+// the input's container is probed.
+func enhancedOutputPath(input, container string) (string, error) {
+	ext := filepath.Ext(input)
+	stem := strings.TrimSuffix(input, ext)
+	switch container {
+	case containerMP4:
+		return stem + enhancedSuffix + ".mp4", nil
+	case containerSame:
+		format, err := probeFormat(input)
+		if err != nil {
+			return "", err
+		}
+		if containerFamily(format) == containerMP4 {
+			if strings.EqualFold(ext, ".m4v") {
+				return stem + enhancedSuffix + ".m4v", nil
+			}
+			return stem + enhancedSuffix + ".mp4", nil
+		}
+	}
+	return stem + enhancedSuffix + ".mkv", nil
+}
+
+// outputPath returns where the output of an input is written: the
+// enhancedOutputPath, moved into -output-dir if one is set.
+func outputPath(input string, opts Options) (string, error) {
+	output, err := enhancedOutputPath(input, opts.OutputContainer)
+	if err != nil || opts.OutputDir == "" {
+		return output, err
+	}
+	return filepath.Join(opts.OutputDir, filepath.Base(output)), nil
+}
+
+// enhancedSource returns the existing source of an output named by
+// enhancedOutputPath, or "" if there is none.
+func enhancedSource(output string) string {
+	stem := strings.TrimSuffix(output, filepath.Ext(output))
+	stem = stem[:len(stem)-len(enhancedSuffix)]
+	for _, ext := range inputExtensions {
+		for _, candidate := range []string{stem + ext, stem + strings.ToUpper(ext)} {
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+// checkInputContainer rejects sources in containers the tool doesn't handle.
+// Metadata-only runs edit the source with mkvpropedit, so they need MKV.
+func checkInputContainer(input string, opts Options) error {
+	format, err := probeFormat(input)
+	if err != nil {
+		return fmt.Errorf("reading the container format failed: %v", err)
+	}
+	family := containerFamily(format)
+	if family == "" {
+		return fmt.Errorf("unsupported container %q (supported are MKV, MP4/M4V, AVI and MPEG-TS)", format)
+	}
+	if opts.MetadataOnly && family != containerMKV {
+		return fmt.Errorf("-metadata-only needs an MKV source, %s is %s", input, format)
+	}
+	return nil
+}
+
+// validateContainerPlan checks that the plan's streams, codec and options
+// fit its output container. MP4 only takes the codecs common players
+// decode, and features written with MKVToolNix need Matroska.
+func validateContainerPlan(plan *Plan, opts Options) error {
+	if plan.MetadataOnly {
+		return nil
+	}
+	if plan.Replace && !strings.EqualFold(filepath.Ext(plan.Output), filepath.Ext(plan.Input)) {
+		return fmt.Errorf("-replace can't change the container of %s; use -output-container same", plan.Input)
+	}
+	if isMatroska(plan.Output) {
+		return nil
+	}
+	if plan.StatisticsTags || plan.PreserveUIDs || plan.PreserveEditions {
+		return fmt.Errorf("-stats-tags, -preserve-uids and -preserve-editions need MKV output")
+	}
+	codec := strings.ToLower(opts.AudioCodec)
+	if !mp4Codecs[codec] && !(codec == "opus" && opts.MP4Opus) {
+		return fmt.Errorf("%s tracks aren't supported by most MP4 players; use -acodec aac, ac3 or eac3, -output-container mkv, or -mp4-opus for Opus", opts.AudioCodec)
+	}
+	for _, s := range plan.Streams {
+		if s.Action != "keep" {
+			continue
+		}
+		if s.Type == "attachment" || (s.Type == "subtitle" && !mp4SubtitleCodecs[s.Codec]) {
+			return fmt.Errorf("stream %d (%s %s) can't be stored in MP4; use -output-container mkv", s.Index, s.Type, s.Codec)
+		}
+	}
+	return nil
+}
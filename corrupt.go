@@ -0,0 +1,36 @@
+package main
+
+import "strings"
+
+// corruptToleranceArgs are the ffmpeg input options used with -tolerate-corrupt:
+// decoder errors are ignored and corrupt packets dropped instead of failing.
+var corruptToleranceArgs = []string{"-err_detect", "ignore_err", "-fflags", "+discardcorrupt"}
+
+// inputArgs returns the ffmpeg options for reading the plan's source from
+// input, which is the source file or a pipe carrying it.
+func (p *Plan) inputArgs(input string) []string {
+	args := []string{}
+	if p.TolerateCorrupt {
+		args = append(args, corruptToleranceArgs...)
+	}
+	return append(args, "-i", input)
+}
+
+// isCorruptionMessage reports whether an ffmpeg log line is about a corrupt
+// packet or a frame that failed to decode.
+func isCorruptionMessage(line string) bool {
+	return strings.Contains(line, "Packet corrupt") ||
+		strings.Contains(line, "corrupt decoded frame") ||
+		strings.Contains(line, "Error while decoding stream")
+}
+
+// countCorruption counts the corruption messages in ffmpeg output.
+func countCorruption(output string) int {
+	n := 0
+	for _, line := range strings.Split(output, "\n") {
+		if isCorruptionMessage(line) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Seek index (Matroska cues) handling, selectable with -cues.
+const (
+	cuesOff    = "off"
+	cuesCheck  = "check"  // Report outputs without usable cues
+	cuesRepair = "repair" // Rebuild missing cues with mkvmerge or mkclean
+)
+
+// validateCues checks a -cues value.
+func validateCues(mode string) error {
+	switch mode {
+	case "", cuesOff, cuesCheck, cuesRepair:
+		return nil
+	}
+	return fmt.Errorf("unknown cues mode %q (use %s, %s or %s)", mode, cuesOff, cuesCheck, cuesRepair)
+}
+
+// checksCues reports whether the plan's output gets its seek index checked.
+// Only Matroska has cues; MP4 indexes every sample anyway.
+func (p *Plan) checksCues() bool {
+	return p.Cues != cuesOff && isMatroska(p.Output)
+}
+
+// describeUncued names the tracks lacking cue points.
+func describeUncued(tracks []MatroskaTrack) string {
+	var numbers []string
+	for _, t := range tracks {
+		numbers = append(numbers, fmt.Sprint(t.Number))
+	}
+	return "no cue points for track " + strings.Join(numbers, ", ")
+}
+
+// repairCues rebuilds the seek index of a merged output that lacks cues for
+// the tracks players seek by. Some ffmpeg remuxes leave them out, and TVs
+// then seek slowly or not at all. mkvmerge is preferred, mkclean is used if
+// it isn't installed.
+func repairCues(plan *Plan) error {
+	info, err := readMatroskaInfo(plan.Output)
+	if err != nil {
+		return fmt.Errorf("reading the cues failed: %v", err)
+	}
+	missing := info.uncuedTracks()
+	if len(missing) == 0 {
+		return nil
+	}
+	fmt.Printf("Output has %s, rebuilding the seek index\n", describeUncued(missing))
+
+	fixed := partialPath(plan.Output, plan.JobID+"-cues")
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("mkvmerge"); err == nil {
+		cmd = exec.Command("mkvmerge", "--quiet", "-o", fixed, plan.Output)
+	} else if _, err := exec.LookPath("mkclean"); err == nil {
+		cmd = exec.Command("mkclean", "--quiet", plan.Output, fixed)
+	} else {
+		return fmt.Errorf("-cues repair needs mkvmerge (MKVToolNix) or mkclean")
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	// mkvmerge exits with 1 if it only printed warnings
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && cmd.Args[0] == "mkvmerge") {
+		os.Remove(fixed)
+		return fmt.Errorf("%s failed: %v\nOutput: %s", cmd.Args[0], err, output.String())
+	}
+	if err := os.Rename(fixed, plan.Output); err != nil {
+		os.Remove(fixed)
+		return err
+	}
+	fmt.Println("Rebuilt the seek index with", cmd.Args[0])
+	return nil
+}
+
+// verifyCues checks that the output has cue points for the tracks players
+// seek by and records the result for the job summary. Missing cues fail
+// the verification only with -cues repair, which should have added them.
+func verifyCues(plan *Plan) error {
+	info, err := readMatroskaInfo(plan.Output)
+	if err != nil {
+		return fmt.Errorf("reading the cues failed: %v", err)
+	}
+	missing := info.uncuedTracks()
+	switch {
+	case len(missing) > 0:
+		plan.seekIndex = describeUncued(missing)
+		if plan.Cues == cuesRepair {
+			return fmt.Errorf("output still has %s after rebuilding the seek index", plan.seekIndex)
+		}
+		fmt.Printf("Warning: output has %s and may seek poorly on TVs; use -cues repair to rebuild them\n", plan.seekIndex)
+	case info.CuePoints < 0:
+		plan.seekIndex = "present"
+	default:
+		plan.seekIndex = fmt.Sprintf("%d cue points", info.CuePoints)
+	}
+	fmt.Println("Seek index:", plan.seekIndex)
+	return nil
+}
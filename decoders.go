@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// decoderFlag collects -decoder options of the form "codec=command" or
+// "codec/profile=command".
+type decoderFlag map[string]string
+
+func (d decoderFlag) String() string {
+	var parts []string
+	for key, cmd := range d {
+		parts = append(parts, key+"="+cmd)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Set adds a decoder. An empty value removes all decoders, which is how
+// settings are reset between files.
+func (d decoderFlag) Set(value string) error {
+	if value == "" {
+		for key := range d {
+			delete(d, key)
+		}
+		return nil
+	}
+	key, cmd, ok := strings.Cut(value, "=")
+	if !ok || strings.TrimSpace(key) == "" || strings.TrimSpace(cmd) == "" {
+		return fmt.Errorf("expected codec=command, got %q", value)
+	}
+	d[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(cmd)
+	return nil
+}
+
+// decoderCommand returns the external decoder configured for a stream,
+// expanded for the source file, or "" to decode with ffmpeg. A decoder for
+// "codec/profile" takes precedence over one for the whole codec.
+func decoderCommand(decoders map[string]string, s ffprobeStream, file string) string {
+	codec := strings.ToLower(s.CodecName)
+	cmd, ok := decoders[codec+"/"+strings.ToLower(s.Profile)]
+	if !ok {
+		cmd, ok = decoders[codec]
+	}
+	if !ok {
+		return ""
+	}
+	return strings.NewReplacer(
+		"{input}", shellQuote(file),
+		"{index}", strconv.Itoa(s.Index),
+	).Replace(cmd)
+}
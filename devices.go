@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// deviceDirName holds user device profiles inside the user config directory,
+// one "<name>.yaml" settings file per device.
+const deviceDirName = "mkv-5.1to2.1/devices"
+
+// deviceProfile is the settings known to work on a playback device. Keys
+// are long flag names, like in configuration files and sidecars.
+type deviceProfile struct {
+	Name     string
+	Settings map[string]string
+}
+
+// builtinDevices are the devices selectable with -device out of the box.
+// TVs get the -24 LUFS broadcast loudness their speakers are tuned for;
+// soundbars and receivers get Dolby Digital, which every one of them
+// decodes, with the LFE kept on its own channel for the subwoofer.
+var builtinDevices = []deviceProfile{
+	{"LG C2", map[string]string{"acodec": "eac3", "layout": layoutStereo, "loudnorm": "-24"}},
+	{"Samsung TV", map[string]string{"acodec": "eac3", "layout": layoutStereo, "loudnorm": "-24"}},
+	{"Sony Bravia", map[string]string{"acodec": "eac3", "layout": layoutStereo, "loudnorm": "-24"}},
+	{"Apple TV", map[string]string{"acodec": "aac", "layout": layoutStereo}},
+	{"Roku", map[string]string{"acodec": "aac", "layout": layoutStereo, "loudnorm": "-24"}},
+	{"Chromecast", map[string]string{"acodec": "opus", "layout": layoutStereo}},
+	{"Soundbar 2.1", map[string]string{"acodec": "ac3", "layout": layout21}},
+	{"AV receiver", map[string]string{"acodec": "eac3", "layout": layout21}},
+	{"Headphones", map[string]string{"acodec": "opus", "layout": layoutStereo, "loudnorm": "-16"}},
+}
+
+// deviceKey normalises a device name for lookups, so "lg c2" and "LG-C2"
+// find the same profile.
+func deviceKey(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_'
+	}), " ")
+}
+
+// userDeviceDir returns the directory of user device profiles, or "".
+func userDeviceDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, deviceDirName)
+}
+
+// loadDevices returns the built-in device profiles and the user's, which
+// replace built-in ones of the same name.
+func loadDevices() ([]deviceProfile, error) {
+	devices := make(map[string]deviceProfile)
+	for _, d := range builtinDevices {
+		devices[deviceKey(d.Name)] = d
+	}
+	if dir := userDeviceDir(); dir != "" {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.yaml"))
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			settings, err := parseSimpleYAML(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			name := strings.TrimSuffix(filepath.Base(file), ".yaml")
+			devices[deviceKey(name)] = deviceProfile{name, settings}
+		}
+	}
+
+	var list []deviceProfile
+	for _, d := range devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return deviceKey(list[i].Name) < deviceKey(list[j].Name) })
+	return list, nil
+}
+
+// findDevice returns the profile of a -device name.
+func findDevice(name string) (deviceProfile, error) {
+	devices, err := loadDevices()
+	if err != nil {
+		return deviceProfile{}, err
+	}
+	var names []string
+	for _, d := range devices {
+		if deviceKey(d.Name) == deviceKey(name) {
+			return d, nil
+		}
+		names = append(names, d.Name)
+	}
+	return deviceProfile{}, fmt.Errorf("unknown device %q (known: %s)", name, strings.Join(names, ", "))
+}
+
+// loadDevice applies the -device profile to every flag still at its
+// default, so flags, sidecars and the configuration file all take
+// precedence over it.
+func loadDevice(explicit map[string]bool) error {
+	f := flag.Lookup("device")
+	if f == nil || f.Value.String() == "" {
+		return nil
+	}
+	device, err := findDevice(f.Value.String())
+	if err != nil {
+		return err
+	}
+	for key, value := range device.Settings {
+		target := flag.Lookup(key)
+		if target == nil {
+			return fmt.Errorf("device %s: unknown setting %q", device.Name, key)
+		}
+		if hardeningSettings[key] {
+			return fmt.Errorf("device %s: %q only works on the command line", device.Name, key)
+		}
+		if explicit[key] || target.Value.String() != target.DefValue {
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return fmt.Errorf("device %s: %s: %v", device.Name, key, err)
+		}
+	}
+	return nil
+}
+
+// printDevices lists the device profiles for "-device list".
+func printDevices() error {
+	devices, err := loadDevices()
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		var keys []string
+		for key := range d.Settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var settings []string
+		for _, key := range keys {
+			settings = append(settings, key+"="+d.Settings[key])
+		}
+		fmt.Printf("%-14s %s\n", d.Name, strings.Join(settings, " "))
+	}
+	if dir := userDeviceDir(); dir != "" {
+		fmt.Printf("\nAdd or override devices with settings files in %s (keys are flag names).\n", dir)
+	}
+	return nil
+}
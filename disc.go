@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Disc folder formats, named after the ffmpeg input that reads them.
+const (
+	discBluray = "bluray"
+	discDVD    = "dvdvideo"
+)
+
+// maxDVDTitles is the highest title number a DVD can have.
+const maxDVDTitles = 99
+
+// discFolder reports whether path is a Blu-ray or DVD folder backup, given
+// either as the disc root or as its BDMV/VIDEO_TS directory, and returns the
+// disc root and format.
+func discFolder(path string) (root, format string, ok bool) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return "", "", false
+	}
+	root = filepath.Clean(path)
+	switch strings.ToUpper(filepath.Base(root)) {
+	case "BDMV", "VIDEO_TS":
+		root = filepath.Dir(root)
+	}
+	if _, err := os.Stat(filepath.Join(root, "BDMV", "index.bdmv")); err == nil {
+		return root, discBluray, true
+	}
+	if _, err := os.Stat(filepath.Join(root, "VIDEO_TS", "VIDEO_TS.IFO")); err == nil {
+		return root, discDVD, true
+	}
+	return "", "", false
+}
+
+// discInputArgs returns the ffmpeg input options for a title of a disc;
+// title 0 lets ffmpeg pick the longest Blu-ray playlist.
+func discInputArgs(root, format string, title int) []string {
+	if format == discBluray {
+		args := []string{"-analyzeduration", "100M", "-probesize", "100M"}
+		if title > 0 {
+			args = append(args, "-playlist", strconv.Itoa(title))
+		}
+		return append(args, "-i", "bluray:"+root)
+	}
+	return []string{"-analyzeduration", "100M", "-probesize", "100M",
+		"-f", "dvdvideo", "-title", strconv.Itoa(title), "-i", root}
+}
+
+// mainDVDTitle returns the longest title of a DVD, which is the feature on
+// practically every disc; menus, trailers and extras are much shorter.
+func mainDVDTitle(root string) (int, error) {
+	best, longest := 0, 0.0
+	for title := 1; title <= maxDVDTitles; title++ {
+		args := append([]string{"-loglevel", "error"}, discInputArgs(root, discDVD, title)...)
+		args = append(args, "-show_entries", "format=duration", "-of", "default=nw=1:nk=1")
+		output, err := exec.Command(ffprobePath, args...).Output()
+		if err != nil {
+			break // No more titles
+		}
+		if d, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64); err == nil && d > longest {
+			best, longest = title, d
+		}
+	}
+	if best == 0 {
+		return 0, fmt.Errorf("no playable title found on %s (ffmpeg needs the dvdvideo demuxer)", root)
+	}
+	fmt.Printf("Selected DVD title %d (%s)\n", best, humanDuration(longest))
+	return best, nil
+}
+
+// remuxDisc copies the main title of a disc folder, or the given title or
+// Blu-ray playlist number, into an MKV next to the folder and returns its
+// path. An existing remux is reused, so re-running the conversion doesn't
+// read the disc again.
+func remuxDisc(ctx context.Context, root, format string, title int) (string, error) {
+	output := root + ".mkv"
+	if _, err := os.Stat(output); err == nil {
+		fmt.Println("Using existing remux of the disc:", output)
+		return output, nil
+	}
+	if format == discDVD && title == 0 {
+		var err error
+		if title, err = mainDVDTitle(root); err != nil {
+			return "", err
+		}
+	}
+
+	fmt.Printf("Remuxing the main title of %s to %s...\n", root, output)
+	partial := partialPath(output, newJobID())
+	args := append([]string{"-hide_banner", "-loglevel", "warning"}, discInputArgs(root, format, title)...)
+	args = append(args, "-map", "0", "-c", "copy", "-ignore_unknown", "-y", partial)
+	cmd := interruptibleCommand(ctx, ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(partial)
+		return "", fmt.Errorf("remuxing disc failed: %v\nOutput: %s", err, stderr.String())
+	}
+	if err := os.Rename(partial, output); err != nil {
+		return "", err
+	}
+	return output, nil
+}
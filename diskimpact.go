@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DiskImpact is the projected disk usage of executing a plan. Sizes are
+// estimates from stream bitrates and the source duration.
+type DiskImpact struct {
+	InputSize   int64              `json:"input_size"`   // Size of the source file
+	EncodeSize  int64              `json:"encode_size"`  // Encoded tracks written before the merge
+	DroppedSize int64              `json:"dropped_size"` // Source streams left out of the output
+	OutputSize  int64              `json:"output_size"`  // Estimated size of the output file
+	Filesystems []FilesystemImpact `json:"filesystems"`
+	Notes       []string           `json:"notes,omitempty"` // Limits of the estimate
+}
+
+// FilesystemImpact is the projected usage on one filesystem.
+type FilesystemImpact struct {
+	Path  string `json:"path"`           // A directory on the filesystem
+	Peak  int64  `json:"peak"`           // Most space used at once while running
+	Final int64  `json:"final"`          // Space still used when the job is done
+	Free  int64  `json:"free,omitempty"` // Currently available space, 0 if unknown
+}
+
+// Fits reports whether the peak usage fits in the free space, if known.
+func (f FilesystemImpact) Fits() bool {
+	return f.Free == 0 || f.Peak <= f.Free
+}
+
+// estimateDiskImpact models the disk usage of a plan: the source is staged
+// and the encodes are written first, then the output is merged while they
+// still exist.
+func estimateDiskImpact(plan *Plan, streams []ffprobeStream) (*DiskImpact, error) {
+	info, err := os.Stat(plan.Input)
+	if err != nil {
+		return nil, err
+	}
+	duration, err := probeDuration(plan.Input)
+	if err != nil {
+		return nil, err
+	}
+	impact := &DiskImpact{InputSize: info.Size()}
+
+	for _, enc := range plan.Encodes {
+		impact.EncodeSize += int64(encoderBitrate(enc.EncoderArgs) / 8 * duration)
+	}
+	for _, s := range streams {
+		if plan.keeps(s.Index) {
+			continue
+		}
+		size, ok := streamSize(s, duration)
+		if !ok {
+			impact.Notes = append(impact.Notes, fmt.Sprintf("size of dropped stream #%d is unknown", s.Index))
+		}
+		impact.DroppedSize += size
+	}
+	if plan.reencodesVideo() {
+		impact.Notes = append(impact.Notes, "re-encoded video is assumed to keep its size")
+	}
+	impact.OutputSize = max(0, impact.InputSize-impact.DroppedSize+impact.EncodeSize)
+
+	// Encodes live in the cache or next to the input, the output may be
+	// elsewhere. A staged copy of the source and the encodes are still
+	// there while the output is merged, so together they make the peak.
+	encodeDir := filepath.Dir(plan.Input)
+	if len(plan.Encodes) > 0 {
+		encodeDir = filepath.Dir(plan.Encodes[0].TempFile)
+	}
+	finalEncodes := int64(0)
+	if plan.KeepEncodes {
+		finalEncodes = impact.EncodeSize
+	}
+	output := diskUse{filepath.Dir(plan.Output), impact.OutputSize, impact.OutputSize}
+	if plan.Publish != "" {
+		// Merged into the workspace and moved to the publish target from there
+		output = diskUse{existingAncestor(plan.workspaceDir()), impact.OutputSize, 0}
+		impact.Notes = append(impact.Notes, "space at the publish target isn't checked")
+	}
+	uses := []diskUse{output, {encodeDir, impact.EncodeSize, finalEncodes}}
+	if plan.StageDir != "" {
+		uses = append(uses, diskUse{plan.StageDir, impact.InputSize, 0})
+	}
+
+	devs := make(map[int]uint64) // Filesystems by position, if known
+	for _, use := range uses {
+		dev, free, ok := filesystemInfo(use.dir)
+		shared := -1
+		for i, fs := range impact.Filesystems {
+			if d, known := devs[i]; fs.Path == use.dir || ok && known && d == dev {
+				shared = i
+				break
+			}
+		}
+		if shared < 0 {
+			shared = len(impact.Filesystems)
+			impact.Filesystems = append(impact.Filesystems, FilesystemImpact{Path: use.dir, Free: free})
+			if ok {
+				devs[shared] = dev
+			}
+		}
+		impact.Filesystems[shared].Peak += use.peak
+		impact.Filesystems[shared].Final += use.final
+	}
+	return impact, nil
+}
+
+// diskUse is the space a plan takes up in one directory.
+type diskUse struct {
+	dir         string
+	peak, final int64
+}
+
+// diskSpaceReserve is kept free on top of the estimate, which is derived
+// from bitrates and can be off by a few percent.
+const diskSpaceReserve = 256 << 20
+
+// checkDiskSpace fails a plan whose estimated peak usage doesn't fit in the
+// space free right now, before anything is written. Plans without an
+// estimate, or filesystems whose free space is unknown, pass.
+func checkDiskSpace(plan *Plan) error {
+	if plan.Disk == nil || plan.IgnoreDiskSpace {
+		return nil
+	}
+	for _, fs := range plan.Disk.Filesystems {
+		_, free, ok := filesystemInfo(fs.Path)
+		if !ok || free == 0 {
+			continue
+		}
+		if fs.Peak+diskSpaceReserve > free {
+			return fmt.Errorf("not enough disk space in %s: about %s are needed, %s are free (use -temp-dir, -output-dir or -stage-dir on another disk, or -ignore-disk-space)",
+				fs.Path, humanSize(fs.Peak+diskSpaceReserve), humanSize(free))
+		}
+	}
+	return nil
+}
+
+// encoderBitrate returns the -b:a bitrate of encoder options in bits per
+// second, or 0 if none is set.
+func encoderBitrate(args []string) float64 {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-b:a" {
+			return parseBitrate(args[i+1])
+		}
+	}
+	return 0
+}
+
+// parseBitrate parses an ffmpeg bitrate such as "320k" or "1.5M".
+func parseBitrate(s string) float64 {
+	factor := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"):
+		factor, s = 1e3, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "M"):
+		factor, s = 1e6, strings.TrimSuffix(s, "M")
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return v * factor
+}
+
+// streamSize estimates the bytes a stream takes up, preferring the
+// statistics tags written by mkvmerge over ffprobe's bitrate.
+func streamSize(s ffprobeStream, duration float64) (int64, bool) {
+	for key, value := range s.Tags {
+		if strings.HasPrefix(key, "NUMBER_OF_BYTES") {
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return n, true
+			}
+		}
+	}
+	bitrate := parseBitrate(s.BitRate)
+	for key, value := range s.Tags {
+		if bitrate == 0 && (key == "BPS" || strings.HasPrefix(key, "BPS-")) {
+			bitrate = parseBitrate(value)
+		}
+	}
+	if bitrate == 0 {
+		return 0, false
+	}
+	return int64(bitrate / 8 * duration), true
+}
+
+// printDiskImpact shows the projected disk usage in the text plan.
+func printDiskImpact(impact *DiskImpact) {
+	fmt.Printf("  disk:     encodes %s, dropped streams %s, output ~%s (source %s)\n",
+		humanSize(impact.EncodeSize), humanSize(impact.DroppedSize), humanSize(impact.OutputSize), humanSize(impact.InputSize))
+	for _, fs := range impact.Filesystems {
+		line := fmt.Sprintf("            %s: peak +%s, final +%s", fs.Path, humanSize(fs.Peak), humanSize(fs.Final))
+		if fs.Free > 0 {
+			line += fmt.Sprintf(", %s free", humanSize(fs.Free))
+			if !fs.Fits() {
+				line += " - DOES NOT FIT"
+			}
+		}
+		fmt.Println(line)
+	}
+	for _, note := range impact.Notes {
+		fmt.Println("            note:", note)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// filesystemInfo returns the device a path lives on and the space available
+// to unprivileged users.
+func filesystemInfo(path string) (dev uint64, free int64, ok bool) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, 0, false
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return uint64(st.Dev), 0, true
+	}
+	return uint64(st.Dev), int64(fs.Bavail) * int64(fs.Bsize), true
+}
@@ -0,0 +1,7 @@
+package main
+
+// filesystemInfo is not implemented on Windows; every directory is treated
+// as its own filesystem with unknown free space.
+func filesystemInfo(path string) (dev uint64, free int64, ok bool) {
+	return 0, 0, false
+}
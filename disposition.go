@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Policies for which audio track is flagged as the default, see -default-audio.
+const (
+	defaultAudioOriginal = "original" // The source's default track stays the default
+	defaultAudioEnhanced = "enhanced" // Its enhanced version becomes the default
+)
+
+// inheritedDispositions are the flags an enhanced track takes over from its
+// source, since they describe the content rather than the mix.
+var inheritedDispositions = []string{"comment", "hearing_impaired", "visual_impaired", "descriptions", "dub", "original"}
+
+// validateDefaultAudio checks the -default-audio value.
+func validateDefaultAudio(policy string) error {
+	switch policy {
+	case "", defaultAudioOriginal, defaultAudioEnhanced:
+		return nil
+	}
+	return fmt.Errorf("invalid -default-audio %q (%s or %s)", policy, defaultAudioOriginal, defaultAudioEnhanced)
+}
+
+// encodeDisposition returns the disposition of an enhanced version of track.
+func encodeDisposition(track TrackInfo) string {
+	var flags []string
+	for _, name := range inheritedDispositions {
+		if track.Disposition[name] == 1 {
+			flags = append(flags, name)
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// applyDefaultAudio moves the default flag from the source's default audio
+// track, or the first kept one if none is flagged, to its first enhanced
+// version when the policy asks for it.
+func applyDefaultAudio(plan *Plan, policy string) {
+	if policy != defaultAudioEnhanced || len(plan.Encodes) == 0 {
+		return
+	}
+	source := -1
+	for _, s := range plan.Streams {
+		if s.Type != "audio" || s.Action != "keep" {
+			continue
+		}
+		if hasDisposition(s.Disposition, "default") {
+			source = s.Index
+			break
+		}
+		if source < 0 {
+			source = s.Index
+		}
+	}
+
+	target := -1
+	for i, enc := range plan.Encodes {
+		if enc.SourceIndex == source {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		return // The default track isn't downmixed
+	}
+	for i := range plan.Streams {
+		if plan.Streams[i].Type == "audio" {
+			plan.Streams[i].Disposition = setDisposition(plan.Streams[i].Disposition, "default", false)
+		}
+	}
+	plan.Encodes[target].Disposition = setDisposition(plan.Encodes[target].Disposition, "default", true)
+}
+
+// hasDisposition reports whether a comma separated disposition list
+// contains flag.
+func hasDisposition(disposition, flag string) bool {
+	for _, f := range strings.Split(disposition, ",") {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// setDisposition adds flag to or removes it from a comma separated
+// disposition list.
+func setDisposition(disposition, flag string, set bool) string {
+	var flags []string
+	for _, f := range strings.Split(disposition, ",") {
+		if f != "" && f != flag {
+			flags = append(flags, f)
+		}
+	}
+	if set {
+		flags = append([]string{flag}, flags...)
+	}
+	return strings.Join(flags, ",")
+}
+
+// dispositionArgs returns the ffmpeg option setting exactly the listed
+// flags on an output stream, clearing any others.
+func dispositionArgs(outIndex int, disposition string) []string {
+	value := strings.ReplaceAll(disposition, ",", "+")
+	if value == "" {
+		value = "0"
+	}
+	return []string{fmt.Sprintf("-disposition:%d", outIndex), value}
+}
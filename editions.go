@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// checkEditions warns when a file has ordered chapters or several editions,
+// which an ffmpeg remux flattens into a single linear chapter list.
+func checkEditions(file string, preserve bool) []Warning {
+	info, err := readMatroskaInfo(file)
+	if err != nil || (info.OrderedEditions == 0 && info.Editions <= 1) {
+		return nil
+	}
+	if preserve {
+		fmt.Printf("Found %d edition(s), %d with ordered chapters; they will be copied with MKVToolNix\n", info.Editions, info.OrderedEditions)
+		return nil
+	}
+	return []Warning{{
+		Code: "editions-flattened",
+		Message: fmt.Sprintf("file has %d edition(s), %d with ordered chapters; the remux keeps only a linear chapter list "+
+			"and playback order will change, use -preserve-editions (requires MKVToolNix) to keep them", info.Editions, info.OrderedEditions),
+	}}
+}
+
+// copyEditions replaces the chapters of the plan's output with the complete
+// chapter structure (all editions, ordered flags) of its source.
+func copyEditions(plan *Plan) error {
+	for _, tool := range []string{"mkvextract", "mkvpropedit"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s (MKVToolNix) is required to preserve editions: %v", tool, err)
+		}
+	}
+
+	chapters := plan.workPath("chapters.xml")
+	defer os.Remove(chapters)
+
+	for _, args := range [][]string{
+		{"mkvextract", plan.Input, "chapters", chapters},
+		{"mkvpropedit", plan.Output, "--chapters", chapters},
+	} {
+		cmd := exec.Command(args[0], args[1:]...)
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s failed: %v\nOutput: %s", args[0], err, out.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build linux && (amd64 || arm64 || riscv64 || ppc64 || ppc64le || s390x || loong64 || mips64 || mips64le)
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Advice for fadvise(2).
+const (
+	fadvSequential = 2
+	fadvWillNeed   = 3
+)
+
+// adviseSequential tells the kernel f is read front to back, which widens
+// its readahead window.
+func adviseSequential(f *os.File) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvSequential, 0, 0)
+}
+
+// adviseWillNeed asks the kernel to start reading length bytes of f at
+// offset in the background.
+func adviseWillNeed(f *os.File, offset, length int64) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(offset), uintptr(length), fadvWillNeed, 0, 0)
+}
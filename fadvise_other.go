@@ -0,0 +1,12 @@
+//go:build !(linux && (amd64 || arm64 || riscv64 || ppc64 || ppc64le || s390x || loong64 || mips64 || mips64le))
+
+package main
+
+import "os"
+
+// adviseSequential does nothing where fadvise is not available, or takes
+// its offsets in register pairs as on 32-bit Linux.
+func adviseSequential(f *os.File) {}
+
+// adviseWillNeed does nothing where adviseSequential doesn't either.
+func adviseWillNeed(f *os.File, offset, length int64) {}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// PlanExclusion records an encode that was left out of the output.
+type PlanExclusion struct {
+	SourceIndex int    `json:"source_index"` // Source stream of the failed encode
+	Attempts    int    `json:"attempts"`     // How often it was tried
+	Error       string `json:"error"`        // Error of the last attempt
+}
+
+// encodeTracks runs all encodes of the plan, retrying each up to
+// plan.TrackAttempts times. It returns the last error of every encode that
+// never succeeded, by position in plan.Encodes.
+func encodeTracks(ctx context.Context, plan *Plan, jobs *jobLimiter) map[int]error {
+	attempts := max(1, plan.TrackAttempts)
+	failures := make(map[int]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, enc := range plan.Encodes {
+		wg.Add(1)
+		go func(i int, enc PlanEncode) {
+			defer wg.Done()
+			for attempt := 1; ; attempt++ {
+				err := processTrack(ctx, plan, enc, jobs)
+				if err == nil {
+					return
+				}
+				if ctx.Err() != nil {
+					err = errInterrupted
+				} else {
+					fmt.Printf("Encoding track %d failed (attempt %d of %d): %v\n", enc.SourceIndex, attempt, attempts, err)
+				}
+				if attempt >= attempts || ctx.Err() != nil {
+					mu.Lock()
+					failures[i] = err
+					mu.Unlock()
+					return
+				}
+			}
+		}(i, enc)
+	}
+	wg.Wait()
+	return failures
+}
+
+// excludeFailedTracks removes failed encodes from the plan and records them,
+// or fails if the plan doesn't allow leaving tracks out. An original that
+// was dropped in favour of a failed encode is kept again, with the default
+// flag the encode took over.
+func excludeFailedTracks(plan *Plan, failures map[int]error) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	if !plan.SkipFailedTracks {
+		for i, enc := range plan.Encodes {
+			if err, failed := failures[i]; failed {
+				return fmt.Errorf("encoding track %d failed: %v", enc.SourceIndex, err)
+			}
+		}
+	}
+
+	var kept, excluded []PlanEncode
+	for i, enc := range plan.Encodes {
+		err, failed := failures[i]
+		if !failed {
+			kept = append(kept, enc)
+			continue
+		}
+		excluded = append(excluded, enc)
+		plan.Excluded = append(plan.Excluded, PlanExclusion{
+			SourceIndex: enc.SourceIndex,
+			Attempts:    max(1, plan.TrackAttempts),
+			Error:       err.Error(),
+		})
+		fmt.Printf("Excluding the enhanced version of track %d from the output\n", enc.SourceIndex)
+	}
+	plan.Encodes = kept
+
+	for _, enc := range excluded {
+		if err := restoreOriginal(plan, enc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreOriginal hands what a failed encode took over from its source
+// track back: the track itself if it was dropped and no other encode of it
+// is left, and the default flag.
+func restoreOriginal(plan *Plan, enc PlanEncode) error {
+	isDefault := hasDisposition(enc.Disposition, "default")
+	for i := range plan.Encodes {
+		if plan.Encodes[i].SourceIndex == enc.SourceIndex {
+			if isDefault {
+				plan.Encodes[i].Disposition = setDisposition(plan.Encodes[i].Disposition, "default", true)
+			}
+			return nil
+		}
+	}
+	for i := range plan.Streams {
+		s := &plan.Streams[i]
+		if s.Index != enc.SourceIndex {
+			continue
+		}
+		if s.Action == "drop" {
+			if plan.Tempo != 0 {
+				return fmt.Errorf("encoding track %d failed and -tempo can't copy its original instead", enc.SourceIndex)
+			}
+			s.Action = "keep"
+			fmt.Printf("Keeping the original track %d instead\n", enc.SourceIndex)
+		}
+		if isDefault {
+			s.Disposition = setDisposition(s.Disposition, "default", true)
+		}
+		return nil
+	}
+	return nil
+}
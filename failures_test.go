@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// droppedOriginalPlan is a plan whose only audio track was dropped in
+// favour of its downmix, which took over the default flag.
+func droppedOriginalPlan() *Plan {
+	return &Plan{
+		SkipFailedTracks: true,
+		Streams: []PlanStream{
+			{Index: 0, Type: "video", Action: "keep"},
+			{Index: 1, Type: "audio", Action: "drop", Disposition: "default"},
+		},
+		Encodes: []PlanEncode{{SourceIndex: 1, Disposition: "default"}},
+	}
+}
+
+func TestExcludeFailedTracksRestoresOriginal(t *testing.T) {
+	plan := droppedOriginalPlan()
+	applyDefaultAudio(plan, defaultAudioEnhanced)
+	if err := excludeFailedTracks(plan, map[int]error{0: errors.New("encoder crashed")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Encodes) != 0 || len(plan.Excluded) != 1 {
+		t.Fatalf("got %d encodes and %d exclusions, want 0 and 1", len(plan.Encodes), len(plan.Excluded))
+	}
+	s := plan.Streams[1]
+	if s.Action != "keep" {
+		t.Errorf("original is %q, want keep", s.Action)
+	}
+	if !hasDisposition(s.Disposition, "default") {
+		t.Errorf("original disposition is %q, want default", s.Disposition)
+	}
+}
+
+func TestExcludeFailedTracksKeepsOtherEncode(t *testing.T) {
+	plan := droppedOriginalPlan()
+	plan.Encodes = append(plan.Encodes, PlanEncode{SourceIndex: 1})
+	if err := excludeFailedTracks(plan, map[int]error{0: errors.New("encoder crashed")}); err != nil {
+		t.Fatal(err)
+	}
+	if plan.Streams[1].Action != "drop" {
+		t.Errorf("original is %q, want drop as another encode replaces it", plan.Streams[1].Action)
+	}
+	if len(plan.Encodes) != 1 || !hasDisposition(plan.Encodes[0].Disposition, "default") {
+		t.Errorf("remaining encodes %+v, want one with the default flag", plan.Encodes)
+	}
+}
+
+func TestExcludeFailedTracksTempo(t *testing.T) {
+	plan := droppedOriginalPlan()
+	plan.Tempo = 25 / 23.976
+	if err := excludeFailedTracks(plan, map[int]error{0: errors.New("encoder crashed")}); err == nil {
+		t.Error("a retimed plan copied its original audio")
+	}
+}
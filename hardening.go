@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// baseEnv are the variables -clean-env keeps so ffmpeg, the shell hooks
+// and the config lookup still work. LC_* is kept as a prefix.
+var baseEnv = []string{"PATH", "HOME", "USER", "LANG", "TZ", "TMPDIR", "TERM", "XDG_CONFIG_HOME", "XDG_CACHE_HOME"}
+
+// sandboxedEnv holds the process ID -sandbox executes again once writes
+// are restricted. Exec keeps the ID, so a value inherited from another
+// process never matches.
+const sandboxedEnv = "MKV21_SANDBOXED"
+
+// hardeningSettings only take effect on the command line, as they are
+// applied before any settings file is read.
+var hardeningSettings = map[string]bool{
+	"run-as": true, "clean-env": true, "keep-env": true, "sandbox": true, "sandbox-write": true,
+}
+
+// harden applies the process-wide hardening options before any child
+// process runs: first the privilege drop, then the environment cleanup and
+// last the write sandbox, which every child process inherits. input is the
+// file or directory the run converts.
+func harden(opts *Options, input string) error {
+	sandbox := opts.Sandbox || opts.SandboxWrite != ""
+	if marker := os.Getenv(sandboxedEnv); marker != "" {
+		os.Unsetenv(sandboxedEnv)
+		if sandbox && marker == strconv.Itoa(os.Getpid()) {
+			// Executed again by restrictWrites: the privileges and the
+			// environment were handled before, check they still hold
+			return checkHardened(opts)
+		}
+	}
+	if opts.RunAs != "" {
+		if err := dropPrivileges(opts.RunAs); err != nil {
+			return fmt.Errorf("-run-as %s: %v", opts.RunAs, err)
+		}
+		// Defaults in the config directory were resolved for root
+		if f := flag.Lookup("audit-log"); f != nil && f.Value.String() == f.DefValue {
+			f.DefValue = defaultAuditLog()
+			f.Value.Set(f.DefValue)
+		}
+	}
+	if opts.CleanEnv {
+		cleanEnv(commaList(opts.KeepEnv))
+	}
+	if sandbox {
+		dirs := sandboxDirs(opts, input)
+		if err := restrictWrites(dirs); err != nil {
+			return fmt.Errorf("-sandbox: %v", err)
+		}
+	}
+	return nil
+}
+
+// cleanEnv removes every environment variable except baseEnv, LC_* and
+// keep. Credentials like ACOUSTID_API_KEY, AWS_* or RCLONE_* only reach
+// the hooks and rclone when they are listed in keep.
+func cleanEnv(keep []string) {
+	kept := map[string]string{}
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if keepEnv(name, keep) {
+			kept[name] = value
+		}
+	}
+	os.Clearenv()
+	for name, value := range kept {
+		os.Setenv(name, value)
+	}
+}
+
+// keepEnv reports whether -clean-env keeps the variable name. Entries of
+// keep ending in * match by prefix.
+func keepEnv(name string, keep []string) bool {
+	if strings.HasPrefix(name, "LC_") {
+		return true
+	}
+	for _, k := range append(baseEnv, keep...) {
+		if prefix, ok := strings.CutSuffix(k, "*"); ok && strings.HasPrefix(name, prefix) || k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sandboxDirs are the directories writes stay allowed in: the input
+// directory (or the input itself for recursive runs), every directory the
+// options write to, the system temporary directory and -sandbox-write.
+func sandboxDirs(opts *Options, input string) []string {
+	var dirs []string
+	add := func(path string) {
+		if path == "" || strings.Contains(path, "://") || strings.HasPrefix(path, rclonePrefix) {
+			return
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			dirs = append(dirs, existingAncestor(abs))
+		}
+	}
+	if info, err := os.Stat(input); err == nil && info.IsDir() {
+		add(input)
+	} else {
+		add(filepath.Dir(input))
+	}
+	add(os.TempDir())
+	add(opts.TempDir)
+	add(opts.OutputDir)
+	add(opts.StageDir)
+	add(opts.CacheDir)
+	add(opts.TrashDir)
+	add(opts.Publish)
+	for _, file := range []string{opts.LogFile, opts.AuditLog} {
+		if file != "" {
+			add(filepath.Dir(file))
+		}
+	}
+	for _, dir := range commaList(opts.SandboxWrite) {
+		add(dir)
+	}
+	return dirs
+}
+
+// existingAncestor returns path, or the closest of its parents that exists
+// for directories that are only created later.
+func existingAncestor(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// commaList splits a comma separated option value, dropping empty entries.
+func commaList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
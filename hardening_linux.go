@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock system calls and flags, see landlock(7).
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	prSetNoNewPrivs = 38
+	prGetNoNewPrivs = 39
+	oPath           = 0x200000 // O_PATH, missing from package syscall
+)
+
+// Landlock filesystem access rights. Only writes are handled, so reading
+// and executing stay unrestricted.
+const (
+	landlockWriteFile  = 1 << 1
+	landlockRemoveDir  = 1 << 4
+	landlockRemoveFile = 1 << 5
+	landlockMakeChar   = 1 << 6
+	landlockMakeDir    = 1 << 7
+	landlockMakeReg    = 1 << 8
+	landlockMakeSock   = 1 << 9
+	landlockMakeFifo   = 1 << 10
+	landlockMakeBlock  = 1 << 11
+	landlockMakeSym    = 1 << 12
+	landlockRefer      = 1 << 13 // ABI 2
+	landlockTruncate   = 1 << 14 // ABI 3
+
+	landlockWrites = landlockWriteFile | landlockRemoveDir | landlockRemoveFile |
+		landlockMakeChar | landlockMakeDir | landlockMakeReg | landlockMakeSock |
+		landlockMakeFifo | landlockMakeBlock | landlockMakeSym
+)
+
+// dropPrivileges switches a process started as root to account, given as
+// user or user:group, and points HOME at the account's home directory.
+func dropPrivileges(account string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("dropping privileges needs to start as root")
+	}
+	name, group, _ := strings.Cut(account, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if uid == 0 {
+		return fmt.Errorf("%s is root", name)
+	}
+
+	var groups []int
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil {
+				groups = append(groups, n)
+			}
+		}
+	}
+	// The group has to change while still root; Go applies these to every
+	// thread of the process
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	if syscall.Setuid(0) == nil {
+		return fmt.Errorf("root privileges could be regained")
+	}
+	os.Setenv("HOME", u.HomeDir)
+	os.Setenv("USER", u.Username)
+	// These point into root's directories
+	os.Unsetenv("XDG_CONFIG_HOME")
+	os.Unsetenv("XDG_CACHE_HOME")
+	return nil
+}
+
+// lookupAccount returns the user ID of a -run-as account.
+func lookupAccount(account string) (int, error) {
+	name, _, _ := strings.Cut(account, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// checkHardened verifies the state restrictWrites executed this program
+// again in: no_new_privs, which only the sandbox sets, and the -run-as
+// account.
+func checkHardened(opts *Options) error {
+	set, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prGetNoNewPrivs, 0, 0)
+	if errno != 0 || set != 1 {
+		return fmt.Errorf("-sandbox: the process is not restricted")
+	}
+	if opts.RunAs != "" {
+		uid, err := lookupAccount(opts.RunAs)
+		if err != nil {
+			return fmt.Errorf("-run-as %s: %v", opts.RunAs, err)
+		}
+		if os.Getuid() != uid || os.Geteuid() != uid {
+			return fmt.Errorf("-run-as %s: running as user %d", opts.RunAs, os.Geteuid())
+		}
+	}
+	return nil
+}
+
+// restrictWrites confines this process and every child it starts to
+// writing below dirs with Landlock (Linux 5.13+) and only returns on
+// errors. /dev/null stays writable as exec uses it for discarded output.
+func restrictWrites(dirs []string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("Landlock is not available: %v", errno)
+	}
+	handled := uint64(landlockWrites)
+	if abi >= 2 {
+		// Moving files between the allowed directories
+		handled |= landlockRefer
+	}
+	if abi >= 3 {
+		handled |= landlockTruncate
+	}
+
+	attr := handled
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("creating the ruleset: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	for _, dir := range dirs {
+		if err := landlockAllow(int(fd), dir, handled); err != nil {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+	}
+	if err := landlockAllow(int(fd), os.DevNull, landlockWriteFile|handled&landlockTruncate); err != nil {
+		return fmt.Errorf("%s: %v", os.DevNull, err)
+	}
+
+	// Both only apply to the calling thread and the syscall package can't
+	// run them on all threads of a cgo binary, so the restricted thread
+	// executes this program again, which then starts out restricted
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %v", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("restricting the process: %v", errno)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(self, os.Args, append(os.Environ(), sandboxedEnv+"="+strconv.Itoa(os.Getpid())))
+}
+
+// landlockAllow adds a rule granting access below path. A path removed
+// since sandboxDirs found it is skipped.
+func landlockAllow(ruleset int, path string, access uint64) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|oPath|syscall.O_CLOEXEC, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && !info.IsDir() {
+		// Rules on files only take rights that apply to files
+		access &= landlockWriteFile | landlockTruncate
+	}
+
+	// struct landlock_path_beneath_attr is packed: __u64 then __s32
+	var attr [12]byte
+	binary.NativeEndian.PutUint64(attr[0:], access)
+	binary.NativeEndian.PutUint32(attr[8:], uint32(f.Fd()))
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
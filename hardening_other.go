@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// dropPrivileges is only implemented on Linux.
+func dropPrivileges(account string) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+// checkHardened never runs, as restrictWrites doesn't execute the program
+// again elsewhere.
+func checkHardened(opts *Options) error {
+	return fmt.Errorf("not supported on this platform")
+}
+
+// restrictWrites is only implemented on Linux, where it uses Landlock.
+func restrictWrites(dirs []string) error {
+	return fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// hashChunkSize is the piece of a file each leaf of a tree hash covers.
+const hashChunkSize = 64 << 20
+
+// hashAlgorithm is a checksum selectable per use. Tree algorithms hash
+// every hashChunkSize piece on its own and then the list of piece digests,
+// so the pieces of large files can be hashed in parallel; plain ones read
+// the file front to back and match the usual command line tools.
+type hashAlgorithm struct {
+	new  func() hash.Hash
+	tree bool
+}
+
+// hashAlgorithms are the available checksums. The fast ones come from the
+// standard library: CRC-32C uses the CPU's CRC instructions and SHA-256
+// its SHA extensions where there are any. The CRCs only detect accidental
+// corruption; anyone can make a file with a given CRC.
+var hashAlgorithms = map[string]hashAlgorithm{
+	"sha256":      {new: sha256.New},
+	"sha256-tree": {new: sha256.New, tree: true},
+	"crc32c": {new: func() hash.Hash {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}, tree: true},
+	"crc64": {new: func() hash.Hash {
+		return crc64.New(crc64.MakeTable(crc64.ECMA))
+	}, tree: true},
+}
+
+// hashWorkers is how many pieces of a file are hashed at once.
+var hashWorkers = runtime.NumCPU()
+
+// validateHash checks a checksum name given for the option named flag.
+func validateHash(flag, name string) error {
+	if _, ok := hashAlgorithms[name]; ok {
+		return nil
+	}
+	var names []string
+	for n := range hashAlgorithms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown -%s %q (expected %s)", flag, name, strings.Join(names, ", "))
+}
+
+// formatChecksum labels a digest with its algorithm. Plain SHA-256 stays
+// bare hex, as in audit logs written before there was a choice.
+func formatChecksum(name string, sum []byte) string {
+	if name == "sha256" {
+		return hex.EncodeToString(sum)
+	}
+	return name + ":" + hex.EncodeToString(sum)
+}
+
+// hashFile returns the labelled checksum of a file. Pieces of tree
+// algorithms are spread over hashWorkers goroutines.
+func hashFile(path, name string) (string, error) {
+	algo, ok := hashAlgorithms[name]
+	if !ok {
+		return "", fmt.Errorf("unknown checksum %q", name)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if !algo.tree {
+		h := algo.new()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		return formatChecksum(name, h.Sum(nil)), nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	pieces := int((info.Size() + hashChunkSize - 1) / hashChunkSize)
+	sums := make([][]byte, pieces)
+	errs := make([]error, pieces)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < hashWorkers && w < pieces; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				h := algo.new()
+				_, errs[i] = io.Copy(h, io.NewSectionReader(f, int64(i)*hashChunkSize, hashChunkSize))
+				sums[i] = h.Sum(nil)
+			}
+		}()
+	}
+	for i := 0; i < pieces; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return "", err
+		}
+	}
+	return treeSum(name, sums), nil
+}
+
+// treeSum combines the piece digests of a tree algorithm.
+func treeSum(name string, sums [][]byte) string {
+	h := hashAlgorithms[name].new()
+	for _, sum := range sums {
+		h.Write(sum)
+	}
+	return formatChecksum(name, h.Sum(nil))
+}
+
+// streamHasher computes the same checksum as hashFile from data written to
+// it in order, for hashing a copy while it is made.
+type streamHasher struct {
+	name  string
+	algo  hashAlgorithm
+	piece hash.Hash
+	n     int64 // Bytes in the current piece
+	sums  [][]byte
+}
+
+func newStreamHasher(name string) *streamHasher {
+	algo := hashAlgorithms[name]
+	return &streamHasher{name: name, algo: algo, piece: algo.new()}
+}
+
+func (s *streamHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		part := p
+		if s.algo.tree && int64(len(part)) > hashChunkSize-s.n {
+			part = part[:hashChunkSize-s.n]
+		}
+		s.piece.Write(part)
+		s.n += int64(len(part))
+		p = p[len(part):]
+		if s.algo.tree && s.n == hashChunkSize {
+			s.sums = append(s.sums, s.piece.Sum(nil))
+			s.piece, s.n = s.algo.new(), 0
+		}
+	}
+	return written, nil
+}
+
+// Sum returns the labelled checksum of everything written so far.
+func (s *streamHasher) Sum() string {
+	if !s.algo.tree {
+		return formatChecksum(s.name, s.piece.Sum(nil))
+	}
+	sums := s.sums
+	if s.n > 0 {
+		sums = append(sums, s.piece.Sum(nil))
+	}
+	return treeSum(s.name, sums)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// hdrSideData lists side data types that carry HDR or Dolby Vision metadata.
+var hdrSideData = []string{
+	"Mastering display metadata",
+	"Content light level metadata",
+	"DOVI configuration record",
+	"Dolby Vision RPU Data",
+	"Dolby Vision Metadata",
+	"HDR Dynamic Metadata SMPTE2094-40 (HDR10+)",
+}
+
+// isHDRSideData reports whether a side data type carries HDR metadata.
+func isHDRSideData(sideDataType string) bool {
+	for _, t := range hdrSideData {
+		if strings.EqualFold(t, sideDataType) {
+			return true
+		}
+	}
+	return false
+}
+
+// videoHDRMetadata collects the HDR related properties of the video streams
+// in a file, in stream order. If keep is set, only streams it accepts count.
+func videoHDRMetadata(file string, keep func(index int) bool) ([]map[string]bool, error) {
+	streams, err := probeStreams(file, "v")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []map[string]bool
+	for i, s := range streams {
+		if s.Disposition["attached_pic"] == 1 || (keep != nil && !keep(s.Index)) {
+			continue
+		}
+		found := make(map[string]bool)
+		if s.ColorTrc == "smpte2084" || s.ColorTrc == "arib-std-b67" {
+			found["transfer "+s.ColorTrc] = true
+		}
+		for _, sd := range s.SideData {
+			if isHDRSideData(sd.Type) {
+				found[sd.Type] = true
+			}
+		}
+		frameSideData, err := probeFirstFrameSideData(file, fmt.Sprintf("v:%d", i))
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range frameSideData {
+			if isHDRSideData(t) {
+				found[t] = true
+			}
+		}
+		result = append(result, found)
+	}
+	return result, nil
+}
+
+// validateHDRMetadata fails if any HDR10 or Dolby Vision metadata present
+// on the kept source video streams is missing from the output.
+func validateHDRMetadata(plan *Plan) error {
+	want, err := videoHDRMetadata(plan.Input, plan.keeps)
+	if err != nil {
+		return err
+	}
+	got, err := videoHDRMetadata(plan.Output, nil)
+	if err != nil {
+		return err
+	}
+
+	for i, props := range want {
+		if len(props) == 0 {
+			continue
+		}
+		if i >= len(got) {
+			return fmt.Errorf("video stream %d with HDR metadata is missing from the output", i)
+		}
+		var missing []string
+		for prop := range props {
+			if !got[i][prop] {
+				missing = append(missing, prop)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return fmt.Errorf("video stream %d lost HDR metadata during remux: %s", i, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
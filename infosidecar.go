@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Formats of the track info sidecar written next to the output, selectable
+// with -info-sidecar.
+const (
+	infoSidecarJSON = "json" // <output>.audio.json for custom scrapers
+	infoSidecarNFO  = "nfo"  // Kodi/Jellyfin <output>.nfo stream details
+)
+
+// validateInfoSidecar checks an -info-sidecar value.
+func validateInfoSidecar(format string) error {
+	switch format {
+	case "", infoSidecarJSON, infoSidecarNFO:
+		return nil
+	}
+	return fmt.Errorf("unknown info sidecar format %q (use %s or %s)", format, infoSidecarJSON, infoSidecarNFO)
+}
+
+// encodeCodec returns the codec of a new track: the -acodec profile name of
+// its encoder, or the encoder itself.
+func encodeCodec(enc PlanEncode) string {
+	encoder := ""
+	for i := 0; i+1 < len(enc.EncoderArgs); i++ {
+		if enc.EncoderArgs[i] == "-acodec" {
+			encoder = enc.EncoderArgs[i+1]
+		}
+	}
+	for name, p := range codecProfiles {
+		if p.Encoder == encoder {
+			return name
+		}
+	}
+	return encoder
+}
+
+// encodeBitrateArg returns the -b:a value of a new track, or "" for
+// lossless codecs.
+func encodeBitrateArg(enc PlanEncode) string {
+	for i := 0; i+1 < len(enc.EncoderArgs); i++ {
+		if enc.EncoderArgs[i] == "-b:a" {
+			return enc.EncoderArgs[i+1]
+		}
+	}
+	return ""
+}
+
+// encodeChannels returns the channel count of a new track, from the layout
+// its filter mixes down to.
+func encodeChannels(enc PlanEncode) int {
+	if strings.Contains(enc.Filter, "pan=2.1") || strings.Contains(enc.Filter, "channel_layouts=2.1") {
+		return 3
+	}
+	return 2
+}
+
+// encodeLoudness returns the integrated loudness of a new track in LUFS:
+// measured, if ReplayGain tags were written, else the -loudnorm target. It
+// is 0 if neither is known.
+func encodeLoudness(enc PlanEncode) float64 {
+	if gain, ok := enc.Metadata["REPLAYGAIN_TRACK_GAIN"]; ok {
+		if g, err := strconv.ParseFloat(strings.TrimSuffix(gain, " dB"), 64); err == nil {
+			return replayGainReference - g
+		}
+	}
+	for _, param := range strings.Split(enc.Loudnorm, ":") {
+		if value, ok := strings.CutPrefix(param, "I="); ok {
+			if i, err := strconv.ParseFloat(value, 64); err == nil {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// infoSidecarPath returns the sidecar of an output in a format.
+func infoSidecarPath(output, format string) string {
+	stem := strings.TrimSuffix(output, filepath.Ext(output))
+	if format == infoSidecarJSON {
+		return stem + ".audio.json"
+	}
+	return stem + ".nfo"
+}
+
+// nfoAudio is an audio stream in Kodi's NFO stream details.
+type nfoAudio struct {
+	Codec    string `xml:"codec"`
+	Language string `xml:"language"`
+	Channels int    `xml:"channels"`
+	Title    string `xml:"title,omitempty"`
+}
+
+// nfoMovie is an NFO document holding only stream details.
+type nfoMovie struct {
+	XMLName xml.Name   `xml:"movie"`
+	Audio   []nfoAudio `xml:"fileinfo>streamdetails>audio"`
+}
+
+// writeInfoSidecar describes the new tracks of a finished output for media
+// managers, from the same data as the job summary. An existing NFO is left
+// alone, since it usually holds the scraped movie information.
+func writeInfoSidecar(plan *Plan, summary JobSummary) error {
+	path := infoSidecarPath(plan.Output, plan.InfoSidecar)
+	var data []byte
+	var err error
+	switch plan.InfoSidecar {
+	case infoSidecarJSON:
+		data, err = json.MarshalIndent(struct {
+			File   string         `json:"file"`
+			Tracks []SummaryTrack `json:"tracks"`
+		}{filepath.Base(plan.Output), summary.Tracks}, "", "  ")
+	case infoSidecarNFO:
+		if _, statErr := os.Stat(path); statErr == nil {
+			fmt.Println("Keeping the existing", path)
+			return nil
+		}
+		nfo := nfoMovie{}
+		for _, t := range summary.Tracks {
+			nfo.Audio = append(nfo.Audio, nfoAudio{t.Codec, t.Language, t.Channels, t.Title})
+		}
+		if data, err = xml.MarshalIndent(nfo, "", "  "); err == nil {
+			data = append([]byte(xml.Header), data...)
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("writing the info sidecar failed: %v", err)
+	}
+	fmt.Println("Track info written to", path)
+	return nil
+}
@@ -0,0 +1,160 @@
+//go:build integration
+
+// Integration tests run full convert, merge and verify cycles with a real
+// ffmpeg on the synthetic source of the soak test:
+//
+//	go test -tags integration ./...
+//
+// They are skipped when ffmpeg or ffprobe can't be found; -ffmpeg-path and
+// -ffprobe-path are taken from $FFMPEG_PATH and $FFPROBE_PATH.
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// integrationClip is the length of the synthetic source.
+const integrationClip = 5 * time.Second
+
+// integrationTolerance is how far, in seconds, an output's duration may be
+// off, leaving room for encoder delay.
+const integrationTolerance = 0.5
+
+// integrationFlags are the parsed conversion options the tests share.
+var integrationFlags *Options
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	integrationFlags = parseFlags(nil)
+	os.Exit(m.Run())
+}
+
+// integrationSource writes the synthetic 5.1 source into a fresh directory,
+// skipping the test if ffmpeg isn't usable.
+func integrationSource(t *testing.T) string {
+	t.Helper()
+	setToolPaths(*integrationFlags)
+	if err := checkTools(); err != nil {
+		t.Skip(err)
+	}
+	input := filepath.Join(t.TempDir(), soakInputName)
+	if err := writeSoakSource(input, integrationClip); err != nil {
+		t.Fatal(err)
+	}
+	return input
+}
+
+// convert runs a whole conversion of input with settings, given as flag
+// names and values, and returns the executed plan.
+func convert(t *testing.T, input string, settings map[string]string) *Plan {
+	t.Helper()
+	explicit := map[string]bool{}
+	for name, value := range map[string]string{"audit-log": "", "temp-dir": t.TempDir()} {
+		if _, ok := settings[name]; !ok {
+			settings[name] = value
+		}
+	}
+	for name, value := range settings {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("-%s %s: %v", name, value, err)
+		}
+		explicit[name] = true
+	}
+
+	plan, opts, err := preparePlan(context.Background(), input, integrationFlags, explicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runPlan(context.Background(), plan, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+// audioStreams probes the audio streams of a converted file.
+func audioStreams(t *testing.T, file string) []ffprobeStream {
+	t.Helper()
+	streams, err := probeStreams(file, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return streams
+}
+
+// checkDuration fails the test if output is noticeably shorter or longer
+// than the synthetic source.
+func checkDuration(t *testing.T, output string) {
+	t.Helper()
+	got, err := probeDuration(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := integrationClip.Seconds(); got < want-integrationTolerance || got > want+integrationTolerance {
+		t.Errorf("output lasts %.2fs, want %.2fs", got, want)
+	}
+}
+
+func TestIntegrationDefault(t *testing.T) {
+	plan := convert(t, integrationSource(t), map[string]string{})
+	checkDuration(t, plan.Output)
+
+	streams := audioStreams(t, plan.Output)
+	if len(streams) != 2 {
+		t.Fatalf("got %d audio streams, want the original and its downmix", len(streams))
+	}
+	if s := streams[0]; s.CodecName != "flac" || s.Channels != 6 {
+		t.Errorf("original is %s with %d channels, want flac with 6", s.CodecName, s.Channels)
+	}
+	if s := streams[1]; s.CodecName != "opus" || s.Channels != 2 {
+		t.Errorf("downmix is %s with %d channels, want opus with 2", s.CodecName, s.Channels)
+	}
+	if got, want := streams[1].Tags["title"], plan.Encodes[0].Title; got != want {
+		t.Errorf("downmix is titled %q, want %q", got, want)
+	}
+	if got := streams[1].Language(); got != "eng" {
+		t.Errorf("downmix language is %q, want eng", got)
+	}
+}
+
+func TestIntegration21(t *testing.T) {
+	plan := convert(t, integrationSource(t), map[string]string{"acodec": "ac3", "layout": layout21})
+	checkDuration(t, plan.Output)
+
+	streams := audioStreams(t, plan.Output)
+	if len(streams) != 2 {
+		t.Fatalf("got %d audio streams, want 2", len(streams))
+	}
+	if s := streams[1]; s.CodecName != "ac3" || s.Channels != 3 {
+		t.Errorf("downmix is %s with %d channels, want ac3 with 3", s.CodecName, s.Channels)
+	}
+}
+
+func TestIntegrationDropOriginal(t *testing.T) {
+	plan := convert(t, integrationSource(t), map[string]string{"keep-original": "false", "acodec": "aac"})
+	checkDuration(t, plan.Output)
+
+	streams := audioStreams(t, plan.Output)
+	if len(streams) != 1 {
+		t.Fatalf("got %d audio streams, want only the downmix", len(streams))
+	}
+	if s := streams[0]; s.CodecName != "aac" || s.Channels != 2 {
+		t.Errorf("downmix is %s with %d channels, want aac with 2", s.CodecName, s.Channels)
+	}
+}
+
+func TestIntegrationMP4(t *testing.T) {
+	// FLAC in MP4 needs -strict on older ffmpeg, so only the downmix is kept
+	plan := convert(t, integrationSource(t), map[string]string{"output-container": "mp4", "acodec": "aac", "keep-original": "false"})
+	if filepath.Ext(plan.Output) != ".mp4" {
+		t.Fatalf("output %s is not an MP4", plan.Output)
+	}
+	checkDuration(t, plan.Output)
+	if streams := audioStreams(t, plan.Output); len(streams) != 1 || streams[0].CodecName != "aac" {
+		t.Errorf("got audio streams %+v, want one aac stream", streams)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobsAuto lets the number of concurrent encodes follow the machine load.
+const jobsAuto = "auto"
+
+// autoJobsInterval is how often the adaptive limit is re-evaluated.
+const autoJobsInterval = 10 * time.Second
+
+// validateJobs checks a -jobs value: a positive number, 0 for one encode per
+// track, or "auto".
+func validateJobs(jobs string) error {
+	if jobs == "" || jobs == jobsAuto {
+		return nil
+	}
+	if n, err := strconv.Atoi(jobs); err != nil || n < 0 {
+		return fmt.Errorf("invalid -jobs value %q: use a number or %s", jobs, jobsAuto)
+	}
+	return nil
+}
+
+// jobLimiter bounds how many encodes run at once. In auto mode the limit is
+// adjusted while the encodes run.
+type jobLimiter struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	running int
+	waiting int
+	speeds  map[string]float64 // Latest ffmpeg speed per running encode, by its TempFile
+}
+
+// newJobLimiter creates a limiter for total encodes. Auto mode starts
+// conservatively with a single encode.
+func newJobLimiter(jobs string, total int) *jobLimiter {
+	l := &jobLimiter{limit: total, speeds: make(map[string]float64)}
+	l.cond = sync.NewCond(&l.mu)
+	if jobs == jobsAuto {
+		l.limit = 1
+	} else if n, _ := strconv.Atoi(jobs); n > 0 {
+		l.limit = n
+	}
+	return l
+}
+
+// acquire blocks until another encode may start and the run isn't paused.
+func (l *jobLimiter) acquire() {
+	pauser.wait()
+	l.mu.Lock()
+	l.waiting++
+	for l.running >= l.limit {
+		l.cond.Wait()
+	}
+	l.waiting--
+	l.running++
+	l.mu.Unlock()
+}
+
+// release marks an encode as finished. id is its TempFile, which is unique
+// across the files of a batch sharing the limiter.
+func (l *jobLimiter) release(id string) {
+	l.mu.Lock()
+	l.running--
+	delete(l.speeds, id)
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// reportSpeed records the encode speed ffmpeg last printed for an encode.
+func (l *jobLimiter) reportSpeed(id string, speed float64) {
+	l.mu.Lock()
+	l.speeds[id] = speed
+	l.mu.Unlock()
+}
+
+// adapt scales the limit until done is closed: it adds an encode while the
+// CPU has headroom and the previous step raised the combined encode speed,
+// and removes one when the CPU is saturated.
+func (l *jobLimiter) adapt(done <-chan struct{}) {
+	maxJobs := runtime.NumCPU()
+	ticker := time.NewTicker(autoJobsInterval)
+	defer ticker.Stop()
+
+	lastBusy, lastTotal, ok := readCPUTimes()
+	lastSpeed := 0.0
+	grew := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		busy, total, ok2 := readCPUTimes()
+		if !ok || !ok2 || total == lastTotal {
+			// Without CPU statistics, fall back to half the cores
+			l.mu.Lock()
+			if l.limit < maxJobs/2 {
+				l.limit = max(1, maxJobs/2)
+				l.cond.Broadcast()
+			}
+			l.mu.Unlock()
+			return
+		}
+		load := float64(busy-lastBusy) / float64(total-lastTotal)
+		lastBusy, lastTotal = busy, total
+
+		l.mu.Lock()
+		speed := 0.0
+		for _, s := range l.speeds {
+			speed += s
+		}
+		switch {
+		case load > 0.95 && l.limit > 1:
+			l.limit--
+			grew = false
+			fmt.Printf("CPU saturated (%.0f%%), running at most %d encodes\n", load*100, l.limit)
+		case grew && speed < lastSpeed*1.1 && l.limit > 1:
+			// The last encode added didn't make the batch faster
+			l.limit--
+			grew = false
+			fmt.Printf("No speedup from more encodes, running at most %d encodes\n", l.limit)
+		case load < 0.8 && l.waiting > 0 && l.running >= l.limit && l.limit < maxJobs:
+			l.limit++
+			grew = true
+			l.cond.Broadcast()
+			fmt.Printf("CPU at %.0f%%, running up to %d encodes\n", load*100, l.limit)
+		default:
+			grew = false
+		}
+		lastSpeed = speed
+		l.mu.Unlock()
+	}
+}
+
+// readCPUTimes returns the busy and total CPU time from /proc/stat. It
+// reports false where that isn't available.
+func readCPUTimes() (busy, total uint64, ok bool) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, false
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, false
+	}
+	for i, f := range fields[1:] {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		total += v
+		// idle and iowait don't count as busy
+		if i != 3 && i != 4 {
+			busy += v
+		}
+	}
+	return busy, total, true
+}
+
+// scanFFmpegLines splits ffmpeg output on newlines and on the carriage
+// returns it uses to redraw its status line.
+func scanFFmpegLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// jobState is the resume manifest of a file's conversion, kept in the
+// workspace directory. It records which encodes finished and whether the
+// output was merged, so a run that died halfway continues where it stopped.
+// It is removed once the conversion is complete.
+type jobState struct {
+	Input         string                 `json:"input"`
+	InputSize     int64                  `json:"input_size"`
+	InputModified time.Time              `json:"input_modified"`
+	Encodes       map[string]encodeState `json:"encodes"`          // By temp file
+	Merged        *mergeState            `json:"merged,omitempty"` // Output of the merge, before verification
+
+	path  string
+	jobID string
+	mu    sync.Mutex
+}
+
+// encodeState is a finished encode as it was written.
+type encodeState struct {
+	Size     int64     `json:"size"`
+	Duration float64   `json:"duration"` // Seconds, 0 if unknown
+	Elapsed  float64   `json:"elapsed"`  // Seconds the encode took
+	Finished time.Time `json:"finished"`
+}
+
+// mergeState is a merged output and the plan it was merged from.
+type mergeState struct {
+	Output   string          `json:"output"`
+	Size     int64           `json:"size"`
+	Digest   string          `json:"digest"`             // See planDigest
+	Encodes  []PlanEncode    `json:"encodes"`            // Encodes in the output, with the tags added while merging
+	Excluded []PlanExclusion `json:"excluded,omitempty"` // Encodes left out of the output
+	Finished time.Time       `json:"finished"`
+}
+
+// jobStatePath returns the resume manifest of an input in the workspace
+// directory, named after the input's absolute path.
+func jobStatePath(input, tempDir string) string {
+	if abs, err := filepath.Abs(input); err == nil {
+		input = abs
+	}
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(input))
+	return filepath.Join(tempDir, "mkv21_state_"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadJobState reads the resume manifest of an input. A missing or
+// unreadable manifest, or one written for a since changed source, gives an
+// empty state; resuming is only ever an optimisation.
+func loadJobState(input, tempDir string) *jobState {
+	s := &jobState{Input: input, Encodes: make(map[string]encodeState), path: jobStatePath(input, tempDir)}
+	info, err := os.Stat(input)
+	if err != nil {
+		return s
+	}
+	s.InputSize, s.InputModified = info.Size(), info.ModTime()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return s
+	}
+	var saved jobState
+	if json.Unmarshal(data, &saved) != nil || saved.Input != input ||
+		saved.InputSize != s.InputSize || !saved.InputModified.Equal(s.InputModified) {
+		return s
+	}
+	if saved.Encodes != nil {
+		s.Encodes = saved.Encodes
+	}
+	s.Merged = saved.Merged
+	return s
+}
+
+// planDigest identifies what a plan merges, so a recorded merge is only
+// resumed for the same streams and encodes.
+func planDigest(plan *Plan) string {
+	data, _ := json.Marshal([]any{plan.Streams, plan.Encodes, plan.VideoArgs, plan.MergeArgs})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// encodeValid reports whether the encode of enc was recorded as finished and
+// its file is still what was written. A recorded encode whose file changed
+// size or length, or that is shorter than the source, is removed so it is
+// encoded again.
+func (s *jobState) encodeValid(enc PlanEncode, sourceDuration float64) bool {
+	s.mu.Lock()
+	recorded, ok := s.Encodes[enc.TempFile]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	reason := ""
+	info, err := os.Stat(enc.TempFile)
+	switch {
+	case err != nil:
+		reason = "missing"
+	case info.Size() != recorded.Size:
+		reason = fmt.Sprintf("%d bytes instead of %d", info.Size(), recorded.Size)
+	case recorded.Duration > 0:
+		duration, err := probeDuration(enc.TempFile)
+		if err != nil || math.Abs(duration-recorded.Duration) > durationTolerance {
+			reason = "unreadable or shorter than written"
+		} else if sourceDuration > 0 && duration < sourceDuration-verifyDurationTolerance {
+			reason = fmt.Sprintf("%.0fs of %.0fs", duration, sourceDuration)
+		}
+	}
+	if reason == "" {
+		return true
+	}
+	fmt.Printf("Discarding stale encode of track %d (%s)\n", enc.SourceIndex, reason)
+	os.Remove(enc.TempFile)
+	os.Remove(cacheManifestPath(enc.TempFile))
+	s.mu.Lock()
+	delete(s.Encodes, enc.TempFile)
+	s.mu.Unlock()
+	s.save()
+	return false
+}
+
+// encodeDone records a finished encode and how long it took.
+func (s *jobState) encodeDone(enc PlanEncode, elapsed time.Duration) {
+	info, err := os.Stat(enc.TempFile)
+	if err != nil {
+		return
+	}
+	duration, _ := probeDuration(enc.TempFile)
+	s.mu.Lock()
+	s.Encodes[enc.TempFile] = encodeState{Size: info.Size(), Duration: duration, Elapsed: elapsed.Seconds(), Finished: time.Now()}
+	s.mu.Unlock()
+	s.save()
+}
+
+// encodeElapsed returns the seconds the encode into tempFile took, or 0 if
+// it wasn't encoded by this job, e.g. because it came from the cache.
+func (s *jobState) encodeElapsed(tempFile string) float64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Encodes[tempFile].Elapsed
+}
+
+// mergedOutput returns the recorded merge of an earlier run of the same
+// plan, if its output is still there as it was written.
+func (s *jobState) mergedOutput(digest string) (*mergeState, bool) {
+	if s.Merged == nil || s.Merged.Digest != digest {
+		return nil, false
+	}
+	info, err := os.Stat(s.Merged.Output)
+	if err != nil || info.Size() != s.Merged.Size {
+		return nil, false
+	}
+	return s.Merged, true
+}
+
+// mergeDone records the merged output of a plan with the given digest.
+func (s *jobState) mergeDone(plan *Plan, digest string) {
+	info, err := os.Stat(plan.Output)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.Merged = &mergeState{
+		Output:   plan.Output,
+		Size:     info.Size(),
+		Digest:   digest,
+		Encodes:  plan.Encodes,
+		Excluded: plan.Excluded,
+		Finished: time.Now(),
+	}
+	s.mu.Unlock()
+	s.save()
+}
+
+// discardMerge forgets a merged output that failed verification, so the
+// next run merges again.
+func (s *jobState) discardMerge() {
+	s.mu.Lock()
+	s.Merged = nil
+	s.mu.Unlock()
+	s.save()
+}
+
+// save writes the manifest. Errors are ignored since resuming must never
+// fail a conversion. Parallel encodes share the partial file, so saves are
+// serialized.
+func (s *jobState) save() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return
+	}
+	partial := partialPath(s.path, s.jobID)
+	if os.WriteFile(partial, data, 0644) == nil {
+		os.Rename(partial, s.path)
+	}
+}
+
+// remove deletes the manifest of a completed conversion.
+func (s *jobState) remove() {
+	os.Remove(s.path)
+}
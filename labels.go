@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// labelsFileName is the user's label catalog inside the user config
+// directory: "language: title" lines that add to or replace the built-in
+// labels, e.g. "ger: 2.1 Abgemischt".
+const labelsFileName = "mkv-5.1to2.1/labels.yaml"
+
+// builtinLabels are the titles of the new tracks by track language, as ISO
+// 639-2/B codes. Languages without a label keep enhancedTrackTitle.
+var builtinLabels = map[string]string{
+	"ger": "2.1 Optimiert",
+	"fre": "2.1 Optimisé",
+	"spa": "2.1 Mejorado",
+	"ita": "2.1 Migliorato",
+	"por": "2.1 Melhorado",
+	"dut": "2.1 Verbeterd",
+	"pol": "2.1 Ulepszony",
+	"swe": "2.1 Förbättrad",
+	"dan": "2.1 Forbedret",
+	"nor": "2.1 Forbedret",
+	"fin": "2.1 Parannettu",
+	"cze": "2.1 Vylepšená",
+	"rus": "2.1 Улучшенная",
+	"jpn": "2.1 強化版",
+}
+
+// loadLabels returns the label catalog: the built-in labels and the user's.
+// Keys are normalised, so "de", "deu" and "ger" all label German tracks.
+func loadLabels() (map[string]string, error) {
+	labels := make(map[string]string, len(builtinLabels))
+	for lang, label := range builtinLabels {
+		labels[lang] = label
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return labels, nil
+	}
+	file := filepath.Join(dir, labelsFileName)
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return labels, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, err := parseSimpleYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for lang, label := range user {
+		labels[normalizeLanguageCode(lang)] = label
+	}
+	return labels, nil
+}
+
+// localizeTitles titles each new track in its own language, where the
+// catalog has a label for it. Languages are read after normalisation, so
+// filled-in languages get their label too.
+func localizeTitles(plan *Plan, labels map[string]string) {
+	for i := range plan.Encodes {
+		enc := &plan.Encodes[i]
+		if label, ok := labels[normalizeLanguageCode(enc.Language)]; ok {
+			enc.Title = label
+		}
+	}
+}
+
+// isEnhancedTitle reports whether a track title is one given to new tracks,
+// in English or any built-in language.
+func isEnhancedTitle(title string) bool {
+	if title == enhancedTrackTitle {
+		return true
+	}
+	for _, label := range builtinLabels {
+		if title == label {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// iso6391To6392 maps the two-letter codes typically returned by speech
+// language identifiers to the three-letter codes Matroska expects.
+var iso6391To6392 = map[string]string{
+	"ar": "ara", "cs": "ces", "da": "dan", "de": "deu", "el": "ell",
+	"en": "eng", "es": "spa", "fi": "fin", "fr": "fra", "he": "heb",
+	"hi": "hin", "hu": "hun", "it": "ita", "ja": "jpn", "ko": "kor",
+	"nl": "nld", "no": "nor", "pl": "pol", "pt": "por", "ru": "rus",
+	"sv": "swe", "th": "tha", "tr": "tur", "uk": "ukr", "zh": "zho",
+}
+
+// isUndeterminedLanguage reports whether a language tag is missing or "und".
+func isUndeterminedLanguage(lang string) bool {
+	return lang == "" || strings.EqualFold(lang, "und")
+}
+
+// detectMissingLanguages runs the -langid-cmd for every track without a
+// usable language tag and updates the tracks in place. The samples go in a
+// job workspace of their own under -temp-dir. Detection failures are
+// reported but never abort the run.
+func detectMissingLanguages(ctx context.Context, inputFile string, tracks []TrackInfo, opts Options) {
+	workspace := &Plan{TempDir: opts.TempDir, JobID: newJobID()}
+	defer workspace.removeJobDir()
+	for i := range tracks {
+		if !isUndeterminedLanguage(tracks[i].Language) {
+			continue
+		}
+		pauser.wait()
+		if ctx.Err() != nil {
+			return
+		}
+		sample := workspace.workPath("langid_" + tracks[i].Index + ".wav")
+		lang, err := identifyTrackLanguage(ctx, inputFile, tracks[i], opts.LangIDCmd, sample)
+		if err != nil {
+			fmt.Printf("Language detection for track %s failed: %v\n", tracks[i].Index, err)
+			continue
+		}
+		fmt.Printf("Detected language %s for track %s\n", lang, tracks[i].Index)
+		tracks[i].Language = lang
+	}
+}
+
+// identifyTrackLanguage extracts a short mono speech sample of the track to
+// sample and passes it to the external identification command. The command
+// receives the WAV path in place of "{}" (or as last argument) and must print
+// a language code as the first word of its output.
+func identifyTrackLanguage(ctx context.Context, inputFile string, track TrackInfo, command, sample string) (string, error) {
+	defer os.Remove(sample)
+
+	// Skip the opening minutes, which are often music or silence, unless
+	// the track is too short for that
+	for _, offset := range []string{"300", "0"} {
+		cmd := interruptibleCommand(ctx, ffmpegPath, "-loglevel", "error",
+			"-ss", offset, "-i", inputFile,
+			"-map", "0:"+track.Index, "-t", "30",
+			"-ac", "1", "-ar", "16000", "-y", sample)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			if ctx.Err() != nil {
+				return "", errInterrupted
+			}
+			return "", fmt.Errorf("extracting sample failed: %v\nOutput: %s", err, string(output))
+		}
+		if info, err := os.Stat(sample); err == nil && info.Size() > 1024 {
+			break
+		}
+	}
+
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty language detection command")
+	}
+	replaced := false
+	for i, arg := range args {
+		if strings.Contains(arg, "{}") {
+			args[i] = strings.ReplaceAll(arg, "{}", sample)
+			replaced = true
+		}
+	}
+	if !replaced {
+		args = append(args, sample)
+	}
+
+	output, err := interruptibleCommand(ctx, args[0], args[1:]...).Output()
+	if ctx.Err() != nil {
+		return "", errInterrupted
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v", args[0], err)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s returned no language", args[0])
+	}
+
+	lang := strings.ToLower(fields[0])
+	if long, ok := iso6391To6392[lang]; ok {
+		lang = long
+	}
+	if len(lang) != 3 || isUndeterminedLanguage(lang) {
+		return "", fmt.Errorf("unrecognised language code %q", fields[0])
+	}
+	return lang, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Output layouts of the new tracks, selectable with -layout.
+const (
+	layoutStereo = "stereo"
+	layout21     = "2.1" // Stereo plus a dedicated LFE channel
+)
+
+// panFilter returns the pan filter mixing a track down to the output layout.
+// Custom matrices are used as given; for 2.1 they must assign LFE themselves.
+// The default matrices are built for the exact source layout, see
+// layoutMatrix.
+func panFilter(track TrackInfo, opts Options) string {
+	matrix, standard := opts.Matrix51, defaultMatrix51
+	if strings.HasPrefix(track.Layout, "7.1") {
+		matrix, standard = opts.Matrix71, defaultMatrix71
+	}
+	if _, known := layoutChannels[track.Layout]; known && matrix == standard {
+		matrix = layoutMatrix(track.Layout, opts.OutputLayout == layout21)
+	}
+	if opts.OutputLayout == layout21 {
+		return "pan=2.1|" + matrix
+	}
+	return "pan=stereo|" + matrix
+}
+
+// layoutMatrix builds the default pan matrix for a known layout: the fronts
+// at full level, the centre at -3 dB, each surround pair into its side (less
+// of each where a layout has both back and side pairs) and the LFE at -6 dB,
+// or on its own channel with lfe. For 5.1 and 7.1 this gives defaultMatrix51
+// and defaultMatrix71.
+func layoutMatrix(layout string, lfe bool) string {
+	channels := layoutChannels[layout]
+	side := func(ch string) string {
+		terms := "F" + ch + "=F" + ch
+		for _, centre := range []string{"FC", "F" + ch + "C"} {
+			if hasChannel(channels, centre) {
+				terms += "+0.707*" + centre
+			}
+		}
+		back, surround := hasChannel(channels, "B"+ch), hasChannel(channels, "S"+ch)
+		switch {
+		case back && surround:
+			terms += "+0.5*B" + ch + "+0.3*S" + ch
+		case back:
+			terms += "+0.707*B" + ch
+		case surround:
+			terms += "+0.707*S" + ch
+		}
+		if hasChannel(channels, "BC") {
+			terms += "+0.5*BC"
+		}
+		if !lfe && hasChannel(channels, "LFE") {
+			terms += "+0.5*LFE"
+		}
+		return terms
+	}
+	matrix := side("L") + "|" + side("R")
+	if lfe && hasChannel(channels, "LFE") {
+		matrix += "|LFE=LFE"
+	}
+	return matrix
+}
+
+// nativeDownmix replaces the first pan of a filter chain with ffmpeg's own
+// downmix to the output layout, for sources whose layout has no known
+// channel map.
+func nativeDownmix(filter string, opts Options) string {
+	target := "aformat=channel_layouts=stereo"
+	if opts.OutputLayout == layout21 {
+		target = "aformat=channel_layouts=2.1"
+	}
+	chain := strings.Split(filter, ",")
+	for i, f := range chain {
+		if strings.HasPrefix(strings.TrimSpace(f), "pan=") {
+			chain[i] = strings.Replace(f, strings.TrimSpace(f), target, 1)
+			return strings.Join(chain, ",")
+		}
+	}
+	return target + ", " + filter
+}
+
+// describeSource notes how lossless and object-based tracks are downmixed.
+// ffmpeg decodes the channel bed of Atmos and DTS:X tracks; the objects are
+// left out.
+func describeSource(track TrackInfo) string {
+	profile := strings.ToLower(track.Profile)
+	switch {
+	case strings.Contains(profile, "atmos"):
+		return fmt.Sprintf("Track %s: Dolby Atmos, downmixing its %s bed (objects are left out)", track.Index, track.Layout)
+	case strings.Contains(profile, "dts:x"):
+		return fmt.Sprintf("Track %s: DTS:X, downmixing its %s bed (objects are left out)", track.Index, track.Layout)
+	}
+	return ""
+}
+
+// validateLayout checks the -layout value and that the output codec and
+// preset can produce it. Opus and FLAC map three channels to left, right
+// and centre, so they would play the LFE from the centre speaker. No Opus
+// channel mapping family has a 2.1 layout either (family 1 orders three
+// channels L C R, family 255 leaves them unassigned), so the mapping family
+// isn't selectable and these codecs fail here instead. AAC, AC-3 and E-AC-3
+// carry the layout in their bitstream, which players read it from, as
+// Matroska itself only stores the channel count.
+func validateLayout(opts Options) error {
+	switch opts.OutputLayout {
+	case "", layoutStereo:
+		return nil
+	case layout21:
+	default:
+		return fmt.Errorf("unknown layout %q (use %s or %s)", opts.OutputLayout, layoutStereo, layout21)
+	}
+	if downmixPresets[opts.Preset].NoLFE && opts.CustomFilter == "" {
+		return fmt.Errorf("the %s preset cuts the bass and can't be combined with -layout %s", opts.Preset, layout21)
+	}
+	profile := lookupCodec(opts.AudioCodec)
+	for name, p := range codecProfiles {
+		if p.Encoder == profile.Encoder && !p.LFE {
+			return fmt.Errorf("-acodec %s can't carry a %s layout (use one of: %s)", name, layout21, strings.Join(lfeCodecNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// matrixRe matches a pan matrix: "|"-separated output channels, each set
+// to a sum of optionally weighted input channels, e.g. "FL=FL+0.707*FC".
+// Nothing else may follow, as the matrix ends up in the -af filter graph.
+var matrixRe = regexp.MustCompile(`^` + panOutput + `(?:\|` + panOutput + `)*$`)
+
+const (
+	panChannel = `(?:[A-Z]{1,4}|c[0-9]+)`
+	panTerm    = `(?:[0-9]*\.?[0-9]+ *\* *)?` + panChannel
+	panOutput  = ` *` + panChannel + ` *[=<] *-? *` + panTerm + `(?: *[+-] *` + panTerm + `)* *`
+)
+
+// validateMatrix checks a -matrix51 or -matrix71 value.
+func validateMatrix(flag, matrix string) error {
+	if !matrixRe.MatchString(matrix) {
+		return fmt.Errorf("invalid -%s %q (expected output channels like FL=FL+0.707*FC, separated by |)", flag, matrix)
+	}
+	return nil
+}
+
+// validateGain checks the -gain value: a volume multiplier such as 1.5 or
+// a level in decibels such as 3dB.
+func validateGain(gain string) error {
+	number := strings.TrimSuffix(gain, "dB")
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || number == gain && v < 0 {
+		return fmt.Errorf("invalid -gain %q (expected a multiplier like 1.5 or a level like 3dB)", gain)
+	}
+	return nil
+}
+
+// lfeCodecNames lists the codec profiles that support -layout 2.1.
+func lfeCodecNames() []string {
+	var names []string
+	for _, name := range strings.Split(codecNames(), ", ") {
+		if codecProfiles[name].LFE {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Log file formats, see -log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// parseLogLevel parses a -log-level value.
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return 0, fmt.Errorf("invalid -log-level %q (debug, info, warn or error)", value)
+	}
+	return level, nil
+}
+
+// openLogFile opens the -log-file for appending and returns a logger writing
+// to it in the -log-format.
+func openLogFile(path, format string, level slog.Level) (*slog.Logger, *os.File, error) {
+	if format != logFormatText && format != logFormatJSON {
+		return nil, nil, fmt.Errorf("invalid -log-format %q (%s or %s)", format, logFormatText, logFormatJSON)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	options := &slog.HandlerOptions{Level: level}
+	if format == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(f, options)), f, nil
+	}
+	return slog.New(slog.NewTextHandler(f, options)), f, nil
+}
+
+// lineLevel infers the level of a printed message from its prefix.
+func lineLevel(line string) slog.Level {
+	switch {
+	case strings.HasPrefix(line, "Error"):
+		return slog.LevelError
+	case strings.HasPrefix(line, "Warning"):
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// logTrack writes a message about one track of a file, prefixed with both
+// so concurrent encodes can be told apart. The log file gets them as
+// separate file and track attributes.
+func logTrack(input string, track int, level slog.Level, msg string) {
+	line := fmt.Sprintf("%s #%d: %s", filepath.Base(input), track, msg)
+	if activeConsole == nil {
+		fmt.Println(line)
+		return
+	}
+	activeConsole.write(level, line, slog.String("file", input), slog.Int("track", track))
+}
+
+// logDebug writes a message only shown with -log-level debug.
+func logDebug(format string, args ...any) {
+	if activeConsole != nil {
+		activeConsole.write(slog.LevelDebug, fmt.Sprintf(format, args...))
+	}
+}
+
+// logToFile passes a message to the log file, if there is one.
+func (c *console) logToFile(level slog.Level, msg string, attrs []slog.Attr) {
+	if c.log != nil {
+		c.log.LogAttrs(context.Background(), level, msg, attrs...)
+	}
+}
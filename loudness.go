@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// Reference levels for gain tags: ReplayGain 2.0 targets -18 LUFS, the Opus
+// R128 gain tags target -23 LUFS.
+const (
+	replayGainReference = -18.0
+	r128Reference       = -23.0
+)
+
+var (
+	ebur128IntegratedRe = regexp.MustCompile(`I:\s+(-?[\d.]+|-inf) LUFS`)
+	ebur128RangeRe      = regexp.MustCompile(`LRA:\s+(-?[\d.]+) LU`)
+	ebur128PeakRe       = regexp.MustCompile(`Peak:\s+(-?[\d.]+|-inf) dBFS`)
+)
+
+// Loudness is the EBU R128 measurement of an audio stream.
+type Loudness struct {
+	Integrated float64 // Integrated loudness in LUFS
+	Range      float64 // Loudness range in LU
+	TruePeak   float64 // True peak in dBFS
+}
+
+// measureLoudness runs ffmpeg's ebur128 filter over an audio stream and
+// parses the summary it prints at the end.
+func measureLoudness(file, streamSpec string) (Loudness, error) {
+	return measureFilteredLoudness(file, streamSpec, "")
+}
+
+// measureFilteredLoudness measures an audio stream after passing it through
+// filter, which may be empty.
+func measureFilteredLoudness(file, streamSpec, filter string) (Loudness, error) {
+	af := "ebur128=peak=true"
+	if filter != "" {
+		af = filter + "," + af
+	}
+	cmd := exec.Command(ffmpegPath, "-hide_banner", "-nostats",
+		"-i", file, "-map", "0:"+streamSpec,
+		"-af", af, "-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Loudness{}, fmt.Errorf("loudness measurement failed: %v", err)
+	}
+
+	// The summary is the last set of values in the output
+	output := stderr.String()
+	last := func(re *regexp.Regexp) (float64, error) {
+		matches := re.FindAllStringSubmatch(output, -1)
+		if len(matches) == 0 {
+			return 0, fmt.Errorf("no %s in ebur128 output", re.String())
+		}
+		value := matches[len(matches)-1][1]
+		if value == "-inf" {
+			return math.Inf(-1), nil
+		}
+		return strconv.ParseFloat(value, 64)
+	}
+
+	var l Loudness
+	var err error
+	if l.Integrated, err = last(ebur128IntegratedRe); err != nil {
+		return l, err
+	}
+	if l.Range, err = last(ebur128RangeRe); err != nil {
+		return l, err
+	}
+	if l.TruePeak, err = last(ebur128PeakRe); err != nil {
+		return l, err
+	}
+	return l, nil
+}
+
+// gainTags returns the ReplayGain and R128 tags for a measured track.
+func gainTags(l Loudness) map[string]string {
+	if math.IsInf(l.Integrated, 0) {
+		return nil
+	}
+	peak := math.Pow(10, l.TruePeak/20)
+	return map[string]string{
+		"REPLAYGAIN_TRACK_GAIN": fmt.Sprintf("%.2f dB", replayGainReference-l.Integrated),
+		"REPLAYGAIN_TRACK_PEAK": fmt.Sprintf("%.6f", peak),
+		"R128_TRACK_GAIN":       strconv.Itoa(int(math.Round((r128Reference - l.Integrated) * 256))),
+	}
+}
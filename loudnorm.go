@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Default EBU R128 normalisation targets for -loudnorm.
+const (
+	defaultLoudnormTruePeak = -1.5
+	defaultLoudnormRange    = 11.0
+)
+
+// loudnormTarget returns the loudnorm options for the -loudnorm settings, or
+// "" if normalisation is off.
+func loudnormTarget(opts Options) (string, error) {
+	if opts.LoudnormTarget == 0 {
+		return "", nil
+	}
+	switch {
+	case opts.LoudnormTarget < -70 || opts.LoudnormTarget > -5:
+		return "", fmt.Errorf("invalid -loudnorm %g: the target must be between -70 and -5 LUFS", opts.LoudnormTarget)
+	case opts.LoudnormTruePeak < -9 || opts.LoudnormTruePeak > 0:
+		return "", fmt.Errorf("invalid -loudnorm-tp %g: must be between -9 and 0 dBTP", opts.LoudnormTruePeak)
+	case opts.LoudnormRange < 1 || opts.LoudnormRange > 50:
+		return "", fmt.Errorf("invalid -loudnorm-lra %g: must be between 1 and 50 LU", opts.LoudnormRange)
+	}
+	return fmt.Sprintf("I=%g:TP=%g:LRA=%g", opts.LoudnormTarget, opts.LoudnormTruePeak, opts.LoudnormRange), nil
+}
+
+// loudnormMeasurement is the analysis loudnorm prints in its first pass.
+type loudnormMeasurement struct {
+	InputI      string `json:"input_i"`
+	InputTP     string `json:"input_tp"`
+	InputLRA    string `json:"input_lra"`
+	InputThresh string `json:"input_thresh"`
+	Offset      string `json:"target_offset"`
+}
+
+// loudnormFilter runs the first loudnorm pass over the downmix of a track and
+// returns the filter for the second pass, which applies the measured values
+// linearly so dynamics are kept. Silent tracks are left as they are.
+func loudnormFilter(plan *Plan, enc PlanEncode) (string, error) {
+	fmt.Printf("Measuring loudness of track %d for normalisation...\n", enc.SourceIndex)
+	input, source := plan.source(), fmt.Sprintf("0:%d", enc.SourceIndex)
+	var decoder *exec.Cmd
+	if enc.Decoder != "" {
+		input, source = "pipe:0", "0:a:0"
+		decoder = exec.Command("sh", "-c", enc.Decoder)
+	}
+	args := append([]string{"-hide_banner", "-nostats"}, plan.inputArgs(input)...)
+	args = append(args, "-map", source,
+		"-af", enc.Filter+", loudnorm="+enc.Loudnorm+":print_format=json",
+		"-f", "null", "-")
+	cmd := exec.Command(ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if decoder != nil {
+		decoded, err := decoder.StdoutPipe()
+		if err != nil {
+			return "", err
+		}
+		cmd.Stdin = decoded
+		if err := decoder.Start(); err != nil {
+			return "", fmt.Errorf("starting decoder failed: %v", err)
+		}
+		defer decoder.Wait()
+		defer decoded.Close()
+	}
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("loudness analysis failed: %v\nOutput: %s", err, stderr.String())
+	}
+
+	// The analysis is the last JSON object in the log
+	output := stderr.String()
+	start, end := strings.LastIndex(output, "{"), strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("no loudnorm analysis in ffmpeg output")
+	}
+	var m loudnormMeasurement
+	if err := json.Unmarshal([]byte(output[start:end+1]), &m); err != nil {
+		return "", fmt.Errorf("parsing loudnorm analysis failed: %v", err)
+	}
+	if strings.Contains(m.InputI, "inf") {
+		fmt.Printf("Track %d is silent, not normalising it\n", enc.SourceIndex)
+		return enc.Filter, nil
+	}
+	fmt.Printf("Track %d measured %s LUFS, %s dBTP, %s LU\n", enc.SourceIndex, m.InputI, m.InputTP, m.InputLRA)
+
+	// loudnorm upsamples to 192 kHz internally; Opus wants 48 kHz
+	return fmt.Sprintf("%s, loudnorm=%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true, aresample=48000",
+		enc.Filter, enc.Loudnorm, m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.Offset), nil
+}
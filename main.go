@@ -3,54 +3,350 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
+// enhancedTrackTitle is the title given to every downmixed track.
+const enhancedTrackTitle = "2.1 Enhanced"
+
 // TrackInfo stores details of each audio track found in the input file.
 type TrackInfo struct {
 	Index    string // Index of the track within the file
 	Layout   string // Audio channel layout (e.g., "5.1", "7.1")
 	Language string // Language of the audio track
 	Title    string // Title of the track, if available
+
+	Channels    int            // Number of channels
+	Codec       string         // ffprobe codec name (e.g., "dts", "truehd")
+	Profile     string         // ffprobe codec profile (e.g., "DTS-HD MA", "Dolby TrueHD + Dolby Atmos")
+	Disposition map[string]int // ffprobe disposition flags (default, comment, ...)
 }
 
 func main() {
+	// Maintenance commands have their own flags
+	if len(os.Args) > 1 && os.Args[1] == "clean" {
+		runClean(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "apply" {
+		runApply(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		runStatus(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		runAnalyze(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "examples" {
+		runExamples(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "pause" || os.Args[1] == "resume") {
+		runPauseCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	// "plan" takes the same options but only shows what would happen;
+	// "upgrade" re-processes outputs made with other settings
+	args := os.Args[1:]
+	planOnly := len(args) > 0 && args[0] == "plan"
+	upgrade := len(args) > 0 && args[0] == "upgrade"
+	soak := len(args) > 0 && args[0] == "soak"
+	if planOnly || upgrade || soak {
+		args = args[1:]
+	}
+	if upgrade && len(args) > 0 && args[0] == "plan" {
+		planOnly = true
+		args = args[1:]
+	}
+	// "soak" is a hidden endurance test of the whole pipeline
+	var soakSettings *soakOptions
+	if soak {
+		soakSettings = soakFlags()
+	}
+	flags := parseFlags(args)
+	explicit := explicitFlags()
+	planOnly = planOnly || flags.DryRun
+	if flags.Device == "list" {
+		if err := printDevices(); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Check command line arguments for input file
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run script.go <input.mkv>")
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Nothing, not even ffmpeg, may run before privileges are dropped
+	if err := harden(flags, flag.Arg(0)); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	// A missing encoder should fail now, not in the middle of a batch
+	setToolPaths(*flags)
+	if flags.HashWorkers > 0 {
+		hashWorkers = flags.HashWorkers
+	}
+	if err := checkTools(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if err := checkSharedSettings(flags, explicit); err != nil {
+		fmt.Println("Error:", err)
 		os.Exit(1)
 	}
 
-	inputFile := os.Args[1]
-	outputFile := strings.TrimSuffix(inputFile, ".mkv") + "_enhanced.mkv"
+	// Keep stdout clean for the JSON plan or summaries; progress goes to
+	// stderr instead
+	stdout := os.Stdout
+	if flags.JSON {
+		os.Stdout = os.Stderr
+		if !planOnly {
+			jsonSummaries = stdout
+		}
+	}
+
+	// Progress and -quiet need all output to pass through the console
+	console, err := startConsole(flags)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	ctx, stop := interruptContext()
+	if !planOnly {
+		go watchPause(ctx, flags.TempDir)
+	}
+	code := exitOK
+	switch {
+	case soak:
+		if !runSoak(ctx, flag.Arg(0), flags, explicit, soakSettings) {
+			code = exitFailed
+		}
+	case upgrade:
+		code = runUpgrade(ctx, flag.Arg(0), flags, explicit, planOnly)
+	case flags.Recursive:
+		code = runBatch(ctx, flag.Arg(0), flags, explicit, planOnly, stdout)
+	default:
+		err := processFile(ctx, flag.Arg(0), flags, explicit, planOnly, stdout)
+		if _, processed := err.(processedError); processed {
+			fmt.Printf("Skipping %s: %v\n", flag.Arg(0), err)
+			reportUnprocessed(flag.Arg(0), "skipped", err.Error())
+			if flags.JSON {
+				code = exitNothingToDo
+			}
+		} else if err != nil {
+			fmt.Println("Error:", err)
+			code = exitFailed
+		}
+	}
+	stop()
+	console.stop()
+	if code != exitOK {
+		os.Exit(code)
+	}
+}
+
+// checkSharedSettings checks the capabilities the settings every file
+// shares need: the flags, the configuration file and -device. Sidecars can
+// still change them, which preparePlan checks per file.
+func checkSharedSettings(flags *Options, explicit map[string]bool) error {
+	defer resetSettings(explicit)
+	resetSettings(explicit)
+	if err := loadConfig(explicit); err != nil {
+		return fmt.Errorf("loading settings failed: %v", err)
+	}
+	if err := loadDevice(explicit); err != nil {
+		return fmt.Errorf("loading settings failed: %v", err)
+	}
+	return checkCapabilities(*flags)
+}
+
+// processFile converts a single file, or only plans it if planOnly is set.
+func processFile(ctx context.Context, inputFile string, flags *Options, explicit map[string]bool, planOnly bool, stdout io.Writer) error {
+	// Disc folders are remuxed to a plain MKV first, which is then converted
+	if root, format, ok := discFolder(inputFile); ok {
+		mkv, err := remuxDisc(ctx, root, format, flags.DiscTitle)
+		if err != nil {
+			return err
+		}
+		inputFile = mkv
+	}
+
+	// rclone sources are converted from a local copy, and the output goes
+	// back next to them unless -publish says otherwise
+	remote, isRemote := rcloneSource(inputFile)
+	if isRemote {
+		if flags.Replace || flags.MetadataOnly {
+			return fmt.Errorf("-replace and -metadata-only can't change rclone sources")
+		}
+		local, err := fetchRemoteSource(ctx, remote, flags.TempDir)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(filepath.Dir(local))
+		inputFile = local
+	}
+
+	started := time.Now()
+	plan, opts, err := preparePlan(ctx, inputFile, flags, explicit)
+	if err != nil {
+		if _, processed := err.(processedError); !processed && !planOnly {
+			finishUnplannedJob(inputFile, flags, started, err)
+		}
+		return err
+	}
+	if isRemote && plan.Publish == "" {
+		plan.Publish = remoteOutputTarget(remote)
+	}
+	if planOnly {
+		if opts.JSON {
+			if err := writePlanJSON(stdout, plan); err != nil {
+				return fmt.Errorf("writing plan failed: %v", err)
+			}
+			return nil
+		}
+		printPlan(plan)
+		if opts.DryRun {
+			printCommands(plan)
+		}
+		return nil
+	}
+	return runPlan(ctx, plan, opts, nil)
+}
+
+// preparePlan inspects a file and builds its plan. Settings are re-resolved
+// for every file from the command line, the configuration file and the
+// file's sidecar.
+func preparePlan(ctx context.Context, inputFile string, flags *Options, explicit map[string]bool) (*Plan, Options, error) {
+	if err := loadSettings(inputFile, explicit); err != nil {
+		return nil, Options{}, fmt.Errorf("loading settings failed: %v", err)
+	}
+	opts := *flags
+	if err := checkCapabilities(opts); err != nil {
+		return nil, opts, err
+	}
+
+	// The extension isn't trusted, the container is probed
+	if err := checkInputContainer(inputFile, opts); err != nil {
+		return nil, opts, err
+	}
+	outputFile, err := outputPath(inputFile, opts)
+	if err != nil {
+		return nil, opts, err
+	}
+	if opts.MetadataOnly {
+		outputFile = inputFile
+	}
+
+	// Re-runs over a library leave converted files alone, but finish
+	// outputs an interrupted run merged and didn't get to verify
+	state := loadJobState(inputFile, opts.TempDir)
+	resuming := state.Merged != nil && state.Merged.Output == outputFile
+	if !opts.Force && !opts.MetadataOnly && !resuming {
+		if err := checkProcessed(inputFile, outputFile, opts.MarkerTag); err != nil {
+			return nil, opts, err
+		}
+	}
 
 	// Extract track information from the input file
 	trackInfos, err := extractTrackInfo(inputFile)
 	if err != nil {
-		fmt.Println("Error extracting track info:", err)
-		os.Exit(1)
+		return nil, opts, fmt.Errorf("extracting track info failed: %v", err)
+	}
+
+	// Broadcast captures can carry several programs; only one is converted
+	programStreams, err := programStreamIndices(inputFile, opts.Program)
+	if err != nil {
+		return nil, opts, err
 	}
+	trackInfos = filterTracksByProgram(trackInfos, programStreams)
 
-	var wg sync.WaitGroup
-	for _, track := range trackInfos {
-		wg.Add(1)
-		go processTrack(inputFile, track, &wg)
+	// Linked segments can't be remuxed on their own without losing content
+	if err := checkLinkedSegments(inputFile); err != nil {
+		return nil, opts, err
 	}
-	wg.Wait()
 
-	// Merge the processed tracks back into a single MKV file
-	if err := mergeTracks(inputFile, outputFile, trackInfos); err != nil {
-		fmt.Println("Error merging tracks:", err)
-		os.Exit(1)
+	// Identify the spoken language of untagged tracks if requested
+	if opts.LangIDCmd != "" {
+		detectMissingLanguages(ctx, inputFile, trackInfos, opts)
 	}
 
-	removeTemporaryFiles(inputFile, trackInfos)
+	// Only surround tracks the user asked for are downmixed
+	selected, err := selectTracks(trackInfos, opts)
+	if err != nil {
+		return nil, opts, err
+	}
 
-	fmt.Println("Enhanced MKV generated:", outputFile)
+	// List the video streams and flag 3D video that may not survive a remux
+	warnings, err := checkVideoStreams(inputFile)
+	if err != nil {
+		fmt.Println("Error checking video streams:", err)
+	}
+
+	// Editions and ordered chapters don't survive an ffmpeg remux
+	warnings = append(warnings, checkEditions(inputFile, opts.PreserveEditions)...)
+
+	plan, err := buildPlan(inputFile, outputFile, selected, programStreams, opts)
+	if err != nil {
+		return nil, opts, fmt.Errorf("building plan failed: %v", err)
+	}
+
+	// Warn about audio/subtitle combinations the kept streams leave
+	// unsubtitled
+	warnings = append(warnings, checkLanguageConsistency(plan)...)
+	warnings = append(warnings, checkVideoReencode(plan)...)
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+	plan.Warnings = warnings
+
+	// Optionally resolve the proper movie/episode name for reports
+	if opts.TMDbKey != "" {
+		title, err := newTMDbClient(opts.TMDbKey).Lookup(inputFile)
+		if err != nil {
+			fmt.Println("TMDb lookup failed:", err)
+		} else {
+			fmt.Println("Title:", title.DisplayName())
+			plan.Media = &title
+		}
+	}
+	return plan, opts, nil
+}
+
+// runPlan executes a plan and reports the result. jobs is passed on to
+// executePlan.
+func runPlan(ctx context.Context, plan *Plan, opts Options, jobs *jobLimiter) error {
+	started := time.Now()
+	err := executePlan(ctx, plan, jobs)
+	finishJob(plan, started, err)
+	if err != nil {
+		return err
+	}
+
+	if opts.MetadataOnly {
+		fmt.Println("Metadata updated:", plan.Output)
+		return nil
+	}
+	fmt.Println("Enhanced MKV generated:", plan.Output)
+	return nil
 }
 
 // extractTrackInfo uses ffprobe to extract audio track details from a video file.
@@ -59,132 +355,276 @@ func extractTrackInfo(file string) ([]TrackInfo, error) {
 		return nil, fmt.Errorf("file does not exist: %s", file)
 	}
 
-	// Use ffprobe to get audio track information
-	cmd := exec.Command("ffprobe", "-loglevel", "error", "-select_streams", "a",
-		"-show_entries", "stream=index,channel_layout:stream_tags=language,title",
-		"-of", "compact=p=0:nk=1", file)
-
-	output, err := cmd.CombinedOutput()
+	// JSON keeps titles containing separators and missing tags intact
+	streams, err := probeStreams(file, "a")
 	if err != nil {
-		return nil, fmt.Errorf("ffprobe failed with error: %s\nOutput: %s", err, string(output))
-	}
-
-	scanner := bufio.NewScanner(bytes.NewReader(output))
-	var tracks []TrackInfo
-	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), "|")
-		if len(parts) >= 3 {
-			track := TrackInfo{
-				Index:    parts[0],
-				Layout:   parts[1],
-				Language: parts[2],
-				Title:    "", // Default empty if not provided
-			}
-			if len(parts) > 3 {
-				track.Title = parts[3]
-			}
-			tracks = append(tracks, track)
-		}
+		return nil, err
+	}
+	tracks := make([]TrackInfo, 0, len(streams))
+	for _, s := range streams {
+		tracks = append(tracks, TrackInfo{
+			Index:       strconv.Itoa(s.Index),
+			Layout:      s.ChannelLayout,
+			Channels:    s.Channels,
+			Language:    s.Tags["language"],
+			Title:       s.Tags["title"],
+			Codec:       s.CodecName,
+			Profile:     s.Profile,
+			Disposition: s.Disposition,
+		})
 	}
 	return tracks, nil
 }
 
 // processTrack processes each audio track individually using ffmpeg.
-func processTrack(inputFile string, track TrackInfo, wg *sync.WaitGroup) {
-	defer wg.Done()
+func processTrack(ctx context.Context, plan *Plan, enc PlanEncode, jobs *jobLimiter) error {
+	// Skip processing if an interrupted run already finished this encode,
+	// or this exact encode exists in the cache; the file name is derived
+	// from the source content and the settings
+	if plan.state.encodeValid(enc, plan.duration) || cachedEncodeValid(enc) {
+		fmt.Printf("Enhanced track %d already exists, skipping processing\n", enc.SourceIndex)
+		return nil
+	}
+	jobs.acquire()
+	defer jobs.release(enc.TempFile)
+	started := time.Now()
+	partial := partialPath(enc.TempFile, plan.JobID)
+
+	// Normalisation needs a first pass measuring the downmix
+	filter := enc.Filter
+	if enc.Loudnorm != "" {
+		var err error
+		if filter, err = loudnormFilter(plan, enc); err != nil {
+			return err
+		}
+	}
 
-	// Define audio filters based on the channel layout
-	var af string
-	if strings.HasPrefix(track.Layout, "7.1") {
-		af = "volume=1.5, pan=stereo|FL=FL+0.707*FC+0.5*BL+0.3*SL+0.5*LFE|FR=FR+0.707*FC+0.5*BR+0.3*SR+0.5*LFE"
-	} else {
-		af = "volume=1.5, pan=stereo|FL=FL+0.707*FC+0.707*BL+0.5*LFE|FR=FR+0.707*FC+0.707*BR+0.5*LFE"
+	// Metering only adds logging, so it doesn't change the cached result
+	var meter *levelMeter
+	if plan.Meter {
+		filter = meteredFilter(filter)
+		meter = newLevelMeter(enc.SourceIndex)
 	}
-	enhancedFile := strings.TrimSuffix(inputFile, ".mkv") + "_track" + track.Index + "_enhanced.opus"
 
-	// Skip processing if enhanced track already exists
-	if _, err := os.Stat(enhancedFile); err == nil {
-		fmt.Printf("Enhanced track %s already exists, skipping processing\n", track.Index)
-		return
+	// Progress comes from -progress; the log only carries problems, plus
+	// the levels when metering
+	logLevel := "warning"
+	if meter != nil {
+		logLevel = "info"
+	}
+	args := encodeCommandArgs(plan, enc, filter, logLevel, partial)
+
+	// An external decoder feeds the decoded track through a pipe
+	var decoder *exec.Cmd
+	if enc.Decoder != "" {
+		decoder = interruptibleCommand(ctx, "sh", "-c", enc.Decoder)
+		decoder.Stderr = os.Stderr
 	}
+	cmd := interruptibleCommand(ctx, ffmpegPath, args...)
 
-	cmd := exec.Command("ffmpeg",
-		"-i", inputFile,
-		"-map", "0:"+track.Index,
-		"-af", af,
-		"-acodec", "libopus", "-b:a", "320k",
-		"-vbr", "on",
-		"-compression_level", "9",
-		"-frame_duration", "20",
-		"-application", "audio",
-		"-metadata:s:a", "language="+track.Language,
-		"-metadata:s:a", "title=2.1 Enhanced",
-		"-y", enhancedFile)
+	var decoded io.ReadCloser
+	if decoder != nil {
+		var err error
+		if decoded, err = decoder.StdoutPipe(); err != nil {
+			return err
+		}
+		cmd.Stdin = decoded
+		if err := decoder.Start(); err != nil {
+			return fmt.Errorf("starting decoder failed: %v", err)
+		}
+	}
 
 	// Execute the ffmpeg command and capture stderr for error tracking
 	stderrPipe, _ := cmd.StderrPipe()
+	progressPipe, _ := cmd.StdoutPipe()
 	if err := cmd.Start(); err != nil {
-		fmt.Printf("Error starting ffmpeg for track %s: %v\n", track.Index, err)
-		return
+		if decoder != nil {
+			decoder.Process.Kill()
+			decoder.Wait()
+		}
+		return fmt.Errorf("starting ffmpeg failed: %v", err)
+	}
+	if decoded != nil {
+		// Only ffmpeg reads the decoder output; if it exits, the decoder
+		// must see a broken pipe instead of blocking
+		decoded.Close()
 	}
 
-	// Print ffmpeg output in real time
+	// Feed ffmpeg's progress to the limiter, the checkpoint and the
+	// progress line, and print its warnings and errors
+	checkpoint := newCheckpoint(plan, enc)
+	shown := progress.start(plan.Input, enc.SourceIndex, plan.duration)
+	defer progress.finish(shown)
+	reported := make(chan struct{})
 	go func() {
+		defer close(reported)
+		readFFmpegProgress(progressPipe, func(position, speed float64) {
+			jobs.reportSpeed(enc.TempFile, speed)
+			checkpoint.report(position, speed)
+			progress.update(shown, position, speed)
+		})
+	}()
+	corrupt := 0
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
 		scanner := bufio.NewScanner(stderrPipe)
+		scanner.Split(scanFFmpegLines)
 		for scanner.Scan() {
-			fmt.Println("FFmpeg Output:", scanner.Text())
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+			if isCorruptionMessage(line) {
+				corrupt++
+			}
+			if meter != nil && meter.parse(line) {
+				continue
+			}
+			logTrack(plan.Input, enc.SourceIndex, slog.LevelWarn, "ffmpeg: "+line)
 		}
 	}()
 
-	if err := cmd.Wait(); err != nil {
-		fmt.Printf("FFmpeg command for track %s failed: %v\n", track.Index, err)
+	<-scanned
+	<-reported
+	err := cmd.Wait()
+	if err != nil {
+		err = fmt.Errorf("ffmpeg command failed: %v", err)
+	}
+	if decoder != nil {
+		if decodeErr := decoder.Wait(); decodeErr != nil && err == nil {
+			err = fmt.Errorf("decoder failed: %v", decodeErr)
+		}
 	}
+	if err != nil {
+		checkpoint.fail()
+		os.Remove(partial)
+		return err
+	}
+	checkpoint.finish()
+	if corrupt > 0 {
+		fmt.Printf("Track %d: skipped %d corrupt packet(s) or frame(s)\n", enc.SourceIndex, corrupt)
+	}
+	if err := os.Rename(partial, enc.TempFile); err != nil {
+		return fmt.Errorf("finishing the encode failed: %v", err)
+	}
+	if err := writeCacheManifest(enc, plan.JobID); err != nil {
+		fmt.Printf("Error recording track %d in the cache: %v\n", enc.SourceIndex, err)
+	}
+	plan.state.encodeDone(enc, time.Since(started))
+	return nil
 }
 
-// mergeTracks combines video, original audio, and enhanced audio tracks into a single file.
-func mergeTracks(inputFile, outputFile string, tracks []TrackInfo) error {
-	args := []string{"-i", inputFile} // Include the original video file
-
-	for _, track := range tracks {
-		enhancedFile := strings.TrimSuffix(inputFile, ".mkv") + "_track" + track.Index + "_enhanced.opus"
-		args = append(args, "-i", enhancedFile) // Include enhanced audio tracks
+// encodeCommandArgs returns the ffmpeg arguments encoding one track of the
+// plan with filter into output. With an external decoder, ffmpeg reads the
+// decoded track from stdin.
+func encodeCommandArgs(plan *Plan, enc PlanEncode, filter, logLevel, output string) []string {
+	args := []string{"-hide_banner", "-loglevel", logLevel, "-nostats", "-progress", "pipe:1"}
+	input := plan.source()
+	source := fmt.Sprintf("0:%d", enc.SourceIndex)
+	if enc.Decoder != "" {
+		input = "pipe:0"
+		source = "0:a:0"
 	}
+	args = append(args, plan.inputArgs(input)...)
+	args = append(args,
+		"-map", source,
+		"-af", filter)
+	args = append(args, enc.EncoderArgs...)
+	return append(args,
+		"-metadata:s:a", "language="+enc.Language,
+		"-metadata:s:a", "title="+enc.Title,
+		"-y", output)
+}
 
-	args = append(args, "-map", "0:v")  // Map video stream from the original file
-	args = append(args, "-map", "0:s?") // Map subtitle streams, if available
-
-	// Copy original and enhanced audio streams
-	for i := range tracks {
-		args = append(args, "-map", fmt.Sprintf("0:a:%d", i), "-c:a", "copy")
-		args = append(args, "-map", fmt.Sprintf("%d:a", 1+i), "-c:a", "copy")
+// mergeTracks combines video, original audio, and enhanced audio tracks into a single file.
+func mergeTracks(ctx context.Context, plan *Plan) error {
+	if plan.Tempo != 0 {
+		if err := writeRetimedChapters(plan); err != nil {
+			return fmt.Errorf("retiming chapters failed: %v", err)
+		}
+		defer os.Remove(plan.chapterFile())
 	}
+	args := mergeCommandArgs(plan)
+	logDebug("ffmpeg %s", strings.Join(args, " "))
 
-	args = append(args, "-c:v", "copy", "-c:s", "copy", "-y", outputFile)
-
-	// Debugging: Print the ffmpeg command to verify correctness
-	fmt.Println("ffmpeg", strings.Join(args, " "))
-
-	cmd := exec.Command("ffmpeg", args...)
+	cmd := interruptibleCommand(ctx, ffmpegPath, args...)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
+		// Never leave a broken output behind
+		os.Remove(plan.Output)
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
 		return fmt.Errorf("ffmpeg command failed: %v\nstderr:\n%s", err, stderr.String())
 	}
+	if n := countCorruption(stderr.String()); n > 0 {
+		fmt.Printf("Merge: skipped %d corrupt packet(s)\n", n)
+	}
 	return nil
 }
 
+// mergeCommandArgs returns the ffmpeg arguments merging the plan's output.
+func mergeCommandArgs(plan *Plan) []string {
+	args := append(plan.tempoInputArgs(), plan.inputArgs(plan.source())...) // Include the original video file
+	for _, enc := range plan.Encodes {
+		args = append(args, "-i", enc.TempFile) // Include enhanced audio tracks
+	}
+
+	// Retimed chapters come from their own file, as -itsscale leaves them be
+	if plan.Tempo != 0 {
+		args = append(args, "-i", plan.chapterFile(), "-map_chapters", strconv.Itoa(1+len(plan.Encodes)))
+	}
+
+	// Map the output streams in plan order, writing tags and dispositions
+	// as we go
+	var metadata []string
+	outputs := plan.outputStreams()
+	for i, out := range outputs {
+		if out.Encode >= 0 {
+			args = append(args, "-map", fmt.Sprintf("%d:a", 1+out.Encode))
+		} else {
+			args = append(args, "-map", fmt.Sprintf("0:%d", out.Source))
+		}
+		metadata = append(metadata, streamMetadataArgs(i, out.Metadata)...)
+		metadata = append(metadata, dispositionArgs(i, out.Disposition)...)
+	}
+	args = append(args, metadata...)
+
+	// Dispositions are set explicitly, so the muxer mustn't infer defaults
+	if isMatroska(plan.Output) {
+		args = append(args, "-default_mode", "passthrough")
+	}
+
+	// Copy everything except what the plan re-encodes
+	args = append(args, "-c", "copy")
+	args = append(args, plan.VideoArgs...)
+	args = append(args, plan.videoStreamArgs(outputs)...)
+	args = append(args, plan.MergeArgs...)
+	return append(args, "-y", plan.Output)
+}
+
+// streamMetadataArgs returns the ffmpeg options writing tags to an output stream.
+func streamMetadataArgs(outIndex int, tags map[string]string) []string {
+	var args []string
+	for key, value := range tags {
+		args = append(args, fmt.Sprintf("-metadata:s:%d", outIndex), key+"="+value)
+	}
+	return args
+}
+
 // removeTemporaryFiles deletes all temporary enhanced audio files.
-func removeTemporaryFiles(inputFile string, tracks []TrackInfo) error {
-	for _, track := range tracks {
-		// Construct the filename for each temporary enhanced audio file
-		enhancedFile := strings.TrimSuffix(inputFile, ".mkv") + "_track" + track.Index + "_enhanced.opus"
-		// Remove the file
-		err := os.Remove(enhancedFile)
+func removeTemporaryFiles(encodes []PlanEncode) error {
+	for _, enc := range encodes {
+		// Remove the temporary enhanced audio file and its manifest
+		os.Remove(cacheManifestPath(enc.TempFile))
+		err := os.Remove(enc.TempFile)
 		if err != nil {
-			fmt.Printf("Failed to delete temporary file %s: %v\n", enhancedFile, err)
+			fmt.Printf("Failed to delete temporary file %s: %v\n", enc.TempFile, err)
 			return err
 		}
-		fmt.Printf("Temporary file %s removed successfully.\n", enhancedFile)
+		fmt.Printf("Temporary file %s removed successfully.\n", enc.TempFile)
 	}
 	return nil
 }
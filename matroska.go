@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Matroska element IDs used by the structure checks.
+const (
+	mkvEBML               = 0x1A45DFA3
+	mkvSegment            = 0x18538067
+	mkvSeekHead           = 0x114D9B74
+	mkvSeek               = 0x4DBB
+	mkvSeekID             = 0x53AB
+	mkvSeekPosition       = 0x53AC
+	mkvInfo               = 0x1549A966
+	mkvSegmentUID         = 0x73A4
+	mkvPrevUID            = 0x3CB923
+	mkvNextUID            = 0x3EB923
+	mkvSegmentFamily      = 0x4444
+	mkvChapters           = 0x1043A770
+	mkvEditionEntry       = 0x45B9
+	mkvEditionFlagOrdered = 0x45DD
+	mkvChapterAtom        = 0xB6
+	mkvChapterSegmentUID  = 0x6E67
+	mkvCluster            = 0x1F43B675
+	mkvTracks             = 0x1654AE6B
+	mkvTrackEntry         = 0xAE
+	mkvTrackNumber        = 0xD7
+	mkvTrackUID           = 0x73C5
+	mkvTrackType          = 0x83
+	mkvCues               = 0x1C53BB6B
+	mkvCuePoint           = 0xBB
+	mkvCueTrackPositions  = 0xB7
+	mkvCueTrack           = 0xF7
+)
+
+// maxMatroskaMetaSize caps how much of a metadata element is read into memory.
+const maxMatroskaMetaSize = 16 << 20
+
+// MatroskaInfo describes the segment-level structure of a Matroska file.
+type MatroskaInfo struct {
+	SegmentUID      []byte   // UID of this segment, if set
+	PrevUID         []byte   // UID of the previous segment in a split file
+	NextUID         []byte   // UID of the next segment in a split file
+	SegmentFamilies [][]byte // Families this segment belongs to
+	Editions        int      // Number of chapter editions
+	OrderedEditions int      // Number of editions with ordered chapters
+	LinkedSegments  [][]byte // Segment UIDs referenced by ordered chapters, excluding this one
+	Tracks          []MatroskaTrack
+	CuePoints       int             // Number of cue points, -1 if the Cues were too large to read
+	CuedTracks      map[uint64]bool // Track numbers with at least one cue point
+}
+
+// MatroskaTrack is a TrackEntry of the segment, in file order.
+type MatroskaTrack struct {
+	Number uint64 // TrackNumber used by blocks
+	UID    uint64 // TrackUID referenced by tags, chapters and players
+	Type   uint64 // TrackType (1 video, 2 audio, 17 subtitle, ...)
+}
+
+// IsLinked reports whether playback of the file depends on other segments.
+func (m *MatroskaInfo) IsLinked() bool {
+	return len(m.PrevUID) > 0 || len(m.NextUID) > 0 || len(m.LinkedSegments) > 0
+}
+
+// errNotMatroska is returned for files that don't start with an EBML header.
+var errNotMatroska = errors.New("not a Matroska file")
+
+// readMatroskaInfo reads the segment info and chapters of a Matroska file.
+// Only the small metadata elements are read; clusters are skipped via the
+// SeekHead or element sizes.
+func readMatroskaInfo(path string) (*MatroskaInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	id, size, hlen, err := readElementHeader(f, 0)
+	if err != nil || id != mkvEBML || size < 0 {
+		return nil, errNotMatroska
+	}
+
+	// The segment follows the EBML header
+	segOff := int64(hlen) + size
+	id, segSize, hlen, err := readElementHeader(f, segOff)
+	if err != nil || id != mkvSegment {
+		return nil, fmt.Errorf("no Matroska segment found: %v", err)
+	}
+	dataStart := segOff + int64(hlen)
+	segEnd := int64(-1)
+	if segSize >= 0 {
+		segEnd = dataStart + segSize
+	}
+
+	info := &MatroskaInfo{CuedTracks: make(map[uint64]bool)}
+	positions := make(map[uint64]int64)
+	seen := make(map[uint64]bool)
+
+	// Walk the top-level elements until the first cluster
+	for off := dataStart; segEnd < 0 || off < segEnd; {
+		id, size, hlen, err := readElementHeader(f, off)
+		if err != nil || id == mkvCluster || size < 0 {
+			break
+		}
+		body := off + int64(hlen)
+		switch id {
+		case mkvSeekHead:
+			data, err := readElementBody(f, body, size)
+			if err != nil {
+				return nil, err
+			}
+			parseSeekHead(data, dataStart, positions)
+		case mkvInfo, mkvChapters, mkvTracks:
+			data, err := readElementBody(f, body, size)
+			if err != nil {
+				return nil, err
+			}
+			info.parse(id, data)
+			seen[id] = true
+		case mkvCues:
+			info.readCues(f, body, size)
+			seen[id] = true
+		}
+		off = body + size
+	}
+
+	// Metadata written after the clusters is found via the SeekHead
+	for _, id := range []uint64{mkvInfo, mkvChapters, mkvTracks, mkvCues} {
+		pos, ok := positions[id]
+		if seen[id] || !ok {
+			continue
+		}
+		gotID, size, hlen, err := readElementHeader(f, pos)
+		if err != nil || gotID != id || size < 0 {
+			continue
+		}
+		if id == mkvCues {
+			info.readCues(f, pos+int64(hlen), size)
+			continue
+		}
+		data, err := readElementBody(f, pos+int64(hlen), size)
+		if err != nil {
+			return nil, err
+		}
+		info.parse(id, data)
+	}
+
+	// Ordered chapters pointing at this very segment aren't external links
+	linked := info.LinkedSegments[:0]
+	for _, uid := range info.LinkedSegments {
+		if !bytes.Equal(uid, info.SegmentUID) {
+			linked = append(linked, uid)
+		}
+	}
+	info.LinkedSegments = linked
+	return info, nil
+}
+
+// parse fills in the details from an Info, Chapters or Tracks element body.
+func (m *MatroskaInfo) parse(id uint64, data []byte) {
+	switch id {
+	case mkvInfo:
+		walkElements(data, func(id uint64, body []byte) {
+			switch id {
+			case mkvSegmentUID:
+				m.SegmentUID = body
+			case mkvPrevUID:
+				m.PrevUID = body
+			case mkvNextUID:
+				m.NextUID = body
+			case mkvSegmentFamily:
+				m.SegmentFamilies = append(m.SegmentFamilies, body)
+			}
+		})
+	case mkvTracks:
+		walkElements(data, func(id uint64, entry []byte) {
+			if id != mkvTrackEntry {
+				return
+			}
+			var track MatroskaTrack
+			walkElements(entry, func(id uint64, body []byte) {
+				switch id {
+				case mkvTrackNumber:
+					track.Number = readUint(body)
+				case mkvTrackUID:
+					track.UID = readUint(body)
+				case mkvTrackType:
+					track.Type = readUint(body)
+				}
+			})
+			m.Tracks = append(m.Tracks, track)
+		})
+	case mkvChapters:
+		walkElements(data, func(id uint64, edition []byte) {
+			if id != mkvEditionEntry {
+				return
+			}
+			m.Editions++
+			ordered := false
+			var uids [][]byte
+			walkElements(edition, func(id uint64, body []byte) {
+				switch id {
+				case mkvEditionFlagOrdered:
+					ordered = readUint(body) == 1
+				case mkvChapterAtom:
+					uids = append(uids, chapterSegmentUIDs(body)...)
+				}
+			})
+			if ordered {
+				m.OrderedEditions++
+				m.LinkedSegments = append(m.LinkedSegments, uids...)
+			}
+		})
+	}
+}
+
+// readCues counts the cue points of a Cues element and the tracks they
+// index. Cues of very long files can exceed maxMatroskaMetaSize; they are
+// only recorded as present.
+func (m *MatroskaInfo) readCues(r io.ReaderAt, off, size int64) {
+	data, err := readElementBody(r, off, size)
+	if err != nil {
+		m.CuePoints = -1
+		return
+	}
+	walkElements(data, func(id uint64, point []byte) {
+		if id != mkvCuePoint {
+			return
+		}
+		m.CuePoints++
+		walkElements(point, func(id uint64, positions []byte) {
+			if id != mkvCueTrackPositions {
+				return
+			}
+			walkElements(positions, func(id uint64, body []byte) {
+				if id == mkvCueTrack {
+					m.CuedTracks[readUint(body)] = true
+				}
+			})
+		})
+	})
+}
+
+// uncuedTracks returns the tracks players seek by that have no cue points:
+// the video tracks, or the audio tracks of files without video. Muxers
+// don't index the other tracks.
+func (m *MatroskaInfo) uncuedTracks() []MatroskaTrack {
+	if m.CuePoints < 0 {
+		return nil
+	}
+	seekType := uint64(2)
+	for _, t := range m.Tracks {
+		if t.Type == 1 {
+			seekType = 1
+		}
+	}
+	var missing []MatroskaTrack
+	for _, t := range m.Tracks {
+		if t.Type == seekType && !m.CuedTracks[t.Number] {
+			missing = append(missing, t)
+		}
+	}
+	return missing
+}
+
+// chapterSegmentUIDs collects the segment UIDs referenced by a chapter atom
+// and its nested chapters.
+func chapterSegmentUIDs(atom []byte) [][]byte {
+	var uids [][]byte
+	walkElements(atom, func(id uint64, body []byte) {
+		switch id {
+		case mkvChapterSegmentUID:
+			uids = append(uids, body)
+		case mkvChapterAtom:
+			uids = append(uids, chapterSegmentUIDs(body)...)
+		}
+	})
+	return uids
+}
+
+// parseSeekHead records the absolute file offsets listed in a SeekHead.
+func parseSeekHead(data []byte, segmentStart int64, positions map[uint64]int64) {
+	walkElements(data, func(id uint64, seek []byte) {
+		if id != mkvSeek {
+			return
+		}
+		var target uint64
+		var pos int64 = -1
+		walkElements(seek, func(id uint64, body []byte) {
+			switch id {
+			case mkvSeekID:
+				target = readUint(body)
+			case mkvSeekPosition:
+				pos = int64(readUint(body))
+			}
+		})
+		if target != 0 && pos >= 0 {
+			positions[target] = segmentStart + pos
+		}
+	})
+}
+
+// walkElements calls fn for each child element in an element body. Malformed
+// data ends the walk instead of failing.
+func walkElements(data []byte, fn func(id uint64, body []byte)) {
+	r := bytes.NewReader(data)
+	for off := int64(0); off < int64(len(data)); {
+		id, size, hlen, err := readElementHeader(r, off)
+		if err != nil || size < 0 || off+int64(hlen)+size > int64(len(data)) {
+			return
+		}
+		start := off + int64(hlen)
+		fn(id, data[start:start+size])
+		off = start + size
+	}
+}
+
+// readElementHeader decodes the EBML ID and size at off. A size of -1 means
+// the element has an unknown size.
+func readElementHeader(r io.ReaderAt, off int64) (id uint64, size int64, headerLen int, err error) {
+	var buf [12]byte
+	n, err := r.ReadAt(buf[:], off)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, 0, err
+	}
+	data := buf[:n]
+
+	id, idLen, ok := readVint(data, false)
+	if !ok || idLen > 4 {
+		return 0, 0, 0, fmt.Errorf("invalid EBML ID at offset %d", off)
+	}
+	raw, sizeLen, ok := readVint(data[idLen:], true)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid EBML size at offset %d", off)
+	}
+	size = int64(raw)
+	if raw == (1<<(7*uint(sizeLen)))-1 {
+		size = -1
+	}
+	return id, size, idLen + sizeLen, nil
+}
+
+// readVint decodes an EBML variable length integer. IDs keep their length
+// marker bit, sizes have it stripped.
+func readVint(data []byte, stripMarker bool) (uint64, int, bool) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || len(data) < length {
+		return 0, 0, false
+	}
+	value := uint64(data[0])
+	if stripMarker {
+		value &= uint64(0xFF >> uint(length))
+	}
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length, true
+}
+
+// readElementBody reads an element body of at most maxMatroskaMetaSize bytes.
+func readElementBody(r io.ReaderAt, off, size int64) ([]byte, error) {
+	if size > maxMatroskaMetaSize {
+		return nil, fmt.Errorf("Matroska element at offset %d is too large (%d bytes)", off, size)
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, off); err != nil {
+		return nil, fmt.Errorf("reading Matroska element at offset %d failed: %v", off, err)
+	}
+	return data, nil
+}
+
+// readUint decodes a big-endian EBML unsigned integer of up to 8 bytes.
+func readUint(data []byte) uint64 {
+	if len(data) > 8 {
+		return 0
+	}
+	var buf [8]byte
+	copy(buf[8-len(data):], data)
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// checkLinkedSegments refuses files whose playback depends on other segment
+// files, since remuxing a single segment silently drops the linked content.
+func checkLinkedSegments(file string) error {
+	info, err := readMatroskaInfo(file)
+	if err == errNotMatroska {
+		return nil
+	}
+	if err != nil {
+		fmt.Println("Warning: could not inspect Matroska segment structure:", err)
+		return nil
+	}
+	if !info.IsLinked() {
+		return nil
+	}
+	if len(info.LinkedSegments) > 0 {
+		return fmt.Errorf("%s uses ordered chapters that reference %d external segment(s); "+
+			"build a self-contained file first by appending the referenced segments in chapter order (e.g. with mkvmerge) and process that instead", file, len(info.LinkedSegments))
+	}
+	return fmt.Errorf("%s is one part of a split Matroska file (linked previous/next segment); "+
+		"append all parts into one file first (e.g. mkvmerge -o joined.mkv part1.mkv + part2.mkv) and process the result", file)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+)
+
+// mkvpropeditTrackProperties maps plan metadata keys to the track header
+// properties mkvpropedit sets.
+var mkvpropeditTrackProperties = map[string]string{
+	"language": "language",
+	"title":    "name",
+}
+
+// editMetadataInPlace applies the metadata changes of a metadata-only plan to
+// the source with mkvpropedit, without remuxing it.
+func editMetadataInPlace(plan *Plan) error {
+	if _, err := exec.LookPath("mkvpropedit"); err != nil {
+		return fmt.Errorf("mkvpropedit (MKVToolNix) is required for -metadata-only: %v", err)
+	}
+	for _, s := range plan.Streams {
+		if s.Action == "drop" {
+			return fmt.Errorf("stream %d would be dropped, which needs a remux; run without -metadata-only", s.Index)
+		}
+	}
+
+	// ffprobe stream indices follow the TrackEntry order
+	args := []string{plan.Input}
+	for _, s := range plan.Streams {
+		var keys []string
+		for key := range s.Metadata {
+			if _, ok := mkvpropeditTrackProperties[key]; ok {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+		args = append(args, "--edit", fmt.Sprintf("track:%d", s.Index+1))
+		for _, key := range keys {
+			property, value := mkvpropeditTrackProperties[key], s.Metadata[key]
+			if value == "" {
+				args = append(args, "--delete", property)
+			} else {
+				args = append(args, "--set", property+"="+value)
+			}
+			fmt.Printf("Track #%d: %s=%q\n", s.Index, key, value)
+		}
+	}
+	if len(args) == 1 {
+		fmt.Println("Metadata is already up to date.")
+		return nil
+	}
+	if err := auditPlan(plan, "metadata-edit", ""); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("mkvpropedit", args...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mkvpropedit failed: %v\nOutput: %s", err, output.String())
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// meterInputFilter measures per-channel levels of the source before the
+// downmix and prints them as frame metadata.
+const meterInputFilter = "astats=metadata=1:reset=25:measure_overall=none:measure_perchannel=Peak_level+RMS_level," +
+	"ametadata=mode=print"
+
+// meterOutputFilter logs the momentary loudness of the downmix.
+const meterOutputFilter = "ebur128=framelog=info"
+
+// meterInterval is how often levels are printed while encoding.
+const meterInterval = 2 * time.Second
+
+// deadChannelTime is how many seconds of silence on one channel, while
+// others carry sound, mark the channel as dead.
+const deadChannelTime = 30.0
+
+// silenceLevel is the RMS level below which a channel counts as silent, in dBFS.
+const silenceLevel = -90.0
+
+var (
+	meterPtsRe       = regexp.MustCompile(`pts_time:(-?[\d.]+)`)
+	meterStatRe      = regexp.MustCompile(`lavfi\.astats\.(\d+)\.(Peak_level|RMS_level)=(\S+)`)
+	meterMomentaryRe = regexp.MustCompile(`\bM:\s*(-?[\d.]+|-?inf)`)
+)
+
+// meteredFilter wraps a downmix filter with the metering filters.
+func meteredFilter(filter string) string {
+	return meterInputFilter + "," + filter + "," + meterOutputFilter
+}
+
+// levelMeter follows the levels of one track from ffmpeg's log output and
+// prints them with peak hold, warning about dead or clipping channels.
+type levelMeter struct {
+	track     int
+	pts       float64
+	rms       map[int]float64
+	hold      map[int]float64
+	silent    map[int]float64 // Time each silent channel went quiet
+	dead      map[int]bool
+	clipped   int
+	momentary float64
+	printed   time.Time
+}
+
+// newLevelMeter creates a meter for the track with the given source index.
+func newLevelMeter(track int) *levelMeter {
+	return &levelMeter{
+		track:     track,
+		rms:       make(map[int]float64),
+		hold:      make(map[int]float64),
+		silent:    make(map[int]float64),
+		dead:      make(map[int]bool),
+		momentary: math.Inf(-1),
+	}
+}
+
+// parse consumes an ffmpeg log line. It reports whether the line was meter
+// output, which isn't worth printing on its own.
+func (m *levelMeter) parse(line string) bool {
+	if match := meterStatRe.FindStringSubmatch(line); match != nil {
+		ch, _ := strconv.Atoi(match[1])
+		value := parseLevel(match[3])
+		if match[2] == "Peak_level" {
+			if hold, ok := m.hold[ch]; !ok || value > hold {
+				m.hold[ch] = value
+			}
+			if value >= 0 {
+				m.clipped++
+			}
+		} else {
+			m.rms[ch] = value
+			m.checkSilence(ch, value)
+		}
+		return true
+	}
+	if strings.Contains(line, "Parsed_ametadata") {
+		if match := meterPtsRe.FindStringSubmatch(line); match != nil {
+			m.pts, _ = strconv.ParseFloat(match[1], 64)
+		}
+		return true
+	}
+	if strings.Contains(line, "Parsed_ebur128") {
+		if match := meterMomentaryRe.FindStringSubmatch(line); match != nil {
+			m.momentary = parseLevel(match[1])
+		}
+		m.print()
+		return true
+	}
+	return false
+}
+
+// checkSilence warns once about a channel that stays silent while the
+// others don't.
+func (m *levelMeter) checkSilence(ch int, rms float64) {
+	if rms > silenceLevel {
+		delete(m.silent, ch)
+		return
+	}
+	since, ok := m.silent[ch]
+	if !ok {
+		m.silent[ch] = m.pts
+		return
+	}
+	if m.pts-since < deadChannelTime || m.dead[ch] || len(m.silent) == len(m.rms) {
+		return
+	}
+	m.dead[ch] = true
+	fmt.Printf("Warning: track %d channel %d has been silent for %.0fs while others carry sound\n",
+		m.track, ch, m.pts-since)
+}
+
+// print shows the current levels, at most every meterInterval.
+func (m *levelMeter) print() {
+	if time.Since(m.printed) < meterInterval || len(m.rms) == 0 {
+		return
+	}
+	m.printed = time.Now()
+
+	var channels []int
+	for ch := range m.rms {
+		channels = append(channels, ch)
+	}
+	sort.Ints(channels)
+	var levels []string
+	for _, ch := range channels {
+		levels = append(levels, fmt.Sprintf("ch%d %s (peak %s)", ch, formatLevel(m.rms[ch]), formatLevel(m.hold[ch])))
+	}
+	line := fmt.Sprintf("Track %d levels at %s: %s | M %s LUFS", m.track,
+		time.Duration(m.pts*float64(time.Second)).Round(time.Second), strings.Join(levels, ", "), formatLevel(m.momentary))
+	if m.clipped > 0 {
+		line += fmt.Sprintf(" | %d clipping window(s)", m.clipped)
+	}
+	fmt.Println(line)
+}
+
+// parseLevel parses a dB value as printed by ffmpeg, including "-inf".
+func parseLevel(s string) float64 {
+	if strings.HasSuffix(s, "inf") {
+		return math.Inf(-1)
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.Inf(-1)
+	}
+	return v
+}
+
+// formatLevel formats a dB value for the meter output.
+func formatLevel(v float64) string {
+	if math.IsInf(v, -1) {
+		return "-inf"
+	}
+	return fmt.Sprintf("%.1f", v)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Muxing targets, selectable with -target.
+const (
+	targetArchive   = "archive"   // ffmpeg's muxer defaults
+	targetStreaming = "streaming" // Short clusters, tight interleaving and the index up front
+)
+
+// Cluster limits of the streaming target: a TV fetching the file over the
+// network can start and seek after reading a couple of seconds of it.
+const (
+	streamingClusterTime = 2000    // Milliseconds
+	streamingClusterSize = 2 << 20 // Bytes
+)
+
+// validateTarget checks a -target value.
+func validateTarget(target string) error {
+	switch target {
+	case "", targetArchive, targetStreaming:
+		return nil
+	}
+	return fmt.Errorf("unknown target %q (use %s or %s)", target, targetArchive, targetStreaming)
+}
+
+// muxerArgs returns the ffmpeg output options laying out the merged file for
+// the -target, with -cluster-time, -cluster-size and -interleave-delta
+// overriding its defaults. Cluster limits only apply to Matroska.
+func muxerArgs(opts Options, output string) ([]string, error) {
+	if err := validateTarget(opts.Target); err != nil {
+		return nil, err
+	}
+	streaming := opts.Target == targetStreaming
+	var args []string
+
+	// Packets of all streams close together in the file, so players reading
+	// it front to back never buffer one stream to reach another
+	interleave := opts.InterleaveDelta
+	if interleave == "" && streaming && !opts.FixTimestamps {
+		interleave = "0"
+	}
+	if interleave != "" {
+		delta, err := time.ParseDuration(interleave)
+		if err != nil || delta < 0 {
+			return nil, fmt.Errorf("invalid -interleave-delta %q (use a duration such as 500ms, or 0 to wait for every stream)", interleave)
+		}
+		args = append(args, "-max_interleave_delta", strconv.FormatInt(delta.Microseconds(), 10))
+	}
+
+	if !isMatroska(output) {
+		if streaming {
+			args = append(args, "-movflags", "+faststart")
+		}
+		return args, nil
+	}
+	clusterTime, clusterSize := opts.ClusterTime, int64(0)
+	if opts.ClusterSize != "" {
+		size, err := parseByteSize(opts.ClusterSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -cluster-size: %v", err)
+		}
+		clusterSize = size
+	}
+	if streaming {
+		if clusterTime == 0 {
+			clusterTime = streamingClusterTime
+		}
+		if clusterSize == 0 {
+			clusterSize = streamingClusterSize
+		}
+		args = append(args, "-cues_to_front", "1")
+	}
+	if clusterTime < 0 {
+		return nil, fmt.Errorf("invalid -cluster-time %d", clusterTime)
+	}
+	if clusterTime > 0 {
+		args = append(args, "-cluster_time_limit", strconv.Itoa(clusterTime))
+	}
+	if clusterSize > 0 {
+		args = append(args, "-cluster_size_limit", strconv.FormatInt(clusterSize, 10))
+	}
+	return args, nil
+}
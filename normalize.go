@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// normalizeRules lists the available metadata normalisation rules.
+var normalizeRules = []string{"language", "titles", "spam", "fill"}
+
+// iso6392TToB maps ISO 639-2/T terminology codes to the bibliographic codes
+// Matroska uses.
+var iso6392TToB = map[string]string{
+	"sqi": "alb", "hye": "arm", "eus": "baq", "mya": "bur", "zho": "chi",
+	"ces": "cze", "nld": "dut", "fra": "fre", "kat": "geo", "deu": "ger",
+	"ell": "gre", "isl": "ice", "mkd": "mac", "mri": "mao", "msa": "may",
+	"fas": "per", "ron": "rum", "slk": "slo", "bod": "tib", "cym": "wel",
+}
+
+// trackTitleSpam matches release group and site advertising in track titles.
+var trackTitleSpam = []*regexp.Regexp{
+	regexp.MustCompile(`\[[^\]]*\]`),
+	regexp.MustCompile(`(?i)\b(encoded|ripped|synced|subbed|uploaded)\s+by\s+\S+`),
+	regexp.MustCompile(`(?i)\b(www\.)?[a-z0-9-]+\.(com|org|net|to|se|cc)\b`),
+}
+
+// parseNormalizeRules turns a comma separated rule list (or "all") into a set.
+func parseNormalizeRules(value string) (map[string]bool, error) {
+	rules := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case "all":
+			for _, r := range normalizeRules {
+				rules[r] = true
+			}
+		default:
+			known := false
+			for _, r := range normalizeRules {
+				known = known || r == name
+			}
+			if !known {
+				return nil, fmt.Errorf("unknown normalize rule %q (available: %s, all)", name, strings.Join(normalizeRules, ", "))
+			}
+			rules[name] = true
+		}
+	}
+	return rules, nil
+}
+
+// normalizeLanguageCode lower-cases a language code and converts ISO 639-2/T
+// and two-letter codes to the ISO 639-2/B form.
+func normalizeLanguageCode(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if long, ok := iso6391To6392[lang]; ok {
+		lang = long
+	}
+	if b, ok := iso6392TToB[lang]; ok {
+		return b
+	}
+	return lang
+}
+
+// cleanTrackTitle strips release spam and fixes all-lower or all-upper casing.
+func cleanTrackTitle(title string, rules map[string]bool) string {
+	if rules["spam"] {
+		for _, re := range trackTitleSpam {
+			title = re.ReplaceAllString(title, "")
+		}
+		title = strings.Join(strings.Fields(title), " ")
+		title = strings.Trim(title, " -|:")
+	}
+	if rules["titles"] && (title == strings.ToLower(title) || title == strings.ToUpper(title)) {
+		words := strings.Fields(strings.ToLower(title))
+		for i, w := range words {
+			// Keep short format tokens like "5.1" and "ac3" recognisable
+			if strings.ContainsAny(w, "0123456789") {
+				words[i] = strings.ToUpper(w)
+				continue
+			}
+			words[i] = strings.ToUpper(w[:1]) + w[1:]
+		}
+		title = strings.Join(words, " ")
+	}
+	return title
+}
+
+// normalizePlanMetadata applies the selected rules to the audio and subtitle
+// streams of a plan, recording changed tags in PlanStream.Metadata, and to
+// the languages of the new tracks.
+func normalizePlanMetadata(plan *Plan, rules map[string]bool) {
+	if len(rules) == 0 {
+		return
+	}
+
+	// The dominant language is the most common one among audio streams
+	counts := make(map[string]int)
+	dominant := ""
+	for _, s := range plan.Streams {
+		lang := normalizeLanguageCode(s.Language)
+		if s.Type != "audio" || isUndeterminedLanguage(lang) {
+			continue
+		}
+		counts[lang]++
+		if counts[lang] > counts[dominant] {
+			dominant = lang
+		}
+	}
+
+	fixLanguage := func(lang string) string {
+		if rules["language"] {
+			lang = normalizeLanguageCode(lang)
+		}
+		if rules["fill"] && isUndeterminedLanguage(lang) && dominant != "" {
+			lang = dominant
+		}
+		return lang
+	}
+
+	for i := range plan.Streams {
+		s := &plan.Streams[i]
+		if s.Type != "audio" && s.Type != "subtitle" {
+			continue
+		}
+		if lang := fixLanguage(s.Language); lang != s.Language {
+			s.setMetadata("language", lang)
+			s.Language = lang
+		}
+		if title := cleanTrackTitle(s.Title, rules); title != s.Title {
+			s.setMetadata("title", title)
+			s.Title = title
+		}
+	}
+	for i := range plan.Encodes {
+		plan.Encodes[i].Language = fixLanguage(plan.Encodes[i].Language)
+	}
+}
+
+// setMetadata records a tag the merge writes to the stream.
+func (s *PlanStream) setMetadata(key, value string) {
+	if s.Metadata == nil {
+		s.Metadata = make(map[string]string)
+	}
+	s.Metadata[key] = value
+}
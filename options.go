@@ -0,0 +1,286 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// Default downmix settings, used unless overridden by the configuration
+// file, a sidecar or flags.
+const (
+	defaultGain     = "1.5"
+	defaultMatrix51 = "FL=FL+0.707*FC+0.707*BL+0.5*LFE|FR=FR+0.707*FC+0.707*BR+0.5*LFE"
+	defaultMatrix71 = "FL=FL+0.707*FC+0.5*BL+0.3*SL+0.5*LFE|FR=FR+0.707*FC+0.5*BR+0.3*SR+0.5*LFE"
+
+	defaultAudioCodec       = "opus"
+	defaultBitrate          = "320k"
+	defaultCompressionLevel = 9
+)
+
+// defaultJobs runs one encode per CPU core.
+var defaultJobs = strconv.Itoa(runtime.NumCPU())
+
+// Options holds the command line settings for a run.
+//
+// Settings are resolved in the order flags > per-title sidecar >
+// configuration file > defaults.
+type Options struct {
+	Preset       string // Downmix filter preset, see downmixPresets
+	CustomFilter string // User-supplied downmix filter chain replacing the preset
+	RNNModel     string // arnndn model file for noise reduction in the speech preset
+	Gain         string // Volume multiplier applied by the downmix, unless normalising
+	Matrix51     string // Pan matrix used for 5.1 and other non-7.1 sources
+	Matrix71     string // Pan matrix used for 7.1 sources
+
+	OutputLayout string // Channel layout of the new tracks: stereo or 2.1
+	Device       string // Playback device whose known-good settings are the defaults
+
+	LoudnormTarget   float64 // Integrated loudness to normalise to in LUFS, 0 for the fixed gain
+	LoudnormTruePeak float64 // Maximum true peak when normalising, in dBTP
+	LoudnormRange    float64 // Target loudness range when normalising, in LU
+
+	AudioCodec       string // ffmpeg encoder for the new tracks
+	Bitrate          string // Bitrate of the new tracks, empty for the codec's default
+	CompressionLevel int    // Opus (0-10) or FLAC (0-12) encoder complexity
+	Dialnorm         int    // Dialogue level of AC-3 and E-AC-3 tracks in dB, 0 for automatic
+
+	TMDbKey   string // TMDb API key used to resolve titles, empty disables lookups
+	LangIDCmd string // Command identifying the spoken language of untagged tracks
+
+	FFmpegPath      string  // ffmpeg executable
+	FFprobePath     string  // ffprobe executable, empty to find it next to ffmpeg or in PATH
+	TempDir         string  // Directory for temporary encodes, empty means next to the input
+	OutputDir       string  // Directory the output is written to, empty means next to the input
+	InfoSidecar     string  // Format of the track info written next to the output
+	IgnoreDiskSpace bool    // Run even if the disk estimate doesn't fit the free space
+	StageDir        string  // Local directory the source is copied to before encoding
+	StageChunk      string  // Read size for staging the source
+	StageVerify     string  // Checksum comparing the staged copy with the source
+	StageReadahead  string  // How far the kernel reads ahead while staging
+	HashWorkers     int     // Pieces of a file hashed at once
+	CacheDir        string  // Directory keeping encoded tracks for reuse, empty means temporary
+	CacheMaxAgeDays int     // Evict cached tracks unused for this many days
+	CacheMaxSizeGB  float64 // Evict least recently used cached tracks above this size
+	Program         string  // Transport stream program to convert (number or ID)
+	DiscTitle       int     // Disc title or Blu-ray playlist to remux, 0 for the main title
+	Tracks          string  // Comma separated source stream indices to downmix, empty for all
+	Languages       string  // Comma separated languages to downmix, empty for all
+	SkipCommentary  bool    // Don't downmix commentary tracks
+	KeepOriginal    bool    // Copy the source tracks of downmixes to the output
+	DropTracks      string  // Comma separated source stream indices whose original is dropped after downmixing
+	DropLanguages   string  // Comma separated languages whose originals are dropped after downmixing
+	FixTimestamps   bool    // Normalise messy source timestamps while merging
+	Target          string  // Muxing target: archive or streaming
+	ClusterTime     int     // Matroska cluster length in milliseconds, 0 for the target's default
+	ClusterSize     string  // Matroska cluster size limit, empty for the target's default
+	InterleaveDelta string  // Maximum interleaving delay of the merge, empty for the target's default
+	JSON            bool    // Print machine-readable JSON instead of text
+	Quiet           bool    // Print nothing but errors
+	Plain           bool    // Screen reader friendly output without redraws
+	Progress        string  // Progress display: tracks or compact
+	DryRun          bool    // Show the plan and its ffmpeg commands without running them
+	LogLevel        string  // Least important messages shown: debug, info, warn or error
+	LogFile         string  // File every shown message is appended to
+	LogFormat       string  // Format of the log file: text or json
+	Normalize       string  // Comma separated metadata normalisation rules
+	Jobs            string  // Concurrent track encodes, a number or "auto"
+	SourceCheck     string  // How thoroughly the source is verified before encoding
+	Tempo           string  // Frame rate conversion of the whole file, see parseTempo
+	TempoFilter     string  // Time stretcher keeping the pitch, see tempoAtempo
+	OutputContainer string  // Container of the output, see containerMKV
+	MP4Opus         bool    // Allow Opus tracks in MP4 outputs
+	SeekTests       int     // Random seek positions tested in the output
+	Cues            string  // Seek index handling of Matroska outputs
+	PlayerCmd       string  // Player command for the seek test, empty to decode with ffmpeg
+	Verify          string  // How thoroughly the output is verified after merging
+	TolerateCorrupt bool    // Skip corrupt packets and decode errors instead of failing
+	Meter           bool    // Show per-channel levels and loudness while encoding
+	QualityCheck    bool    // Compare each downmix against ffmpeg's default downmix
+	MinPhase        float64 // Lowest acceptable phase correlation of a downmix, 0 for no limit
+	MusicTags       bool    // Tag new tracks with their MusicBrainz recording via AcoustID
+
+	TrackAttempts    int  // Tries per track encode before it counts as failed
+	SkipFailedTracks bool // Produce the output without tracks that keep failing
+
+	MetadataOnly bool        // Only fix track metadata in place, no encode or remux
+	Decoders     decoderFlag // External decoder commands by codec
+	ReleaseHints bool        // Pick settings from tokens in the file name
+
+	Recursive         bool   // Process every MKV below a directory
+	Force             bool   // Convert files even if they were already processed
+	Replace           bool   // Replace the source with the verified output
+	Backup            bool   // Keep the replaced source as <input>.bak
+	TrashDir          string // Move replaced sources to this directory
+	AuditLog          string // Append-only log of destructive actions
+	AuditHash         string // Checksum of originals in the audit log
+	Publish           string // Where verified outputs are delivered
+	PublishAttempts   int    // Tries per upload
+	MarkerTag         string // Track tag marking an already processed file
+	LocalizeTitles    bool   // Title new tracks in their own language
+	IncludeOwnOutputs bool   // Also process earlier outputs in recursive runs
+	Config            string // Configuration file, empty for the default location
+
+	PostHook        string // Shell command run after each job with its summary
+	SummaryTemplate string // text/template file used to render the text summary
+	OnSuccess       string // Shell command run after each successful job
+	OnFailure       string // Shell command run after each failed job
+	WebhookURL      string // URL the JSON job summary is POSTed to
+
+	RunAs        string // Account to switch to when started as root
+	CleanEnv     bool   // Drop environment variables ffmpeg and the hooks don't need
+	KeepEnv      string // Variables -clean-env keeps in addition to the basics
+	Sandbox      bool   // Only allow writes to the directories in use
+	SandboxWrite string // More directories the sandbox allows writes to
+
+	StatisticsTags   bool // Add Matroska track statistics tags with mkvpropedit
+	ReplayGain       bool // Write ReplayGain/R128 gain tags on the new tracks
+	PreserveUIDs     bool // Keep the source track UIDs on copied tracks
+	PreserveEditions bool // Copy all chapter editions and ordered chapters from the source
+
+	ADPolicy  string // What to do with audio description tracks
+	SDHPolicy string // What to do with SDH subtitle tracks
+
+	DefaultAudio string // Which audio track is flagged as default, see defaultAudioOriginal
+
+	VideoCodec  string // Video encoder, "copy" (default) keeps the original video
+	VideoCRF    string // Constant quality value for the video encoder
+	VideoPreset string // Encoder speed preset
+}
+
+// parseFlags parses the command line into Options. Positional arguments
+// remain available through flag.Args. The returned Options stay bound to the
+// flags, so later flag.Set calls (sidecars) are reflected in them.
+func parseFlags(args []string) *Options {
+	opts := &Options{Decoders: decoderFlag{}}
+	flag.StringVar(&opts.Preset, "preset", "default", "downmix preset: "+presetHelp())
+	flag.StringVar(&opts.CustomFilter, "custom-filter", "", "ffmpeg audio filter chain used instead of the preset, e.g. \"pan=stereo|FL=FL+FC+0.7*BL|FR=FR+FC+0.7*BR, volume=1.2\"; its first pan is checked against each source layout")
+	flag.StringVar(&opts.RNNModel, "rnn-model", "", "arnndn model file enabling RNN noise reduction in the speech preset")
+	flag.StringVar(&opts.Gain, "gain", defaultGain, "volume multiplier applied before the downmix (ignored with -loudnorm)")
+	flag.Float64Var(&opts.LoudnormTarget, "loudnorm", 0, "normalise the new tracks to this integrated loudness in LUFS (e.g. -16) with a two-pass EBU R128 loudnorm instead of the fixed -gain")
+	flag.Float64Var(&opts.LoudnormTruePeak, "loudnorm-tp", defaultLoudnormTruePeak, "maximum true peak in dBTP for -loudnorm")
+	flag.Float64Var(&opts.LoudnormRange, "loudnorm-lra", defaultLoudnormRange, "target loudness range in LU for -loudnorm")
+	flag.StringVar(&opts.Matrix51, "matrix51", defaultMatrix51, "stereo pan matrix for 5.1 sources")
+	flag.StringVar(&opts.Matrix71, "matrix71", defaultMatrix71, "stereo pan matrix for 7.1 sources")
+	flag.StringVar(&opts.Device, "device", "", "playback device (e.g. \"LG C2\") whose known-good codec, layout and loudness are used where nothing else sets them; \"list\" shows all devices")
+	flag.StringVar(&opts.OutputLayout, "layout", layoutStereo, "channel layout of the new tracks: stereo (LFE mixed into left and right) or 2.1 (own LFE channel; needs -acodec aac, ac3 or eac3, custom -matrix51/-matrix71 must assign LFE)")
+	flag.StringVar(&opts.AudioCodec, "acodec", defaultAudioCodec, "codec of the new tracks: "+codecNames()+", or any ffmpeg audio encoder")
+	flag.StringVar(&opts.Bitrate, "bitrate", "", "bitrate of the new tracks (default per codec: opus 320k, aac 256k, ac3 448k, eac3 640k); auto picks it per track from the source codec, channels and whether it is mostly speech or music")
+	flag.IntVar(&opts.CompressionLevel, "compression-level", defaultCompressionLevel, "Opus (0-10) or FLAC (0-12) encoder complexity, higher is slower and better")
+	flag.IntVar(&opts.Dialnorm, "dialnorm", 0, "dialogue level in dB (-31 to -1) written to ac3 and eac3 tracks for receivers to normalise to; 0 uses the -loudnorm target, or -31 (level unchanged) without it. No DRC profile is written, so receivers don't compress the downmix; use -preset nightmode for that")
+	flag.StringVar(&opts.TMDbKey, "tmdb-key", os.Getenv("TMDB_API_KEY"), "TMDb API key or API read access token for resolving movie/episode titles in reports (default $TMDB_API_KEY)")
+
+	flag.StringVar(&opts.LangIDCmd, "langid-cmd", "", "command that prints the spoken language of a WAV sample ({} is replaced by its path), used for untagged tracks")
+	flag.StringVar(&opts.FFmpegPath, "ffmpeg-path", ffmpegPath, "ffmpeg executable (default $FFMPEG_PATH or ffmpeg in PATH)")
+	flag.StringVar(&opts.FFprobePath, "ffprobe-path", os.Getenv("FFPROBE_PATH"), "ffprobe executable (default $FFPROBE_PATH, the ffprobe next to -ffmpeg-path, or ffprobe in PATH)")
+	flag.StringVar(&opts.TempDir, "temp-dir", "", "write temporary encodes to this directory instead of next to the input; each run works in its own subdirectory")
+	flag.StringVar(&opts.TempDir, "tmpdir", "", "shorthand for -temp-dir")
+	flag.StringVar(&opts.OutputDir, "output-dir", "", "write outputs to this directory instead of next to the input, e.g. for sources on read-only shares")
+	flag.StringVar(&opts.InfoSidecar, "info-sidecar", "", "describe the new tracks (codec, language, title, loudness) next to the output: json (<name>.audio.json) or nfo (Kodi/Jellyfin stream details, only if no .nfo exists)")
+	flag.BoolVar(&opts.IgnoreDiskSpace, "ignore-disk-space", false, "start even if the estimated disk usage exceeds the free space")
+	flag.StringVar(&opts.StageDir, "stage-dir", "", "copy the source to this local directory with large sequential reads before encoding, so parallel encodes don't cause seek storms on slow (e.g. NAS) storage")
+	flag.StringVar(&opts.StageVerify, "stage-verify", "", "checksum the source while staging it and compare the staged copy against it: sha256, sha256-tree, crc32c or crc64; empty skips the check")
+	flag.StringVar(&opts.StageReadahead, "stage-readahead", "", "with -stage-dir, ask the kernel to read this far ahead of the copy, e.g. 64M or 256M (Linux); compare the printed staging throughput with and without it")
+	flag.StringVar(&opts.StageChunk, "stage-chunk", defaultStageChunk, "read size for -stage-dir, e.g. 4M or 64M; the staging throughput is printed to compare sizes")
+	flag.StringVar(&opts.CacheDir, "cache-dir", "", "keep encoded tracks in this directory, keyed by source content and settings, and reuse them in later runs")
+	flag.IntVar(&opts.CacheMaxAgeDays, "cache-max-age", 0, "evict cached tracks not used for this many days (0 = never)")
+	flag.Float64Var(&opts.CacheMaxSizeGB, "cache-max-size", 0, "evict least recently used cached tracks above this many GB (0 = unlimited)")
+	flag.StringVar(&opts.Jobs, "jobs", defaultJobs, "concurrent track encodes, shared by all files in a batch: a number (0 = all tracks of a file at once) or auto to follow CPU load and encode speed")
+	flag.StringVar(&opts.Jobs, "j", defaultJobs, "shorthand for -jobs")
+	flag.StringVar(&opts.SourceCheck, "check", sourceCheckQuick, "verify the source before encoding: off, quick (readable, not truncated), packets (read every packet) or decode (also decode the downmixed tracks)")
+	flag.StringVar(&opts.Tempo, "tempo", "", "convert the whole file between frame rates in the same pass, e.g. pal (25 to 23.976 fps for sped-up PAL releases), pal24 or 25:23.976; the new tracks are time-stretched keeping their pitch, video, subtitle and chapter timestamps are scaled, so copied audio tracks must be dropped")
+	flag.StringVar(&opts.TempoFilter, "tempo-filter", tempoAtempo, "time stretcher for -tempo: atempo or rubberband (better quality, needs ffmpeg with librubberband)")
+	flag.StringVar(&opts.Cues, "cues", cuesCheck, "seek index of MKV outputs: off, check (warn if the video has no cue points) or repair (rebuild missing cues with mkvmerge or mkclean)")
+	flag.IntVar(&opts.SeekTests, "seek-test", 0, "after verifying, seek to this many random positions of the output and decode a few seconds from each, catching broken seek indexes (needs -verify fast or full)")
+	flag.StringVar(&opts.PlayerCmd, "player-cmd", "", "player used by -seek-test instead of ffmpeg, run through the shell with {file} and {start} (seconds) replaced, e.g. \"mpv --vo=null --ao=null --start={start} --length=2 {file}\"")
+	flag.StringVar(&opts.OutputContainer, "output-container", containerMKV, "container of the output: mkv, mp4 (needs -acodec aac, ac3 or eac3) or same (MP4/M4V sources stay MP4/M4V, AVI and TS become MKV)")
+	flag.BoolVar(&opts.MP4Opus, "mp4-opus", false, "allow Opus tracks in MP4 outputs, for players known to support them")
+	flag.StringVar(&opts.Verify, "verify", verifyFast, "verify the output before temp files are removed or the original replaced: off, fast (duration, stream counts, frame counts, decode the first "+strconv.Itoa(verifyDecodeSeconds)+"s of the new tracks) or full (decode the new tracks completely)")
+	flag.BoolVar(&opts.TolerateCorrupt, "tolerate-corrupt", false, "salvage damaged sources: ignore decode errors and drop corrupt packets (ffmpeg -err_detect ignore_err -fflags +discardcorrupt), reporting how many were skipped")
+	flag.BoolVar(&opts.Meter, "meter", false, "show live per-channel levels with peak hold and momentary loudness while encoding, warning about dead or clipping channels")
+	flag.BoolVar(&opts.MusicTags, "music-tags", false, "for concerts and other music: identify the new tracks with AcoustID (needs fpcalc and $ACOUSTID_API_KEY) and add MusicBrainz artist/album tags")
+	flag.BoolVar(&opts.QualityCheck, "qc", false, "compare each downmix with ffmpeg's default stereo downmix (loudness and spectral balance), report its phase correlation and warn about outliers")
+	flag.Float64Var(&opts.MinPhase, "min-phase", 0, "fail files whose downmix has a mean phase correlation below this (-1 to 1, e.g. 0.1), as it would lose content on mono soundbars; 0 disables")
+	flag.IntVar(&opts.TrackAttempts, "track-attempts", 1, "how often to try each track encode before giving up on it")
+	flag.BoolVar(&opts.SkipFailedTracks, "skip-failed-tracks", false, "leave out tracks whose encode keeps failing (e.g. a broken commentary track) instead of failing the whole file")
+	flag.BoolVar(&opts.MetadataOnly, "metadata-only", false, "don't encode or remux: apply the -normalize rules to the source's track headers in place with mkvpropedit")
+	flag.Var(opts.Decoders, "decoder", "decode a codec with an external command instead of ffmpeg, as codec=command or codec/profile=command (repeatable); the command writes WAV to stdout, {input} and {index} are replaced by the source file and stream index")
+	flag.StringVar(&opts.PostHook, "post-hook", "", "shell command run after the job; the summary is passed in $MKV21_SUMMARY (text) and $MKV21_SUMMARY_JSON, plus $MKV21_STATUS, $MKV21_INPUT and $MKV21_OUTPUT")
+	flag.StringVar(&opts.OnSuccess, "on-success", "", "shell command run after each converted file, with the same environment as -post-hook")
+	flag.StringVar(&opts.OnFailure, "on-failure", "", "shell command run after each failed file, with the same environment as -post-hook")
+	flag.StringVar(&opts.WebhookURL, "webhook-url", "", "POST the JSON job summary (input, output, tracks, duration, error) to this URL after each file")
+	flag.StringVar(&opts.SummaryTemplate, "summary-template", "", "Go text/template file for $MKV21_SUMMARY (functions: humanSize, humanDuration, shellQuote, json; release name tokens as .Release.title, .Release.resolution, .Release.source, .Release.acodec, ...)")
+	flag.StringVar(&opts.Program, "program", "", "program number or ID to convert in multi-program transport streams")
+	flag.StringVar(&opts.Target, "target", targetArchive, "lay the output out for archive (ffmpeg defaults) or streaming (2s clusters, tight interleaving, seek index at the start) to smart TVs over the network")
+	flag.IntVar(&opts.ClusterTime, "cluster-time", 0, "maximum Matroska cluster length in milliseconds (0 = the -target's default)")
+	flag.StringVar(&opts.ClusterSize, "cluster-size", "", "maximum Matroska cluster size, e.g. 2M (default per -target)")
+	flag.StringVar(&opts.InterleaveDelta, "interleave-delta", "", "maximum time the merge buffers one stream to interleave the others, e.g. 1s; 0 waits for every stream (default per -target)")
+	flag.BoolVar(&opts.FixTimestamps, "fix-timestamps", false, "shift negative timestamps and tighten interleaving while merging (for stuttering WEB-DL sources)")
+	flag.StringVar(&opts.VideoCodec, "vcodec", "copy", "re-encode video with this codec (hevc, av1, h264 or an ffmpeg encoder such as hevc_nvenc; VA-API encoders use "+vaapiDevice+"); cover art stays copied, copy keeps the original")
+	flag.StringVar(&opts.VideoCRF, "crf", "", "constant quality for -vcodec (CRF, or the encoder's equivalent for hardware encoders)")
+	flag.StringVar(&opts.VideoPreset, "vpreset", "", "encoder preset for -vcodec (e.g. slow, medium, p7)")
+	flag.StringVar(&opts.Normalize, "normalize", "", "metadata normalisation rules: language, titles, spam, fill or all (comma separated)")
+	flag.BoolVar(&opts.StatisticsTags, "stats-tags", false, "add track statistics tags (BPS, DURATION, ...) to the output using mkvpropedit")
+	flag.BoolVar(&opts.ReplayGain, "replaygain", false, "measure the new tracks and write ReplayGain/R128 gain tags")
+	flag.StringVar(&opts.ADPolicy, "ad-policy", policyDownmix, "audio description tracks: keep (no downmix), downmix, speech (speech-optimised downmix) or drop")
+	flag.StringVar(&opts.DefaultAudio, "default-audio", defaultAudioOriginal, "audio track flagged as default: original (the source's default track) or enhanced (its downmix)")
+	flag.StringVar(&opts.SDHPolicy, "sdh-policy", policyKeep, "SDH/hearing-impaired subtitles: keep or drop")
+	flag.BoolVar(&opts.PreserveUIDs, "preserve-uids", false, "keep the source track UIDs on copied tracks using mkvpropedit")
+	flag.BoolVar(&opts.PreserveEditions, "preserve-editions", false, "copy all chapter editions and ordered chapters from the source using MKVToolNix")
+	flag.StringVar(&opts.Tracks, "tracks", "", "only downmix these source stream indices, e.g. 1,3 (see the plan command)")
+	flag.StringVar(&opts.Languages, "lang", "", "only downmix tracks in these languages, e.g. en,de")
+	flag.BoolVar(&opts.SkipCommentary, "skip-commentary", false, "don't downmix commentary tracks (commentary disposition or title)")
+	flag.BoolVar(&opts.ReleaseHints, "release-hints", false, "pick settings left at their defaults from the release name, e.g. -bitrate auto for TrueHD, DTS-HD MA or FLAC audio")
+	flag.BoolVar(&opts.KeepOriginal, "keep-original", true, "copy the original surround tracks next to their downmix; -keep-original=false keeps only the enhanced audio")
+	flag.StringVar(&opts.DropTracks, "drop-tracks", "", "drop the originals of these downmixed source stream indices, e.g. 1,3")
+	flag.StringVar(&opts.DropLanguages, "drop-lang", "", "drop the originals of downmixed tracks in these languages, e.g. en,de")
+	flag.IntVar(&opts.DiscTitle, "disc-title", 0, "for Blu-ray (BDMV) and DVD (VIDEO_TS) folder inputs: the title, or Blu-ray playlist number, to remux instead of the longest one")
+	flag.BoolVar(&opts.Recursive, "r", false, "treat the argument as a directory and convert every MKV with a surround track below it")
+	flag.BoolVar(&opts.Replace, "replace", false, "after a verified merge, atomically replace the input with the enhanced file instead of keeping both")
+	flag.BoolVar(&opts.Backup, "backup", false, "with -replace, keep the original as <input>"+backupSuffix)
+	flag.StringVar(&opts.AuditHash, "audit-hash", "sha256", "checksum of originals in the -audit-log: sha256 (as sha256sum) or sha256-tree (parallel pieces, much faster); crc32c and crc64 are faster still but only catch accidental corruption, not deliberate tampering, so avoid them for an audit trail")
+	flag.IntVar(&opts.HashWorkers, "hash-workers", hashWorkers, "pieces of a file hashed in parallel by the tree checksums")
+	flag.StringVar(&opts.TrashDir, "trash-dir", "", "with -replace, move the original to this directory")
+	flag.StringVar(&opts.AuditLog, "audit-log", defaultAuditLog(), "append every in-place replacement or edit (user, settings, dropped streams, checksum of the original) to this JSON lines file; empty disables it")
+	flag.StringVar(&opts.Publish, "publish", "", "deliver the verified output to a local directory, s3://bucket/prefix (aws CLI), sftp://[user@]host[:port]/dir (sftp) or rclone:remote:path (rclone) instead of leaving it next to the input")
+	flag.IntVar(&opts.PublishAttempts, "publish-attempts", defaultPublishAttempts, "tries per -publish upload before the run fails, with a doubling delay between them")
+	flag.BoolVar(&opts.Force, "force", false, "convert files even if their output exists or they already contain a \""+enhancedTrackTitle+"\" track")
+	flag.BoolVar(&opts.LocalizeTitles, "localize-titles", false, "title new tracks in their language, e.g. \"2.1 Optimiert\" for German; labels can be added or changed in "+labelsFileName+" in the user config directory")
+	flag.StringVar(&opts.MarkerTag, "marker-tag", settingsTag, "audio track tag marking a file as already processed (empty to only check titles)")
+	flag.BoolVar(&opts.IncludeOwnOutputs, "include-own-outputs", false, "with -r, also process files written by this tool (recognised by name or their "+provenanceTag+" tag)")
+	flag.StringVar(&opts.Config, "config", "", "configuration file with default settings (default <user config dir>/"+configFileName+")")
+	flag.BoolVar(&opts.JSON, "json", false, "print machine-readable JSON: the plan with the plan command, otherwise a summary line per file (status, tracks, encode times, size change, verification), with exit codes 0 = converted, 2 = nothing to do, 3 = partial failure")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "only show what would be done, including the ffmpeg commands, like the plan command")
+	flag.StringVar(&opts.Progress, "progress", progressTracks, "progress display: tracks (a bar per running encode) or compact (one short line with files done, the current file and the ETA, for tmux and CI logs)")
+	flag.BoolVar(&opts.Plain, "plain", false, "screen reader friendly output: no redrawn progress line, a spelled-out status line every 30s instead (default when TERM=dumb)")
+	flag.BoolVar(&opts.Quiet, "quiet", false, "print nothing but errors, not even progress")
+	flag.StringVar(&opts.LogLevel, "log-level", "info", "least important messages to show and log: debug (includes ffmpeg command lines), info, warn or error")
+	flag.StringVar(&opts.LogFile, "log-file", "", "also append messages to this file, with time, level and the file and track they belong to")
+	flag.StringVar(&opts.LogFormat, "log-format", logFormatText, "format of the -log-file: text or json (one object per line)")
+
+	flag.StringVar(&opts.RunAs, "run-as", "", "when started as root, switch to this user (or user:group) before touching any file or running ffmpeg (Linux)")
+	flag.BoolVar(&opts.CleanEnv, "clean-env", false, "clear the environment of this process and everything it starts, except PATH, HOME, USER, LANG, LC_*, TZ, TMPDIR, TERM and XDG_*_HOME")
+	flag.StringVar(&opts.KeepEnv, "keep-env", "", "comma separated variables -clean-env keeps as well, e.g. ACOUSTID_API_KEY,AWS_*,RCLONE_* (a trailing * matches by prefix)")
+	flag.BoolVar(&opts.Sandbox, "sandbox", false, "only allow this process and ffmpeg to write below the input, output, temp, stage, cache, trash, publish and log directories, using Landlock (Linux 5.13+); for directories created later, their closest existing parent is allowed")
+	flag.StringVar(&opts.SandboxWrite, "sandbox-write", "", "comma separated directories the -sandbox allows writes to as well (implies -sandbox)")
+
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: go run script.go [options] <input.mkv | disc folder | rclone:remote:path/input.mkv>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go run script.go plan [options] <input.mkv>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go run script.go [plan] [options] -r <dir>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go run script.go upgrade [plan] [options] <dir>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go run script.go apply [options] <plan.json>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go run script.go clean [options] <dir>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go run script.go status [options] <dir>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go run script.go analyze [options] <dir>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go run script.go pause|resume [-temp-dir dir]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go run script.go examples [-json] [name]")
+		fmt.Fprintln(flag.CommandLine.Output(), "Defaults are read from the -config file and per-title overrides from <input.mkv>"+sidecarSuffix+" (keys are flag names; sidecars only take downmix and track selection settings).")
+		printHelpRecipes(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+	return opts
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pauseFileName is the control file that pauses running conversions for as
+// long as it exists in the temp directory.
+const pauseFileName = "mkv21.pause"
+
+// pausePollInterval is how often running conversions look for the control
+// file.
+const pausePollInterval = 2 * time.Second
+
+// pauseFilePath returns the control file for a -temp-dir setting.
+func pauseFilePath(tempDir string) string {
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	return filepath.Join(tempDir, pauseFileName)
+}
+
+// pauseControl holds back new work while the run is paused. Work already
+// running is suspended with its child processes, so it continues exactly
+// where it stopped.
+type pauseControl struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+// pauser is the pause state of the running conversion.
+var pauser = newPauseControl()
+
+func newPauseControl() *pauseControl {
+	p := &pauseControl{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// wait blocks while the run is paused.
+func (p *pauseControl) wait() {
+	p.mu.Lock()
+	for p.paused {
+		p.cond.Wait()
+	}
+	p.mu.Unlock()
+}
+
+// set pauses or resumes the run, stopping or continuing the child
+// processes. It reports whether the state changed.
+func (p *pauseControl) set(paused bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused == paused {
+		return false
+	}
+	p.paused = paused
+	if err := suspendChildren(paused); err != nil {
+		fmt.Println("Warning: running encodes can't be paused, only new ones are held back:", err)
+	}
+	if !paused {
+		p.cond.Broadcast()
+	}
+	return true
+}
+
+// watchPause pauses the run while the control file in tempDir exists, until
+// ctx is done.
+func watchPause(ctx context.Context, tempDir string) {
+	path := pauseFilePath(tempDir)
+	ticker := time.NewTicker(pausePollInterval)
+	defer ticker.Stop()
+	for {
+		_, err := os.Stat(path)
+		paused := err == nil
+		if pauser.set(paused) {
+			if paused {
+				fmt.Printf("Paused; run \"resume\" or remove %s to continue\n", path)
+			} else {
+				fmt.Println("Resumed")
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			// Suspended children must run to see the interrupt
+			pauser.set(false)
+			return
+		}
+	}
+}
+
+// runPauseCommand implements the "pause" and "resume" commands, which create
+// and remove the control file watched by running conversions.
+func runPauseCommand(name string, args []string) {
+	cmd := flag.NewFlagSet(name, flag.ExitOnError)
+	tempDir := cmd.String("temp-dir", "", "temp directory of the runs to "+name+" (default the system temp directory)")
+	cmd.Usage = func() {
+		fmt.Fprintf(cmd.Output(), "Usage: go run script.go %s [options]\n", name)
+		cmd.PrintDefaults()
+	}
+	cmd.Parse(args)
+
+	path := pauseFilePath(*tempDir)
+	if name == "pause" {
+		if err := os.WriteFile(path, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Running conversions pause within %s (%s)\n", pausePollInterval, path)
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Paused conversions resume within", pausePollInterval)
+}
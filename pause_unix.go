@@ -0,0 +1,60 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// suspendChildren stops or continues every descendant process, so encodes
+// and merges keep their place while paused.
+func suspendChildren(stop bool) error {
+	sig := syscall.SIGCONT
+	if stop {
+		sig = syscall.SIGSTOP
+	}
+	var firstErr error
+	for _, pid := range descendants(os.Getpid()) {
+		if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// descendants returns the process IDs below pid, parents first.
+func descendants(pid int) []int {
+	var all []int
+	for _, child := range children(pid) {
+		all = append(all, child)
+		all = append(all, descendants(child)...)
+	}
+	return all
+}
+
+// children lists the direct child processes of pid, from /proc where
+// available and with pgrep elsewhere.
+func children(pid int) []int {
+	var fields []string
+	files, _ := filepath.Glob("/proc/" + strconv.Itoa(pid) + "/task/*/children")
+	if len(files) > 0 {
+		for _, f := range files {
+			data, _ := os.ReadFile(f)
+			fields = append(fields, strings.Fields(string(data))...)
+		}
+	} else if output, err := exec.Command("pgrep", "-P", strconv.Itoa(pid)).Output(); err == nil {
+		fields = strings.Fields(string(output))
+	}
+	var pids []int
+	for _, f := range fields {
+		if child, err := strconv.Atoi(f); err == nil {
+			pids = append(pids, child)
+		}
+	}
+	return pids
+}
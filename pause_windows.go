@@ -0,0 +1,12 @@
+package main
+
+import "errors"
+
+// suspendChildren is not implemented on Windows, which has no job control
+// signals; pausing only holds back new work there.
+func suspendChildren(stop bool) error {
+	if !stop {
+		return nil
+	}
+	return errors.New("not supported on Windows")
+}
@@ -0,0 +1,902 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// planVersion is the schema version of the JSON plan document. It must be
+// bumped whenever fields change meaning or are removed.
+const planVersion = 1
+
+// Plan describes what a conversion will do to a file. It is built from the
+// probe results and options, and is everything executePlan needs, so a plan
+// written with "plan -json" can be edited and run later with "apply".
+type Plan struct {
+	Version   int          `json:"version"`         // Schema version, see planVersion
+	Input     string       `json:"input"`           // Source file
+	Output    string       `json:"output"`          // File the merge writes
+	Streams   []PlanStream `json:"streams"`         // Every source stream and what happens to it
+	Encodes   []PlanEncode `json:"encodes"`         // New downmixed tracks added to the output
+	VideoArgs []string     `json:"video_args"`      // ffmpeg video codec options for the merge
+	MergeArgs []string     `json:"merge_args"`      // Extra ffmpeg output options for the merge
+	Tempo     float64      `json:"tempo,omitempty"` // Output speed relative to the source, 0 to keep it
+
+	StatisticsTags   bool `json:"statistics_tags,omitempty"`   // Write track statistics tags after merging
+	ReplayGain       bool `json:"replaygain,omitempty"`        // Measure new tracks and write gain tags
+	PreserveUIDs     bool `json:"preserve_uids,omitempty"`     // Keep source track UIDs on copied tracks
+	PreserveEditions bool `json:"preserve_editions,omitempty"` // Copy all chapter editions from the source
+	KeepEncodes      bool `json:"keep_encodes,omitempty"`      // Leave encodes in the cache after merging
+
+	CacheMaxAge  time.Duration `json:"cache_max_age,omitempty"`  // Evict cached encodes unused for this long
+	CacheMaxSize int64         `json:"cache_max_size,omitempty"` // Evict least recently used encodes above this size
+	Jobs         string        `json:"jobs,omitempty"`           // Concurrent encodes: a number, "auto" or empty for all
+	SourceCheck  string        `json:"source_check,omitempty"`   // How thoroughly to verify the source before encoding
+	Verify       string        `json:"verify,omitempty"`         // How thoroughly to verify the output after merging
+	SeekTests    int           `json:"seek_tests,omitempty"`     // Random seeks checked after verifying, 0 for none
+	Cues         string        `json:"cues,omitempty"`           // Seek index handling of Matroska outputs, see validateCues
+	PlayerCmd    string        `json:"player_cmd,omitempty"`     // Player command run at each seek position instead of ffmpeg
+
+	TolerateCorrupt bool    `json:"tolerate_corrupt,omitempty"` // Skip corrupt packets instead of failing
+	Meter           bool    `json:"meter,omitempty"`            // Show live channel levels while encoding
+	QualityCheck    bool    `json:"quality_check,omitempty"`    // Compare encodes with a reference downmix
+	MinPhase        float64 `json:"min_phase,omitempty"`        // Fail encodes whose phase correlation is below this, 0 to only report
+	MusicTags       bool    `json:"music_tags,omitempty"`       // Tag new tracks with their MusicBrainz recording via AcoustID
+
+	TrackAttempts    int             `json:"track_attempts,omitempty"`     // Tries per encode before it counts as failed
+	SkipFailedTracks bool            `json:"skip_failed_tracks,omitempty"` // Leave out failed encodes instead of failing the run
+	Excluded         []PlanExclusion `json:"excluded,omitempty"`           // Encodes left out because they kept failing
+
+	Warnings []Warning   `json:"warnings,omitempty"` // Non-fatal findings about the source and the planned output
+	Media    *MediaTitle `json:"media,omitempty"`    // Movie or episode resolved via TMDb, nil if not looked up
+
+	PostHook        string `json:"post_hook,omitempty"`        // Shell command run with the job summary
+	SummaryTemplate string `json:"summary_template,omitempty"` // text/template file for the summary, empty for the default
+	OnSuccess       string `json:"on_success,omitempty"`       // Shell command run with the summary of a successful job
+	OnFailure       string `json:"on_failure,omitempty"`       // Shell command run with the summary of a failed job
+	WebhookURL      string `json:"webhook_url,omitempty"`      // URL the JSON summary is POSTed to
+
+	Disk *DiskImpact `json:"disk_impact,omitempty"` // Projected disk usage, informational only
+
+	MetadataOnly bool `json:"metadata_only,omitempty"` // Edit the source's track headers in place instead of remuxing
+
+	Replace   bool   `json:"replace,omitempty"`    // Replace the source with the verified output
+	Backup    bool   `json:"backup,omitempty"`     // Keep the replaced source as <input>.bak
+	TrashDir  string `json:"trash_dir,omitempty"`  // Move the replaced source here instead
+	AuditLog  string `json:"audit_log,omitempty"`  // Append-only log of in-place changes, empty to disable
+	AuditHash string `json:"audit_hash,omitempty"` // Checksum of the original in the audit log, see hashAlgorithms
+
+	Publish         string `json:"publish,omitempty"`          // Where the verified output is delivered, see newPublisher; empty to leave it in place
+	PublishAttempts int    `json:"publish_attempts,omitempty"` // Tries per upload before the run fails
+
+	TempDir         string `json:"temp_dir,omitempty"`          // Workspace for the job's scratch files, empty for the system temp directory
+	JobID           string `json:"-"`                           // Names this execution's temporary files, see newJobID
+	IgnoreDiskSpace bool   `json:"ignore_disk_space,omitempty"` // Skip the free space check before executing
+	InfoSidecar     string `json:"info_sidecar,omitempty"`      // Format of the track info written next to the output, empty for none
+
+	StageDir       string `json:"stage_dir,omitempty"`       // Copy the source here before encoding, empty to read it in place
+	StageChunk     string `json:"stage_chunk,omitempty"`     // Read size for staging, e.g. "16M"
+	StageReadahead string `json:"stage_readahead,omitempty"` // Kernel readahead while staging, e.g. "64M"; empty for the default
+	StageVerify    string `json:"stage_verify,omitempty"`    // Checksum comparing the staged copy with the source, empty to skip
+
+	staged       string  // Staged copy of the source while executing
+	duration     float64 // Seconds of media in the source, for progress; 0 if unknown
+	publishName  string  // Name of the output at the publish target
+	seekIndex    string  // Result of the cues check, for the job summary
+	verification string  // passed, failed or off once the output was verified
+	state        *jobState
+}
+
+// PlanStream is a source stream and whether it is copied to the output.
+type PlanStream struct {
+	Index       int    `json:"index"`                 // Stream index in the source
+	Type        string `json:"type"`                  // ffprobe codec type (video, audio, subtitle, ...)
+	Codec       string `json:"codec"`                 // Codec name
+	Language    string `json:"language"`              // Language tag
+	Title       string `json:"title,omitempty"`       // Title tag
+	Action      string `json:"action"`                // "keep" or "drop"
+	Disposition string `json:"disposition,omitempty"` // Comma separated disposition flags that are set
+
+	Metadata map[string]string `json:"metadata,omitempty"` // Tags the merge overwrites
+}
+
+// PlanEncode is a downmixed track the conversion creates.
+type PlanEncode struct {
+	SourceIndex int      `json:"source_index"`          // Stream index of the source track
+	Layout      string   `json:"layout"`                // Source channel layout
+	Filter      string   `json:"filter"`                // ffmpeg audio filter
+	EncoderArgs []string `json:"encoder_args"`          // ffmpeg encoder options
+	Language    string   `json:"language"`              // Language written to the new track
+	Title       string   `json:"title"`                 // Title written to the new track
+	TempFile    string   `json:"temp_file"`             // Temporary encode target
+	Fingerprint string   `json:"fingerprint"`           // Content fingerprint of the source stream
+	Decoder     string   `json:"decoder,omitempty"`     // External decoder command writing the track to stdout
+	Loudnorm    string   `json:"loudnorm,omitempty"`    // Two-pass EBU R128 normalisation target, e.g. "I=-16:TP=-1.5:LRA=11"
+	Disposition string   `json:"disposition,omitempty"` // Comma separated disposition flags of the new track
+	Content     string   `json:"content,omitempty"`     // speech or music, as detected for -bitrate auto
+
+	Metadata map[string]string `json:"metadata,omitempty"` // Extra tags written by the merge
+}
+
+// buildPlan works out which streams the merge keeps or drops and which
+// tracks it adds. If programStreams is set, streams outside the selected
+// program are dropped.
+func buildPlan(inputFile, outputFile string, tracks []TrackInfo, programStreams map[int]bool, opts Options) (*Plan, error) {
+	streams, err := probeStreams(inputFile, "")
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Version:   planVersion,
+		Input:     inputFile,
+		Output:    outputFile,
+		VideoArgs: videoEncodeArgs(opts),
+
+		StatisticsTags:   opts.StatisticsTags,
+		ReplayGain:       opts.ReplayGain,
+		PreserveUIDs:     opts.PreserveUIDs,
+		PreserveEditions: opts.PreserveEditions,
+		KeepEncodes:      opts.CacheDir != "",
+
+		CacheMaxAge:  time.Duration(opts.CacheMaxAgeDays) * 24 * time.Hour,
+		CacheMaxSize: int64(opts.CacheMaxSizeGB * 1e9),
+		Jobs:         opts.Jobs,
+		SourceCheck:  opts.SourceCheck,
+		Verify:       opts.Verify,
+		SeekTests:    opts.SeekTests,
+		Cues:         opts.Cues,
+		PlayerCmd:    opts.PlayerCmd,
+
+		TolerateCorrupt: opts.TolerateCorrupt,
+		Meter:           opts.Meter,
+		QualityCheck:    opts.QualityCheck,
+		MinPhase:        opts.MinPhase,
+		MusicTags:       opts.MusicTags,
+
+		TrackAttempts:    opts.TrackAttempts,
+		SkipFailedTracks: opts.SkipFailedTracks,
+
+		MetadataOnly:    opts.MetadataOnly,
+		TempDir:         opts.TempDir,
+		Replace:         opts.Replace,
+		Backup:          opts.Backup,
+		TrashDir:        opts.TrashDir,
+		Publish:         opts.Publish,
+		PublishAttempts: opts.PublishAttempts,
+		AuditLog:        opts.AuditLog,
+		AuditHash:       opts.AuditHash,
+		StageDir:        opts.StageDir,
+		IgnoreDiskSpace: opts.IgnoreDiskSpace,
+		InfoSidecar:     opts.InfoSidecar,
+		StageChunk:      opts.StageChunk,
+		StageVerify:     opts.StageVerify,
+		StageReadahead:  opts.StageReadahead,
+	}
+	setPlanHooks(plan, opts)
+
+	// Mark the output so batch scans don't pick it up as a source
+	plan.MergeArgs = append(plan.MergeArgs, "-metadata", provenanceTag+"="+filepath.Base(inputFile))
+
+	// Repair sources with negative or badly interleaved timestamps
+	if opts.FixTimestamps {
+		plan.MergeArgs = append(plan.MergeArgs, "-avoid_negative_ts", "make_zero", "-max_interleave_delta", "0")
+	}
+
+	// Cluster length and interleaving decide how well the output streams
+	muxer, err := muxerArgs(opts, plan.Output)
+	if err != nil {
+		return nil, err
+	}
+	plan.MergeArgs = append(plan.MergeArgs, muxer...)
+
+	if err := validateAccessibilityPolicies(opts); err != nil {
+		return nil, err
+	}
+	if err := validatePreset(opts.Preset); err != nil {
+		return nil, err
+	}
+	if err := validateLayout(opts); err != nil {
+		return nil, err
+	}
+	if err := validateMatrix("matrix51", opts.Matrix51); err != nil {
+		return nil, err
+	}
+	if err := validateMatrix("matrix71", opts.Matrix71); err != nil {
+		return nil, err
+	}
+	if err := validateGain(opts.Gain); err != nil {
+		return nil, err
+	}
+	if err := validatePlanSettings(plan); err != nil {
+		return nil, err
+	}
+	if err := validateOutputContainer(opts.OutputContainer); err != nil {
+		return nil, err
+	}
+	tempo, err := parseTempo(opts.Tempo)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTempoFilter(opts.TempoFilter); err != nil {
+		return nil, err
+	}
+	plan.Tempo = tempo
+	if err := validateDefaultAudio(opts.DefaultAudio); err != nil {
+		return nil, err
+	}
+
+	byIndex := make(map[int]ffprobeStream)
+	for _, s := range streams {
+		byIndex[s.Index] = s
+		ps := PlanStream{
+			Index:       s.Index,
+			Type:        s.CodecType,
+			Codec:       s.CodecName,
+			Language:    s.Language(),
+			Title:       s.Tags["title"],
+			Action:      "drop",
+			Disposition: dispositionString(s.Disposition),
+		}
+		// Attachments and data streams are dropped unless the plan is edited
+		switch s.CodecType {
+		case "video", "audio", "subtitle":
+			ps.Action = "keep"
+		}
+		if (s.CodecType == "audio" && isAudioDescription(s) && opts.ADPolicy == policyDrop) ||
+			(s.CodecType == "subtitle" && isSDH(s) && opts.SDHPolicy == policyDrop) {
+			ps.Action = "drop"
+		}
+		if programStreams != nil && !programStreams[s.Index] {
+			ps.Action = "drop"
+		}
+		if s.CodecType == "attachment" && ps.Title == "" {
+			ps.Title = s.Tags["filename"]
+		}
+		plan.Streams = append(plan.Streams, ps)
+	}
+
+	if err := validateCodec(opts); err != nil {
+		return nil, err
+	}
+	if (opts.Backup || opts.TrashDir != "") && !opts.Replace {
+		return nil, fmt.Errorf("-backup and -trash-dir only apply with -replace")
+	}
+	if opts.Replace && opts.MetadataOnly {
+		return nil, fmt.Errorf("-replace can't be combined with -metadata-only, which already edits the file in place")
+	}
+	if opts.Publish != "" {
+		if opts.Replace || opts.MetadataOnly {
+			return nil, fmt.Errorf("-publish can't be combined with -replace or -metadata-only")
+		}
+		if _, err := newPublisher(opts.Publish); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateInfoSidecar(opts.InfoSidecar); err != nil {
+		return nil, err
+	}
+	if opts.InfoSidecar != "" && (opts.Publish != "" || opts.MetadataOnly) {
+		return nil, fmt.Errorf("-info-sidecar can't be combined with -publish or -metadata-only")
+	}
+	if opts.OutputDir != "" {
+		if opts.Replace || opts.MetadataOnly {
+			return nil, fmt.Errorf("-output-dir can't be combined with -replace or -metadata-only, which write to the input's place")
+		}
+		if info, err := os.Stat(opts.OutputDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("output directory %s doesn't exist or isn't a directory", opts.OutputDir)
+		}
+	}
+	if opts.Replace && opts.Verify == verifyOff {
+		return nil, fmt.Errorf("-replace needs a verified output and can't be combined with -verify off")
+	}
+	if (opts.SeekTests > 0 || opts.PlayerCmd != "") && opts.Verify == verifyOff {
+		return nil, fmt.Errorf("-seek-test is part of the verification and can't be combined with -verify off")
+	}
+	if opts.MusicTags && os.Getenv("ACOUSTID_API_KEY") == "" {
+		return nil, fmt.Errorf("-music-tags needs an AcoustID API key in $ACOUSTID_API_KEY")
+	}
+	loudnorm, err := loudnormTarget(opts)
+	if err != nil {
+		return nil, err
+	}
+	duration := 0.0
+	if opts.Bitrate == bitrateAuto {
+		duration, _ = probeDuration(inputFile) // Unknown, the sample starts at 0
+	}
+	for _, track := range tracks {
+		// Metadata-only runs never add tracks
+		if opts.MetadataOnly {
+			break
+		}
+		index := 0
+		fmt.Sscan(track.Index, &index)
+
+		// Audio description tracks follow their own policy
+		filter := downmixFilter(track, opts)
+		if isAudioDescription(byIndex[index]) {
+			switch opts.ADPolicy {
+			case policyKeep, policyDrop:
+				continue
+			case policySpeech:
+				filter = speechFilter(track, opts)
+			}
+		}
+
+		// Layouts without a known channel map get ffmpeg's own downmix
+		// rather than a pan that silently drops channels
+		if note := describeSource(track); note != "" {
+			fmt.Println(note)
+		}
+		if _, known := layoutChannels[track.Layout]; !known && opts.CustomFilter == "" {
+			fmt.Printf("Warning: track %d (%s) has an unrecognised channel layout %q with %d channels; using ffmpeg's standard downmix\n",
+				index, track.Codec, track.Layout, track.Channels)
+			filter = nativeDownmix(filter, opts)
+		}
+		if err := validateFilterChannels(filter, track.Layout); err != nil {
+			return nil, fmt.Errorf("track %d: %v", index, err)
+		}
+		filter += tempoFilter(tempo, opts.TempoFilter)
+
+		// -bitrate auto spends the bits where the content needs them
+		encodeOpts, content := opts, ""
+		if opts.Bitrate == bitrateAuto {
+			if content, err = analyzeContent(inputFile, track, duration); err != nil {
+				return nil, fmt.Errorf("track %d: %v", index, err)
+			}
+			encodeOpts.Bitrate = autoBitrate(opts.AudioCodec, track, content)
+			fmt.Printf("Track %d: %s content from %s %s, bitrate %s\n", index, content, track.Codec, track.Layout, encodeOpts.Bitrate)
+		}
+
+		enc := PlanEncode{
+			SourceIndex: index,
+			Layout:      track.Layout,
+			Filter:      filter,
+			EncoderArgs: audioEncodeArgs(encodeOpts),
+			Content:     content,
+			Language:    track.Language,
+			Title:       enhancedTrackTitle,
+			Decoder:     decoderCommand(opts.Decoders, byIndex[index], inputFile),
+			Loudnorm:    loudnorm,
+			Disposition: encodeDisposition(track),
+		}
+		plan.Encodes = append(plan.Encodes, enc)
+	}
+	if err := dropOriginals(plan, opts); err != nil {
+		return nil, err
+	}
+	applyDefaultAudio(plan, opts.DefaultAudio)
+	if err := checkTempoPlan(plan); err != nil {
+		return nil, err
+	}
+
+	rules, err := parseNormalizeRules(opts.Normalize)
+	if err != nil {
+		return nil, err
+	}
+	normalizePlanMetadata(plan, rules)
+	if opts.LocalizeTitles {
+		labels, err := loadLabels()
+		if err != nil {
+			return nil, fmt.Errorf("loading track labels failed: %v", err)
+		}
+		localizeTitles(plan, labels)
+	}
+	if err := validateContainerPlan(plan, opts); err != nil {
+		return nil, err
+	}
+
+	// Name each encode after its content and final settings so it can be
+	// reused even if the source is renamed or moved
+	cacheDir := opts.CacheDir
+	if cacheDir == "" {
+		cacheDir = opts.TempDir
+	}
+	if cacheDir == "" {
+		cacheDir = filepath.Dir(inputFile)
+	}
+	for i := range plan.Encodes {
+		enc := &plan.Encodes[i]
+		fingerprint, err := streamFingerprint(inputFile, enc.SourceIndex)
+		if err != nil {
+			return nil, err
+		}
+		enc.Fingerprint = fingerprint
+		enc.TempFile = cachedTrackPath(cacheDir, encodeCacheKey(fingerprint, *enc), encodeExtension(opts.AudioCodec))
+
+		// Recorded on the track so "upgrade" can find outdated outputs
+		if enc.Metadata == nil {
+			enc.Metadata = make(map[string]string)
+		}
+		enc.Metadata[settingsTag] = settingsHash(*enc)
+	}
+
+	// The disk estimate is informational, so it never fails the plan
+	if opts.MetadataOnly {
+		return plan, nil
+	}
+	if plan.Disk, err = estimateDiskImpact(plan, streams); err != nil {
+		fmt.Println("Warning: could not estimate disk usage:", err)
+	}
+	return plan, nil
+}
+
+// outputStream is a stream of the merged output and where it comes from.
+type outputStream struct {
+	Source      int               // Source stream index (for enhanced tracks, the downmixed one)
+	Encode      int               // Index into Plan.Encodes, or -1 for a copied stream
+	Metadata    map[string]string // Tags the merge writes to the stream
+	Disposition string            // Comma separated disposition flags the merge sets
+}
+
+// outputStreams returns the streams of the merged output in order: video,
+// subtitles, then each audio track followed by its enhanced versions, then
+// anything else that was kept. Enhanced versions of dropped audio tracks
+// take the place of their original.
+func (p *Plan) outputStreams() []outputStream {
+	var out []outputStream
+	mapped := make(map[int]bool)
+	for _, streamType := range []string{"video", "subtitle", "audio", ""} {
+		for _, s := range p.Streams {
+			if mapped[s.Index] || (streamType != "" && s.Type != streamType) {
+				continue
+			}
+			if s.Action == "keep" {
+				mapped[s.Index] = true
+				out = append(out, outputStream{Source: s.Index, Encode: -1, Metadata: s.Metadata, Disposition: s.Disposition})
+			}
+			if s.Type != "audio" {
+				continue
+			}
+			for i, enc := range p.Encodes {
+				if enc.SourceIndex == s.Index {
+					mapped[s.Index] = true
+					out = append(out, outputStream{Source: s.Index, Encode: i, Metadata: enc.Metadata, Disposition: enc.Disposition})
+				}
+			}
+		}
+	}
+
+	for i, enc := range p.Encodes {
+		if !mapped[enc.SourceIndex] {
+			out = append(out, outputStream{Source: enc.SourceIndex, Encode: i, Metadata: enc.Metadata, Disposition: enc.Disposition})
+		}
+	}
+	return out
+}
+
+// keeps reports whether the source stream with the given index is copied
+// to the output.
+func (p *Plan) keeps(index int) bool {
+	for _, s := range p.Streams {
+		if s.Index == index {
+			return s.Action == "keep"
+		}
+	}
+	return false
+}
+
+// stream returns the source stream with the given index.
+func (p *Plan) stream(index int) (PlanStream, bool) {
+	for _, s := range p.Streams {
+		if s.Index == index {
+			return s, true
+		}
+	}
+	return PlanStream{}, false
+}
+
+// dispositionString lists the disposition flags that are set.
+func dispositionString(disposition map[string]int) string {
+	var flags []string
+	for _, name := range []string{"default", "forced", "comment", "hearing_impaired", "visual_impaired", "descriptions", "captions", "dub", "original", "attached_pic"} {
+		if disposition[name] == 1 {
+			flags = append(flags, name)
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// printPlan renders the plan as a diff-style summary.
+func printPlan(plan *Plan) {
+	fmt.Printf("%s -> %s\n", plan.Input, plan.Output)
+	for _, e := range plan.Encodes {
+		fmt.Printf("  + add   audio %q [%s] downmixed from #%d (%s)\n", e.Title, e.Language, e.SourceIndex, e.Layout)
+		fmt.Printf("            filter: %s\n", e.Filter)
+		if e.Disposition != "" {
+			fmt.Printf("            disposition: %s\n", e.Disposition)
+		}
+	}
+	for _, s := range plan.Streams {
+		marker := "="
+		if s.Action == "drop" {
+			marker = "-"
+		}
+		fmt.Printf("  %s %-5s %-10s #%d %s [%s]", marker, s.Action, s.Type, s.Index, s.Codec, s.Language)
+		if s.Title != "" {
+			fmt.Printf(" %q", s.Title)
+		}
+		if s.Disposition != "" {
+			fmt.Printf(" (%s)", s.Disposition)
+		}
+		fmt.Println()
+		for _, key := range []string{"language", "title"} {
+			if value, ok := s.Metadata[key]; ok {
+				fmt.Printf("  ~ meta  #%d %s=%q\n", s.Index, key, value)
+			}
+		}
+	}
+	fmt.Println("  flags:    dispositions are set as listed above; unlisted flags are cleared")
+	for _, e := range plan.Encodes {
+		fmt.Printf("  metadata: new track from #%d: language=%s title=%q\n", e.SourceIndex, e.Language, e.Title)
+	}
+	if plan.Tempo != 0 {
+		fmt.Printf("  tempo:    played at %.4fx, video, subtitle and chapter timestamps scaled to match\n", plan.Tempo)
+	}
+	if plan.Disk != nil {
+		printDiskImpact(plan.Disk)
+	}
+}
+
+// writePlanJSON writes the plan as an indented JSON document.
+func writePlanJSON(w io.Writer, plan *Plan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
+
+// readPlanJSON loads a plan document and checks that it can be executed.
+func readPlanJSON(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("parsing plan %s failed: %v", path, err)
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("plan %s has schema version %d, this build supports version %d", path, plan.Version, planVersion)
+	}
+	if plan.Input == "" || plan.Output == "" {
+		return nil, fmt.Errorf("plan %s is missing the input or output file", path)
+	}
+	if plan.Input == plan.Output && !plan.MetadataOnly {
+		return nil, fmt.Errorf("plan %s would overwrite its input", path)
+	}
+	for _, s := range plan.Streams {
+		if s.Action != "keep" && s.Action != "drop" {
+			return nil, fmt.Errorf("plan %s: stream %d has unknown action %q", path, s.Index, s.Action)
+		}
+	}
+	// Plans written before -audit-hash existed used SHA-256
+	if plan.AuditHash == "" {
+		plan.AuditHash = "sha256"
+	}
+	if err := validatePlanSettings(&plan); err != nil {
+		return nil, fmt.Errorf("plan %s: %v", path, err)
+	}
+	return &plan, nil
+}
+
+// validatePlanSettings checks the settings a plan carries over from the
+// options, for plans built from them as well as edited ones read by apply.
+func validatePlanSettings(plan *Plan) error {
+	if err := validateJobs(plan.Jobs); err != nil {
+		return err
+	}
+	if plan.StageChunk != "" || plan.StageDir != "" {
+		if _, err := parseByteSize(plan.StageChunk); err != nil {
+			return fmt.Errorf("invalid -stage-chunk: %v", err)
+		}
+	}
+	if plan.StageReadahead != "" {
+		if _, err := parseByteSize(plan.StageReadahead); err != nil {
+			return fmt.Errorf("invalid -stage-readahead: %v", err)
+		}
+	}
+	if err := validateHash("audit-hash", plan.AuditHash); err != nil {
+		return err
+	}
+	if plan.StageVerify != "" {
+		if err := validateHash("stage-verify", plan.StageVerify); err != nil {
+			return err
+		}
+	}
+	if err := validateSourceCheck(plan.SourceCheck); err != nil {
+		return err
+	}
+	if err := validateVerify(plan.Verify); err != nil {
+		return err
+	}
+	if err := validateCues(plan.Cues); err != nil {
+		return err
+	}
+	if plan.MinPhase < -1 || plan.MinPhase > 1 {
+		return fmt.Errorf("-min-phase must be between -1 and 1")
+	}
+	return nil
+}
+
+// planHardening returns the hardening options for applying plan: those
+// given on the command line, with the sandbox covering the directories
+// the plan writes to.
+func planHardening(flags *Options, plan *Plan) *Options {
+	opts := *flags
+	opts.TempDir, opts.StageDir, opts.TrashDir, opts.Publish = plan.TempDir, plan.StageDir, plan.TrashDir, plan.Publish
+	opts.OutputDir, opts.AuditLog, opts.CacheDir = filepath.Dir(plan.Output), plan.AuditLog, ""
+	for _, enc := range plan.Encodes {
+		if enc.TempFile != "" {
+			opts.SandboxWrite += "," + filepath.Dir(enc.TempFile)
+		}
+	}
+	return &opts
+}
+
+// executePlan encodes the planned tracks, merges them into the output and
+// validates the result before removing the temporary files. Encodes are
+// bounded by jobs, which batch runs share between files; if it is nil, the
+// plan's own -jobs setting is used.
+func executePlan(ctx context.Context, plan *Plan, jobs *jobLimiter) error {
+	plan.JobID = newJobID()
+	if plan.MetadataOnly {
+		return editMetadataInPlace(plan)
+	}
+
+	// Published outputs are merged into the workspace and moved from there
+	if plan.Publish != "" {
+		plan.publishName = filepath.Base(plan.Output)
+		plan.Output = plan.workPath(plan.publishName)
+	}
+
+	// Running out of space halfway through a merge wastes the encodes
+	if err := checkDiskSpace(plan); err != nil {
+		return err
+	}
+	defer plan.removeJobDir()
+
+	// A run that died after merging continues with the verification
+	plan.state = loadJobState(plan.Input, plan.TempDir)
+	plan.state.jobID = plan.JobID
+	digest := planDigest(plan)
+	if merged, ok := plan.state.mergedOutput(digest); ok {
+		fmt.Println("Resuming with the merged output", merged.Output)
+		plan.Output, plan.Encodes, plan.Excluded = merged.Output, merged.Encodes, merged.Excluded
+	} else if err := mergePlan(ctx, plan, jobs, digest); err != nil {
+		return err
+	}
+	return finishPlan(ctx, plan)
+}
+
+// mergePlan encodes the planned tracks and merges them into the output,
+// recording each step in the plan's resume manifest.
+func mergePlan(ctx context.Context, plan *Plan, jobs *jobLimiter, digest string) error {
+	// Fail early on damaged sources instead of deep into an encode
+	if err := checkSource(plan); err != nil {
+		if !plan.TolerateCorrupt {
+			return err
+		}
+		fmt.Println("Warning: continuing with a damaged source:", err)
+	}
+
+	// Parallel encodes read a local copy instead of seeking on slow storage
+	if err := stageInput(ctx, plan); err != nil {
+		return err
+	}
+	defer removeStagedInput(plan)
+	if d, err := probeDuration(plan.Input); err == nil {
+		plan.duration = plan.retimed(d)
+	}
+
+	done := make(chan struct{})
+	if jobs == nil {
+		jobs = newJobLimiter(plan.Jobs, len(plan.Encodes))
+		if plan.Jobs == jobsAuto {
+			go jobs.adapt(done)
+		}
+	}
+	failures := encodeTracks(ctx, plan, jobs)
+	close(done)
+	if ctx.Err() != nil {
+		return errInterrupted
+	}
+	if err := excludeFailedTracks(plan, failures); err != nil {
+		return err
+	}
+
+	// Gain tags describe the encoded result, so measure the temp files
+	if plan.ReplayGain {
+		for i := range plan.Encodes {
+			enc := &plan.Encodes[i]
+			loudness, err := measureLoudness(enc.TempFile, "a:0")
+			if err != nil {
+				return fmt.Errorf("measuring track %d failed: %v", enc.SourceIndex, err)
+			}
+			for key, value := range gainTags(loudness) {
+				if enc.Metadata == nil {
+					enc.Metadata = make(map[string]string)
+				}
+				enc.Metadata[key] = value
+			}
+		}
+	}
+
+	// Opt-in, as it sends fingerprints of the audio to AcoustID
+	if plan.MusicTags {
+		tagMusicTracks(plan)
+	}
+
+	// Flag downmixes that differ a lot from ffmpeg's plain one for review
+	if plan.QualityCheck {
+		warnings, err := checkDownmixQuality(plan)
+		if err != nil {
+			return err
+		}
+		for _, w := range warnings {
+			fmt.Println(w)
+		}
+	}
+
+	// Out-of-phase downmixes collapse on mono speakers
+	if plan.QualityCheck || plan.MinPhase != 0 {
+		warnings, err := checkPhase(plan)
+		if err != nil {
+			return err
+		}
+		for _, w := range warnings {
+			fmt.Println(w)
+		}
+	}
+
+	// Merge the processed tracks back into a single MKV file
+	if err := mergeTracks(ctx, plan); err != nil {
+		return fmt.Errorf("merging tracks failed: %v", err)
+	}
+
+	// Done before the steps editing the file in place, which a remux would undo
+	if plan.Cues == cuesRepair && plan.checksCues() {
+		if err := repairCues(plan); err != nil {
+			return err
+		}
+	}
+
+	// ffmpeg only keeps a single linear chapter list
+	if plan.PreserveEditions {
+		if err := copyEditions(plan); err != nil {
+			return err
+		}
+	}
+
+	// ffmpeg assigns new random UIDs to every track
+	if plan.PreserveUIDs {
+		added, err := preserveTrackUIDs(plan)
+		if err != nil {
+			return err
+		}
+		var tracks []int
+		for i := range added {
+			tracks = append(tracks, i)
+		}
+		sort.Ints(tracks)
+		for _, i := range tracks {
+			fmt.Printf("Added track %d has UID %d\n", i+1, added[i])
+		}
+	}
+
+	// ffmpeg doesn't write bitrate statistics for the new tracks
+	if plan.StatisticsTags {
+		if err := addStatisticsTags(plan.Output); err != nil {
+			return err
+		}
+	}
+	plan.state.mergeDone(plan, digest)
+	return nil
+}
+
+// finishPlan verifies the merged output, puts it in place and removes the
+// temporary files.
+func finishPlan(ctx context.Context, plan *Plan) error {
+
+	// Nothing is cleaned up or replaced until the output checks out
+	if err := verifyOutput(plan); err != nil {
+		plan.verification = "failed"
+		plan.state.discardMerge()
+		return fmt.Errorf("verifying the output failed: %v", err)
+	}
+	plan.verification = "passed"
+	if plan.Verify == verifyOff {
+		plan.verification = verifyOff
+	}
+
+	// Only a verified output may take the place of the original
+	if ctx.Err() != nil {
+		os.Remove(plan.Output)
+		return errInterrupted
+	}
+	if plan.Replace {
+		if err := replaceOriginal(plan); err != nil {
+			return err
+		}
+	}
+	if plan.InfoSidecar != "" {
+		if err := writeInfoSidecar(plan, newJobSummary(plan, time.Now(), nil)); err != nil {
+			return err
+		}
+	}
+	if plan.Publish != "" {
+		if err := publishOutput(ctx, plan); err != nil {
+			return err
+		}
+	}
+
+	// Encodes in a cache directory are kept for later runs
+	if !plan.KeepEncodes {
+		removeTemporaryFiles(plan.Encodes)
+	} else if len(plan.Encodes) > 0 && (plan.CacheMaxAge > 0 || plan.CacheMaxSize > 0) {
+		if err := evictCache(filepath.Dir(plan.Encodes[0].TempFile), plan.CacheMaxAge, plan.CacheMaxSize); err != nil {
+			fmt.Println("Error evicting cached tracks:", err)
+		}
+	}
+	plan.state.remove()
+	return nil
+}
+
+// runApply implements the "apply [options] <plan.json>" command, which
+// executes a previously written (and possibly edited) plan. Only the options
+// setting up the process, like -ffmpeg-path, -run-as or -sandbox, are used;
+// the plan has everything else.
+func runApply(args []string) {
+	flags := parseFlags(args)
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: go run script.go apply [options] <plan.json>")
+		os.Exit(1)
+	}
+
+	plan, err := readPlanJSON(flag.Arg(0))
+	if err != nil {
+		fmt.Println("Error loading plan:", err)
+		os.Exit(1)
+	}
+
+	// The same startup as a conversion, but the plan decides where files
+	// are written
+	if err := harden(planHardening(flags, plan), plan.Input); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	setToolPaths(*flags)
+	if flags.HashWorkers > 0 {
+		hashWorkers = flags.HashWorkers
+	}
+	if err := checkTools(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if err := checkPlanEncoders(plan); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	started := time.Now()
+	ctx, stop := interruptContext()
+	defer stop()
+	err = executePlan(ctx, plan, nil)
+	finishJob(plan, started, err)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if plan.MetadataOnly {
+		fmt.Println("Metadata updated:", plan.Output)
+		return
+	}
+	fmt.Println("Enhanced MKV generated:", plan.Output)
+}
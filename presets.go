@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// downmixPreset is a named downmix selectable with -preset.
+type downmixPreset struct {
+	Description string
+	NoLFE       bool                                       // Cuts the bass, so it can't produce -layout 2.1
+	Filter      func(track TrackInfo, opts Options) string // ffmpeg audio filter for a track
+}
+
+// downmixPresets are the built-in filter presets. Adding a preset only needs
+// a new entry here.
+var downmixPresets = map[string]downmixPreset{
+	"default":        {"balanced mix of all channels", false, defaultFilter},
+	"speech":         {"dialogue-focused and compressed, for hard-of-hearing viewers", true, speechFilter},
+	"nightmode":      {"compressed dynamics for low volume listening", false, nightmodeFilter},
+	"dialogue-boost": {"louder centre channel over music and effects", false, dialogueBoostFilter},
+	"lfe-heavy":      {"the full LFE channel in the mix, for speakers with real bass", false, lfeHeavyFilter},
+}
+
+// presetHelp describes the presets for the -preset help text.
+func presetHelp() string {
+	var names []string
+	for name := range downmixPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s (%s)", name, downmixPresets[name].Description)
+	}
+	return strings.Join(names, ", ")
+}
+
+// surroundChannels returns the pan expression terms for the surround
+// channels of a layout on one side, weighted by gain. Unknown layouts get
+// the back channels; their pan is replaced by nativeDownmix anyway.
+func surroundChannels(layout, side string, gain string) string {
+	channels, known := layoutChannels[layout]
+	if !known {
+		return fmt.Sprintf("+%s*B%s", gain, side)
+	}
+	terms := ""
+	for _, ch := range []string{"B" + side, "S" + side, "BC"} {
+		if hasChannel(channels, ch) {
+			terms += fmt.Sprintf("+%s*%s", gain, ch)
+		}
+	}
+	return terms
+}
+
+// weightedPan builds a pan filter for the output layout from channel gains.
+// For stereo the LFE is folded into both sides with lfe; for 2.1 it keeps
+// its own channel, at twice that gain to match the fold-down level.
+func weightedPan(track TrackInfo, opts Options, front, centre, surround, lfe string) string {
+	side := func(ch string) string {
+		return fmt.Sprintf("F%s=%s*F%s+%s*FC", ch, front, ch, centre) + surroundChannels(track.Layout, ch, surround)
+	}
+	if opts.OutputLayout == layout21 {
+		return fmt.Sprintf("pan=2.1|%s|%s|LFE=2*%s*LFE", side("L"), side("R"), lfe)
+	}
+	return fmt.Sprintf("pan=stereo|%s+%s*LFE|%s+%s*LFE", side("L"), lfe, side("R"), lfe)
+}
+
+// levelled puts the -gain volume in front of a chain, unless the loudnorm
+// pass sets the levels.
+func levelled(opts Options, chain ...string) string {
+	if opts.LoudnormTarget == 0 {
+		chain = append([]string{"volume=" + opts.Gain}, chain...)
+	}
+	return strings.Join(chain, ", ")
+}
+
+// defaultFilter mixes with the -matrix51/-matrix71 pan matrices.
+func defaultFilter(track TrackInfo, opts Options) string {
+	return levelled(opts, panFilter(track, opts))
+}
+
+// speechFilter builds the hard-of-hearing chain: the centre (dialogue)
+// channel dominates the mix, rumble is cut, dynamics are compressed and,
+// if a model is given, background noise is reduced with arnndn.
+func speechFilter(track TrackInfo, opts Options) string {
+	pan := "pan=stereo|FL=FC+0.5*FL" + surroundChannels(track.Layout, "L", "0.3") +
+		"|FR=FC+0.5*FR" + surroundChannels(track.Layout, "R", "0.3")
+	chain := []string{pan, "highpass=f=120"}
+	if opts.RNNModel != "" {
+		chain = append(chain, "arnndn=m="+opts.RNNModel)
+	}
+	chain = append(chain, "acompressor=threshold=-24dB:ratio=3:attack=10:release=200")
+	if opts.LoudnormTarget == 0 {
+		chain = append(chain, "volume="+opts.Gain)
+	}
+	return strings.Join(chain, ", ")
+}
+
+// nightmodeFilter compresses loud effects and lifts quiet dialogue, so the
+// mix can be played at a low volume without riding the remote.
+func nightmodeFilter(track TrackInfo, opts Options) string {
+	return levelled(opts, panFilter(track, opts),
+		"acompressor=threshold=-30dB:ratio=4:attack=5:release=300:makeup=2",
+		"dynaudnorm=f=250:g=15:m=5")
+}
+
+// dialogueBoostFilter raises the centre channel above the fronts and
+// surrounds, keeping the rest of the mix intact.
+func dialogueBoostFilter(track TrackInfo, opts Options) string {
+	return levelled(opts, weightedPan(track, opts, "0.7", "1.0", "0.5", "0.3"))
+}
+
+// lfeHeavyFilter mixes the LFE at full level, limiting the peaks this adds.
+func lfeHeavyFilter(track TrackInfo, opts Options) string {
+	return levelled(opts, weightedPan(track, opts, "1.0", "0.707", "0.707", "1.0"), "alimiter=limit=0.95")
+}
+
+// validatePreset checks the -preset value.
+func validatePreset(name string) error {
+	if _, ok := downmixPresets[name]; ok {
+		return nil
+	}
+	var names []string
+	for name := range downmixPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// downmixFilter builds the ffmpeg audio filter for a track from -custom-filter
+// or the selected preset and the track's channel layout.
+func downmixFilter(track TrackInfo, opts Options) string {
+	if opts.CustomFilter != "" {
+		return opts.CustomFilter
+	}
+	return downmixPresets[opts.Preset].Filter(track, opts)
+}
+
+// layoutChannels are the channels of the surround layouts ffmpeg reports.
+var layoutChannels = map[string][]string{
+	"3.0":            {"FL", "FR", "FC"},
+	"3.1":            {"FL", "FR", "FC", "LFE"},
+	"4.0":            {"FL", "FR", "FC", "BC"},
+	"4.1":            {"FL", "FR", "FC", "LFE", "BC"},
+	"quad":           {"FL", "FR", "BL", "BR"},
+	"quad(side)":     {"FL", "FR", "SL", "SR"},
+	"5.0":            {"FL", "FR", "FC", "BL", "BR"},
+	"5.0(side)":      {"FL", "FR", "FC", "SL", "SR"},
+	"5.1":            {"FL", "FR", "FC", "LFE", "BL", "BR"},
+	"5.1(side)":      {"FL", "FR", "FC", "LFE", "SL", "SR"},
+	"6.0":            {"FL", "FR", "FC", "BC", "SL", "SR"},
+	"6.1":            {"FL", "FR", "FC", "LFE", "BC", "SL", "SR"},
+	"6.1(back)":      {"FL", "FR", "FC", "LFE", "BC", "BL", "BR"},
+	"7.0":            {"FL", "FR", "FC", "BL", "BR", "SL", "SR"},
+	"7.1":            {"FL", "FR", "FC", "LFE", "BL", "BR", "SL", "SR"},
+	"7.1(wide)":      {"FL", "FR", "FC", "LFE", "BL", "BR", "FLC", "FRC"},
+	"7.1(wide-side)": {"FL", "FR", "FC", "LFE", "FLC", "FRC", "SL", "SR"},
+	"hexagonal":      {"FL", "FR", "FC", "BL", "BR", "BC"},
+	"octagonal":      {"FL", "FR", "FC", "BL", "BR", "BC", "SL", "SR"},
+}
+
+// panChannelRe matches the input channels of a pan expression: names such
+// as FL or LFE, or numbered channels such as c3.
+var panChannelRe = regexp.MustCompile(`\b(?:[A-Z]{2,4}|c[0-9]+)\b`)
+
+// validateFilterChannels checks that the first pan of a filter chain, the
+// one reading the source, only uses channels the source layout has. ffmpeg
+// silently leaves out missing channels, which would lose e.g. the surrounds.
+// Layouts not in layoutChannels aren't checked.
+func validateFilterChannels(filter, layout string) error {
+	channels, known := layoutChannels[layout]
+	if !known {
+		return nil
+	}
+	for _, f := range strings.Split(filter, ",") {
+		args, isPan := strings.CutPrefix(strings.TrimSpace(f), "pan=")
+		if !isPan {
+			continue
+		}
+		outputs := strings.Split(args, "|")
+		for _, out := range outputs[1:] {
+			expr := out
+			if i := strings.IndexAny(out, "=<"); i >= 0 {
+				expr = out[i+1:]
+			}
+			for _, ch := range panChannelRe.FindAllString(expr, -1) {
+				if !hasChannel(channels, ch) {
+					return fmt.Errorf("filter uses channel %s, which a %s source doesn't have (channels: %s)", ch, layout, strings.Join(channels, " "))
+				}
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// hasChannel reports whether a layout's channels include ch, by name or as
+// a numbered channel.
+func hasChannel(channels []string, ch string) bool {
+	var n int
+	if _, err := fmt.Sscanf(ch, "c%d", &n); err == nil {
+		return n < len(channels)
+	}
+	for _, c := range channels {
+		if c == ch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"unicode"
+)
+
+// Limits on what a sane file can contain. Anything beyond them is a damaged
+// or hostile file, which is rejected instead of being processed.
+const (
+	maxProbeStreams  = 1024 // Far more than any real release has
+	maxProbeChannels = 64
+	maxTagLength     = 4096
+)
+
+// probeError reports a file whose ffprobe description can't be trusted.
+type probeError struct {
+	File   string
+	Stream int // -1 for the file as a whole
+	Reason string
+}
+
+func (e probeError) Error() string {
+	if e.Stream < 0 {
+		return fmt.Sprintf("%s: invalid ffprobe output: %s", e.File, e.Reason)
+	}
+	return fmt.Sprintf("%s: stream %d: invalid ffprobe output: %s", e.File, e.Stream, e.Reason)
+}
+
+// ffprobeStream is the subset of ffprobe's JSON stream description we use.
+type ffprobeStream struct {
+	Index         int               `json:"index"`
+	CodecType     string            `json:"codec_type"`
+	CodecName     string            `json:"codec_name"`
+	CodecTag      string            `json:"codec_tag_string"`
+	Profile       string            `json:"profile"`
+	ColorTrc      string            `json:"color_transfer"`
+	BitRate       string            `json:"bit_rate"`
+	Channels      int               `json:"channels"`
+	ChannelLayout string            `json:"channel_layout"`
+	Disposition   map[string]int    `json:"disposition"`
+	Tags          map[string]string `json:"tags"`
+	SideData      []ffprobeSideData `json:"side_data_list"`
+}
+
+// ffprobeSideData is a stream-level side data entry (stereo 3D, HDR, DOVI).
+type ffprobeSideData struct {
+	Type string `json:"side_data_type"`
+}
+
+// Language returns the stream's language tag, or "und" if it has none.
+func (s ffprobeStream) Language() string {
+	if lang := s.Tags["language"]; lang != "" {
+		return lang
+	}
+	return "und"
+}
+
+// probeStreams returns the streams of a file matching an ffprobe stream
+// specifier (e.g. "a", "s", "v"), or all streams if the specifier is empty.
+func probeStreams(file, specifier string) ([]ffprobeStream, error) {
+	args := []string{"-loglevel", "error", "-show_streams", "-of", "json"}
+	if specifier != "" {
+		args = append(args, "-select_streams", specifier)
+	}
+	args = append(args, file)
+
+	output, err := exec.Command(ffprobePath, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed with error: %s", err)
+	}
+
+	var result struct {
+		Streams []ffprobeStream `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, probeError{file, -1, err.Error()}
+	}
+	if err := validateStreams(file, result.Streams); err != nil {
+		return nil, err
+	}
+	return result.Streams, nil
+}
+
+// validateStreams rejects stream lists no real file produces and strips
+// control characters from tags, which end up in the terminal, the plan and
+// ffmpeg arguments.
+func validateStreams(file string, streams []ffprobeStream) error {
+	if len(streams) > maxProbeStreams {
+		return probeError{file, -1, fmt.Sprintf("%d streams, at most %d are supported", len(streams), maxProbeStreams)}
+	}
+	seen := make(map[int]bool)
+	for i := range streams {
+		s := &streams[i]
+		if s.Index < 0 || s.Index >= maxProbeStreams {
+			return probeError{file, -1, fmt.Sprintf("stream index %d out of range", s.Index)}
+		}
+		if seen[s.Index] {
+			return probeError{file, s.Index, "duplicate stream index"}
+		}
+		seen[s.Index] = true
+		if s.Channels < 0 || s.Channels > maxProbeChannels {
+			return probeError{file, s.Index, fmt.Sprintf("%d channels", s.Channels)}
+		}
+		for key, value := range s.Tags {
+			if len(key) > maxTagLength || len(value) > maxTagLength {
+				return probeError{file, s.Index, fmt.Sprintf("tag %.32q is longer than %d bytes", key, maxTagLength)}
+			}
+			if clean := stripControl(value); clean != value {
+				s.Tags[key] = clean
+			}
+		}
+		s.ChannelLayout = stripControl(s.ChannelLayout)
+	}
+	return nil
+}
+
+// stripControl removes control characters such as newlines and terminal
+// escape sequences' ESC from a metadata string.
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// probeFirstFrameSideData returns the side data types attached to the first
+// frame of a stream, where per-frame HDR metadata and Dolby Vision RPUs live.
+func probeFirstFrameSideData(file, specifier string) ([]string, error) {
+	output, err := exec.Command(ffprobePath, "-loglevel", "error",
+		"-select_streams", specifier, "-read_intervals", "%+#1",
+		"-show_entries", "frame=side_data_list", "-of", "json", file).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed with error: %s", err)
+	}
+
+	var result struct {
+		Frames []struct {
+			SideData []ffprobeSideData `json:"side_data_list"`
+		} `json:"frames"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, probeError{file, -1, err.Error()}
+	}
+
+	var types []string
+	for _, frame := range result.Frames {
+		for _, sd := range frame.SideData {
+			types = append(types, sd.Type)
+		}
+	}
+	return types, nil
+}
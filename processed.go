@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// processedError is returned for a file that was already converted. It is
+// not a failure: scheduled runs over a library skip such files.
+type processedError struct {
+	reason string
+}
+
+func (e processedError) Error() string {
+	return "already processed: " + e.reason
+}
+
+// checkProcessed returns a processedError if the output of inputFile already
+// exists or the input itself has an enhanced track, recognised by its title
+// or the marker tag.
+func checkProcessed(inputFile, outputFile, markerTag string) error {
+	if _, err := os.Stat(outputFile); err == nil {
+		return processedError{"output " + outputFile + " exists"}
+	}
+	streams, err := probeStreams(inputFile, "a")
+	if err != nil {
+		return err
+	}
+	for _, s := range streams {
+		if isEnhancedTitle(s.Tags["title"]) {
+			return processedError{fmt.Sprintf("track %d is titled %q", s.Index, s.Tags["title"])}
+		}
+		if _, ok := s.Tags[markerTag]; ok && markerTag != "" {
+			return processedError{fmt.Sprintf("track %d has the %s tag", s.Index, markerTag)}
+		}
+	}
+	return nil
+}
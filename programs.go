@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ffprobeProgram is a program (service) of a transport stream.
+type ffprobeProgram struct {
+	ProgramID  int               `json:"program_id"`
+	ProgramNum int               `json:"program_num"`
+	Tags       map[string]string `json:"tags"`
+	Streams    []struct {
+		Index     int    `json:"index"`
+		CodecType string `json:"codec_type"`
+	} `json:"streams"`
+}
+
+// probePrograms lists the programs of a file. Most containers have none.
+func probePrograms(file string) ([]ffprobeProgram, error) {
+	output, err := exec.Command(ffprobePath, "-loglevel", "error", "-show_programs",
+		"-show_entries", "program=program_id,program_num:program_tags=service_name:program_stream=index,codec_type",
+		"-of", "json", file).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed with error: %s", err)
+	}
+
+	var result struct {
+		Programs []ffprobeProgram `json:"programs"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, probeError{file, -1, err.Error()}
+	}
+	if len(result.Programs) > maxProbeStreams {
+		return nil, probeError{file, -1, fmt.Sprintf("%d programs", len(result.Programs))}
+	}
+	return result.Programs, nil
+}
+
+// programStreamIndices returns the stream indices belonging to the selected
+// program, matched by program number or ID. It returns nil if the file has
+// at most one program and none was selected, and an error listing the
+// available programs if the selection is missing or ambiguous.
+func programStreamIndices(file, selected string) (map[int]bool, error) {
+	programs, err := probePrograms(file)
+	if err != nil {
+		return nil, err
+	}
+	if selected == "" && len(programs) <= 1 {
+		return nil, nil
+	}
+
+	var available []string
+	for _, p := range programs {
+		name := p.Tags["service_name"]
+		available = append(available, fmt.Sprintf("%d (%s, %d streams)", p.ProgramNum, name, len(p.Streams)))
+		if selected == strconv.Itoa(p.ProgramNum) || selected == strconv.Itoa(p.ProgramID) {
+			indices := make(map[int]bool)
+			for _, s := range p.Streams {
+				indices[s.Index] = true
+			}
+			return indices, nil
+		}
+	}
+
+	if selected == "" {
+		return nil, fmt.Errorf("%s contains %d programs, select one with -program: %s", file, len(programs), strings.Join(available, "; "))
+	}
+	return nil, fmt.Errorf("program %s not found in %s, available: %s", selected, file, strings.Join(available, "; "))
+}
+
+// filterTracksByProgram keeps only the tracks belonging to the program.
+func filterTracksByProgram(tracks []TrackInfo, indices map[int]bool) []TrackInfo {
+	if indices == nil {
+		return tracks
+	}
+	var kept []TrackInfo
+	for _, track := range tracks {
+		index, err := strconv.Atoi(track.Index)
+		if err == nil && indices[index] {
+			kept = append(kept, track)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the progress line is redrawn on a terminal, and how often it is
+// printed as a new line when the output is a log file or pipe.
+const (
+	progressRedrawInterval = 500 * time.Millisecond
+	progressLogInterval    = 10 * time.Second
+)
+
+// progressPlainInterval is how often -plain prints a status line; screen
+// readers read every line out, so it is much less often than in logs.
+const progressPlainInterval = 30 * time.Second
+
+// progressBarWidth is the number of cells in a track's progress bar.
+const progressBarWidth = 20
+
+// Progress displays, selectable with -progress.
+const (
+	progressTracks  = "tracks"  // A bar per running encode
+	progressCompact = "compact" // One short aggregate line, for tmux and CI logs
+)
+
+// console owns the output while a run shows progress. Everything printed to
+// os.Stdout passes through it, so the progress line stays below the other
+// messages, -quiet and -log-level can drop the less important ones and
+// -log-file gets a copy of them.
+type console struct {
+	mu     sync.Mutex
+	out    *os.File // The real stdout
+	pipe   *os.File // Installed as os.Stdout
+	done   chan struct{}
+	tty    bool       // Redraw the progress line in place
+	plain  bool       // Screen reader mode: no redraws, spelled-out status lines
+	level  slog.Level // Least important level shown
+	status string     // Progress line currently shown at the bottom
+
+	log     *slog.Logger // -log-file, if any
+	logFile *os.File
+}
+
+// activeConsole is the console installed by startConsole, if any.
+var activeConsole *console
+
+// startConsole routes os.Stdout through a new console. It returns nil if the
+// pipe can't be created, in which case output goes straight to stdout.
+func startConsole(flags *Options) (*console, error) {
+	level, err := parseLogLevel(flags.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	switch flags.Progress {
+	case "", progressTracks:
+	case progressCompact:
+		progress.compact = true
+	default:
+		return nil, fmt.Errorf("unknown -progress %q (use %s or %s)", flags.Progress, progressTracks, progressCompact)
+	}
+	var logger *slog.Logger
+	var logFile *os.File
+	if flags.LogFile != "" {
+		if logger, logFile, err = openLogFile(flags.LogFile, flags.LogFormat, level); err != nil {
+			return nil, fmt.Errorf("opening log file failed: %v", err)
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		if logFile != nil {
+			logFile.Close()
+		}
+		return nil, nil
+	}
+	plain := flags.Plain || os.Getenv("TERM") == "dumb"
+	c := &console{out: os.Stdout, pipe: w, done: make(chan struct{}), tty: isTerminal(os.Stdout) && !plain,
+		plain: plain, level: level, log: logger, logFile: logFile}
+	if flags.Quiet {
+		c.level = max(c.level, slog.LevelError)
+	}
+	os.Stdout = w
+	activeConsole = c
+	go func() {
+		defer close(c.done)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for scanner.Scan() {
+			c.println(scanner.Text())
+		}
+		// Never leave writers blocked on a full pipe
+		io.Copy(io.Discard, r)
+	}()
+	return c, nil
+}
+
+// stop flushes the remaining output, clears the progress line and restores
+// os.Stdout.
+func (c *console) stop() {
+	if c == nil {
+		return
+	}
+	os.Stdout = c.out
+	c.pipe.Close()
+	<-c.done
+	c.mu.Lock()
+	c.clearStatus()
+	if c.logFile != nil {
+		c.logFile.Close()
+		c.log = nil
+	}
+	c.mu.Unlock()
+	activeConsole = nil
+}
+
+// println writes a printed message line at the level its prefix implies.
+func (c *console) println(line string) {
+	c.write(lineLevel(line), line)
+}
+
+// write shows a message line above the progress line, unless its level is
+// below the console's, and copies it to the log file.
+func (c *console) write(level slog.Level, line string, attrs ...slog.Attr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logToFile(level, line, attrs)
+	if level < c.level {
+		return
+	}
+	if c.tty && c.status != "" {
+		fmt.Fprint(c.out, "\r\033[K", line, "\n", c.status)
+		return
+	}
+	fmt.Fprintln(c.out, line)
+}
+
+// setStatus shows line as the progress line: redrawn in place on a terminal,
+// printed as a message otherwise.
+func (c *console) setStatus(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.level > slog.LevelInfo {
+		return
+	}
+	if !c.tty {
+		if line != "" {
+			fmt.Fprintln(c.out, line)
+		}
+		return
+	}
+	c.status = line
+	fmt.Fprint(c.out, "\r\033[K", line)
+}
+
+// clearStatus removes the progress line from a terminal. c.mu must be held.
+func (c *console) clearStatus() {
+	if c.tty && c.status != "" {
+		fmt.Fprint(c.out, "\r\033[K")
+	}
+	c.status = ""
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// trackProgress is the progress of one running encode.
+type trackProgress struct {
+	input    string
+	label    string
+	position float64 // Seconds encoded
+	duration float64 // Seconds of input, 0 if unknown
+	speed    float64
+}
+
+// progressTracker combines the progress of all running encodes, and of the
+// files in a batch, into a single line. Changes only record the latest
+// values; the line is drawn by its own goroutine, so a slow terminal or log
+// pipe never holds up the goroutines reading ffmpeg's output.
+type progressTracker struct {
+	mu           sync.Mutex
+	tracks       []*trackProgress
+	filesDone    int
+	filesTotal   int
+	batchStarted time.Time
+	compact      bool // Draw the -progress compact line
+	rendered     time.Time
+	changed      bool // Something changed since the line was last drawn
+	forced       bool // A change that is drawn right away, even in logs
+	renderer     sync.Once
+}
+
+// progress is the tracker shared by all encodes of a run.
+var progress = &progressTracker{}
+
+// start registers a running encode of the given track of input.
+func (p *progressTracker) start(input string, index int, duration float64) *trackProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	label := fmt.Sprintf("Track %d", index)
+	if p.filesTotal > 0 {
+		label = fmt.Sprintf("%s #%d", filepath.Base(input), index)
+	}
+	t := &trackProgress{input: input, label: label, duration: duration}
+	p.tracks = append(p.tracks, t)
+	p.touch(false)
+	return t
+}
+
+// update records the position and speed of an encode from ffmpeg's
+// progress output. Updates between two redraws are coalesced.
+func (p *progressTracker) update(t *trackProgress, position, speed float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t.position, t.speed = position, speed
+	p.touch(false)
+}
+
+// finish removes an encode from the progress line.
+func (p *progressTracker) finish(t *trackProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, other := range p.tracks {
+		if other == t {
+			p.tracks = append(p.tracks[:i], p.tracks[i+1:]...)
+			break
+		}
+	}
+	p.touch(true)
+}
+
+// setBatch starts counting the files of a batch run.
+func (p *progressTracker) setBatch(total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filesDone, p.filesTotal = 0, total
+	p.batchStarted = time.Now()
+}
+
+// fileDone counts a finished file of a batch run.
+func (p *progressTracker) fileDone() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filesDone++
+	p.touch(true)
+}
+
+// touch marks the line for redrawing and starts the goroutine drawing it.
+// p.mu must be held.
+func (p *progressTracker) touch(force bool) {
+	p.changed = true
+	p.forced = p.forced || force
+	p.renderer.Do(func() { go p.renderLoop() })
+}
+
+// renderLoop draws the line whenever it changed and is due, for the rest of
+// the run.
+func (p *progressTracker) renderLoop() {
+	ticker := time.NewTicker(progressRedrawInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if line, ok := p.due(); ok {
+			showProgress(line)
+		}
+	}
+}
+
+// due returns the current progress line if it changed and is due: right
+// away after a forced change, otherwise every progressRedrawInterval on a
+// terminal, every progressLogInterval in logs and every
+// progressPlainInterval with -plain.
+func (p *progressTracker) due() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tty := activeConsole != nil && activeConsole.tty
+	plain := activeConsole != nil && activeConsole.plain
+	interval := progressLogInterval
+	switch {
+	case tty:
+		interval = progressRedrawInterval
+	case plain:
+		interval = progressPlainInterval
+	}
+	if !p.changed || (!p.forced && time.Since(p.rendered) < interval) {
+		return "", false
+	}
+	p.rendered = time.Now()
+	p.changed, p.forced = false, false
+
+	var parts []string
+	if plain {
+		if p.filesTotal > 0 {
+			parts = append(parts, fmt.Sprintf("Progress: %d of %d files done.", p.filesDone, p.filesTotal))
+		}
+		for _, t := range p.tracks {
+			parts = append(parts, t.plainString())
+		}
+		line := strings.Join(parts, " ")
+		return line, line != ""
+	}
+	if p.compact {
+		line := p.compactLine()
+		return line, line != "" || tty
+	}
+	if p.filesTotal > 0 {
+		parts = append(parts, fmt.Sprintf("Files %d/%d", p.filesDone, p.filesTotal))
+	}
+	for _, t := range p.tracks {
+		parts = append(parts, t.String())
+	}
+	line := strings.Join(parts, " | ")
+	return line, line != "" || tty
+}
+
+// compactLine sums up the run for -progress compact, e.g. "3/10 files |
+// Movie.mkv 45% | +1 more | ETA 1h02m": the files done, the progress of the
+// file running longest and the time left. In batches the ETA extrapolates
+// the whole batch from the time taken so far. p.mu must be held.
+func (p *progressTracker) compactLine() string {
+	var inputs []string
+	byInput := make(map[string][]*trackProgress)
+	for _, t := range p.tracks {
+		if _, ok := byInput[t.input]; !ok {
+			inputs = append(inputs, t.input)
+		}
+		byInput[t.input] = append(byInput[t.input], t)
+	}
+
+	var parts []string
+	if p.filesTotal > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d files", p.filesDone, p.filesTotal))
+	}
+	running, eta := 0.0, 0.0
+	for i, input := range inputs {
+		fraction, left := fileProgress(byInput[input])
+		running += fraction
+		eta = max(eta, left)
+		if i == 0 {
+			parts = append(parts, fmt.Sprintf("%s %.0f%%", filepath.Base(input), fraction*100))
+		}
+	}
+	if len(inputs) > 1 {
+		parts = append(parts, fmt.Sprintf("+%d more", len(inputs)-1))
+	}
+	if p.filesTotal > 0 {
+		if done := (float64(p.filesDone) + running) / float64(p.filesTotal); done > 0 {
+			elapsed := time.Since(p.batchStarted).Seconds()
+			eta = elapsed/done - elapsed
+		}
+	}
+	if eta > 0 {
+		parts = append(parts, "ETA "+humanDuration(eta))
+	}
+	return strings.Join(parts, " | ")
+}
+
+// fileProgress returns how far the running encodes of a file are, as the
+// mean of their fractions, and the seconds until the slowest one finishes.
+func fileProgress(tracks []*trackProgress) (fraction, left float64) {
+	known := 0
+	for _, t := range tracks {
+		if t.duration <= 0 {
+			continue
+		}
+		known++
+		fraction += min(t.position/t.duration, 1)
+		if t.speed > 0 {
+			left = max(left, (t.duration-t.position)/t.speed)
+		}
+	}
+	if known > 0 {
+		fraction /= float64(known)
+	}
+	return fraction, left
+}
+
+// showProgress shows a progress line on the console, or prints it if
+// there is none.
+func showProgress(line string) {
+	if activeConsole != nil {
+		activeConsole.setStatus(line)
+	} else if line != "" {
+		fmt.Println(line)
+	}
+}
+
+// String formats the encode as e.g. "Track 1 [#####-----] 50% 2.1x ETA 4m10s".
+func (t *trackProgress) String() string {
+	if t.duration <= 0 {
+		return fmt.Sprintf("%s %s %.1fx", t.label, humanDuration(t.position), t.speed)
+	}
+	fraction := min(t.position/t.duration, 1)
+	filled := int(fraction * progressBarWidth)
+	s := fmt.Sprintf("%s [%s%s] %3.0f%% %.1fx", t.label,
+		strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled), fraction*100, t.speed)
+	if t.speed > 0 {
+		s += " ETA " + humanDuration((t.duration-t.position)/t.speed)
+	}
+	return s
+}
+
+// plainString describes the encode in words for screen readers, e.g.
+// "Track 1: 50 percent done, 2.1 times real time, about 4 minutes left."
+func (t *trackProgress) plainString() string {
+	if t.duration <= 0 {
+		return fmt.Sprintf("%s: %s encoded, %.1f times real time.", t.label, spokenDuration(t.position), t.speed)
+	}
+	fraction := min(t.position/t.duration, 1)
+	s := fmt.Sprintf("%s: %.0f percent done, %.1f times real time", t.label, fraction*100, t.speed)
+	if t.speed > 0 {
+		s += ", about " + spokenDuration((t.duration-t.position)/t.speed) + " left"
+	}
+	return s + "."
+}
+
+// spokenDuration formats seconds in words, e.g. "1 hour 2 minutes", to the
+// minute above a minute.
+func spokenDuration(seconds float64) string {
+	unit := func(n int, name string) string {
+		if n == 1 {
+			return "1 " + name
+		}
+		return fmt.Sprintf("%d %ss", n, name)
+	}
+	total := int(seconds + 0.5)
+	if total < 60 {
+		return unit(total, "second")
+	}
+	hours, minutes := total/3600, (total%3600)/60
+	if hours == 0 {
+		return unit(minutes, "minute")
+	}
+	if minutes == 0 {
+		return unit(hours, "hour")
+	}
+	return unit(hours, "hour") + " " + unit(minutes, "minute")
+}
+
+// readFFmpegProgress reads ffmpeg's -progress output and calls report with
+// the encoded position in seconds and the speed after every update block.
+func readFFmpegProgress(r io.Reader, report func(position, speed float64)) {
+	var position, speed float64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				position = float64(us) / 1e6
+			}
+		case "speed":
+			value = strings.TrimSuffix(strings.TrimSpace(value), "x")
+			if s, err := strconv.ParseFloat(value, 64); err == nil {
+				speed = s
+			}
+		case "progress":
+			report(position, speed)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultPublishAttempts is how often a failed upload is tried by default.
+const defaultPublishAttempts = 3
+
+// publishRetryDelay is the wait before the second attempt; it doubles with
+// every further attempt.
+const publishRetryDelay = 5 * time.Second
+
+// Publisher delivers a verified output to where results should land. The
+// conversion itself always writes locally, so where results go is decided
+// independently of how they are made.
+type Publisher interface {
+	// Publish copies file to the target under name and returns its location.
+	// Publishing the same name again replaces the earlier copy.
+	Publish(ctx context.Context, file, name string) (string, error)
+}
+
+// newPublisher returns the publisher for a -publish target: s3://bucket/prefix
+// (AWS CLI), sftp://[user@]host[:port]/dir (OpenSSH sftp), rclone:remote:path
+// (rclone) or a local directory.
+func newPublisher(target string) (Publisher, error) {
+	switch {
+	case strings.HasPrefix(target, "s3://"):
+		if strings.TrimPrefix(target, "s3://") == "" {
+			return nil, fmt.Errorf("publish target %q has no bucket", target)
+		}
+		return s3Publisher{strings.TrimSuffix(target, "/")}, nil
+	case strings.HasPrefix(target, "sftp://"):
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid publish target %q (use sftp://[user@]host[:port]/dir)", target)
+		}
+		return sftpPublisher{u}, nil
+	case strings.HasPrefix(target, rclonePrefix):
+		remote := strings.TrimPrefix(target, rclonePrefix)
+		if !strings.Contains(remote, ":") {
+			return nil, fmt.Errorf("invalid publish target %q (use rclone:remote:path)", target)
+		}
+		return rclonePublisher{strings.TrimSuffix(remote, "/")}, nil
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, fmt.Errorf("publish directory: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("publish target %s is not a directory", target)
+	}
+	return localPublisher{target}, nil
+}
+
+// localPublisher moves outputs into a directory, e.g. a library on another
+// disk.
+type localPublisher struct {
+	dir string
+}
+
+func (p localPublisher) Publish(ctx context.Context, file, name string) (string, error) {
+	dst := filepath.Join(p.dir, name)
+	partial := dst + ".part"
+	os.Remove(partial) // Left over from an earlier failed attempt
+	if err := linkOrCopy(file, partial); err != nil {
+		return "", err
+	}
+	if err := os.Rename(partial, dst); err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	syncDir(p.dir)
+	return dst, nil
+}
+
+// s3Publisher uploads outputs to an S3 bucket with the AWS CLI, which takes
+// care of credentials and multipart uploads.
+type s3Publisher struct {
+	prefix string // s3://bucket[/prefix]
+}
+
+func (p s3Publisher) Publish(ctx context.Context, file, name string) (string, error) {
+	dst := p.prefix + "/" + name
+	return dst, runTransferCommand(ctx, nil, "aws", "s3", "cp", "--only-show-errors", file, dst)
+}
+
+// sftpPublisher uploads outputs over SFTP, with the user's SSH keys and
+// configuration. The upload is renamed into place once complete.
+type sftpPublisher struct {
+	target *url.URL
+}
+
+func (p sftpPublisher) Publish(ctx context.Context, file, name string) (string, error) {
+	dst := path.Join(p.target.Path, name)
+	if p.target.Path == "" {
+		dst = name // Relative to the remote home directory
+	}
+	host := p.target.Hostname()
+	if p.target.User != nil {
+		host = p.target.User.Username() + "@" + host
+	}
+	args := []string{"-b", "-"}
+	if port := p.target.Port(); port != "" {
+		args = append(args, "-P", port)
+	}
+	args = append(args, host)
+
+	// A leading "-" lets the removal of a missing file fail harmlessly
+	batch := fmt.Sprintf("put %q %q\n-rm %q\nrename %q %q\n", file, dst+".part", dst, dst+".part", dst)
+	return "sftp://" + p.target.Host + dst, runTransferCommand(ctx, strings.NewReader(batch), "sftp", args...)
+}
+
+// rclonePublisher copies outputs to any remote rclone is configured for.
+type rclonePublisher struct {
+	remote string // remote:path
+}
+
+func (p rclonePublisher) Publish(ctx context.Context, file, name string) (string, error) {
+	dst := p.remote + "/" + name
+	if strings.HasSuffix(p.remote, ":") {
+		dst = p.remote + name
+	}
+	return dst, runTransferCommand(ctx, nil, "rclone", "copyto", file, dst)
+}
+
+// runTransferCommand runs an upload or download tool and includes its error output in
+// the error.
+func runTransferCommand(ctx context.Context, stdin *strings.Reader, name string, args ...string) error {
+	cmd := interruptibleCommand(ctx, name, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v\nOutput: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// publishOutput hands the verified output to the plan's publisher, retrying
+// failed attempts with a growing delay, and removes the local copy once it
+// has been published.
+func publishOutput(ctx context.Context, plan *Plan) error {
+	publisher, err := newPublisher(plan.Publish)
+	if err != nil {
+		return err
+	}
+	name := plan.publishName
+	attempts := max(1, plan.PublishAttempts)
+	delay := publishRetryDelay
+	for attempt := 1; ; attempt++ {
+		location, err := publisher.Publish(ctx, plan.Output, name)
+		if err == nil {
+			fmt.Println("Published to", location)
+			os.Remove(plan.Output)
+			plan.Output = location
+			return nil
+		}
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		fmt.Printf("Publishing failed (attempt %d of %d): %v\n", attempt, attempts, err)
+		if attempt >= attempts {
+			return fmt.Errorf("publishing %s failed, it was kept at %s: %v", name, plan.Output, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return errInterrupted
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// referenceDownmixFilter is ffmpeg's own stereo downmix, as with -ac 2.
+const referenceDownmixFilter = "aformat=channel_layouts=stereo"
+
+// Tolerances before an encode is flagged for manual review. The enhanced
+// downmix is intentionally louder and more centred than the reference, so
+// only large differences point at a problem.
+const (
+	qcLoudnessTolerance = 8.0 // LU difference in integrated loudness
+	qcBandTolerance     = 6.0 // dB difference in a band's share of the loudness
+	qcPhaseWarning      = 0.2 // Mean phase correlation below which a downmix is flagged
+)
+
+// outOfPhaseLevel is the phase correlation below which a moment of the
+// downmix counts as out of phase.
+const outOfPhaseLevel = -0.3
+
+// qcBands split the spectrum for the similarity check.
+var qcBands = []struct {
+	name   string
+	filter string
+}{
+	{"low", "lowpass=f=200"},
+	{"mid", "highpass=f=200,lowpass=f=4000"},
+	{"high", "highpass=f=4000"},
+}
+
+// qcProfile is the loudness of a stereo stream overall and per band.
+type qcProfile struct {
+	Integrated float64
+	Bands      []float64 // Band loudness relative to the overall loudness
+}
+
+// measureQCProfile measures the loudness profile of an audio stream after
+// passing it through prefilter.
+func measureQCProfile(file, streamSpec, prefilter string) (qcProfile, error) {
+	join := func(filter string) string {
+		if prefilter == "" {
+			return filter
+		}
+		if filter == "" {
+			return prefilter
+		}
+		return prefilter + "," + filter
+	}
+
+	total, err := measureFilteredLoudness(file, streamSpec, join(""))
+	if err != nil {
+		return qcProfile{}, err
+	}
+	profile := qcProfile{Integrated: total.Integrated}
+	for _, band := range qcBands {
+		l, err := measureFilteredLoudness(file, streamSpec, join(band.filter))
+		if err != nil {
+			return qcProfile{}, err
+		}
+		profile.Bands = append(profile.Bands, l.Integrated-total.Integrated)
+	}
+	return profile, nil
+}
+
+// checkDownmixQuality compares every encode with a reference downmix of its
+// source and returns warnings for the ones that differ suspiciously.
+func checkDownmixQuality(plan *Plan) ([]Warning, error) {
+	var warnings []Warning
+	for _, enc := range plan.Encodes {
+		fmt.Printf("Comparing track %d with a reference downmix...\n", enc.SourceIndex)
+		reference, err := measureQCProfile(plan.source(), fmt.Sprint(enc.SourceIndex), referenceDownmixFilter)
+		if err != nil {
+			return nil, fmt.Errorf("measuring reference downmix of track %d failed: %v", enc.SourceIndex, err)
+		}
+		enhanced, err := measureQCProfile(enc.TempFile, "a:0", "")
+		if err != nil {
+			return nil, fmt.Errorf("measuring track %d failed: %v", enc.SourceIndex, err)
+		}
+
+		if math.IsInf(reference.Integrated, 0) || math.IsInf(enhanced.Integrated, 0) {
+			if math.IsInf(reference.Integrated, 0) != math.IsInf(enhanced.Integrated, 0) {
+				warnings = append(warnings, Warning{"qc-silent", fmt.Sprintf(
+					"track %d: only one of the enhanced and reference downmix is silent", enc.SourceIndex)})
+			}
+			continue
+		}
+		if diff := enhanced.Integrated - reference.Integrated; math.Abs(diff) > qcLoudnessTolerance {
+			warnings = append(warnings, Warning{"qc-loudness", fmt.Sprintf(
+				"track %d: enhanced downmix is %+.1f LU off the reference downmix (%.1f vs %.1f LUFS)",
+				enc.SourceIndex, diff, enhanced.Integrated, reference.Integrated)})
+		}
+		for i, band := range qcBands {
+			ref, got := reference.Bands[i], enhanced.Bands[i]
+			if math.IsInf(ref, 0) || math.IsInf(got, 0) {
+				continue
+			}
+			if diff := got - ref; math.Abs(diff) > qcBandTolerance {
+				warnings = append(warnings, Warning{"qc-spectrum", fmt.Sprintf(
+					"track %d: %s frequencies are %+.1f dB off the reference downmix balance",
+					enc.SourceIndex, band.name, diff)})
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// phaseProfile is the inter-channel phase correlation of a stereo stream:
+// 1 is mono, 0 unrelated channels, -1 channels cancelling each other out.
+type phaseProfile struct {
+	Mean       float64 // Average correlation
+	OutOfPhase float64 // Share of the stream below outOfPhaseLevel, 0-1
+}
+
+// measurePhase measures the phase correlation of the front pair of an audio
+// stream with aphasemeter.
+func measurePhase(file, streamSpec string) (phaseProfile, error) {
+	cmd := exec.Command(ffmpegPath, "-hide_banner", "-nostats", "-loglevel", "error",
+		"-i", file, "-map", "0:"+streamSpec,
+		"-af", "pan=stereo|FL=FL|FR=FR,aphasemeter=video=0,ametadata=print:key=lavfi.aphasemeter.phase:file=-",
+		"-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return phaseProfile{}, fmt.Errorf("phase measurement failed: %v\n%s", err, stderr.String())
+	}
+
+	var sum float64
+	var frames, outOfPhase int
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "lavfi.aphasemeter.phase=")
+		if !ok {
+			continue
+		}
+		phase, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(phase) {
+			continue // Silence has no phase
+		}
+		sum += phase
+		frames++
+		if phase < outOfPhaseLevel {
+			outOfPhase++
+		}
+	}
+	if frames == 0 {
+		return phaseProfile{Mean: 1}, nil
+	}
+	return phaseProfile{sum / float64(frames), float64(outOfPhase) / float64(frames)}, nil
+}
+
+// checkPhase measures the phase correlation of every encode, which decides
+// how much of the downmix survives on mono soundbars and TV speakers. It
+// returns warnings for poorly correlated downmixes and fails for ones below
+// the plan's -min-phase.
+func checkPhase(plan *Plan) ([]Warning, error) {
+	var warnings []Warning
+	for _, enc := range plan.Encodes {
+		phase, err := measurePhase(enc.TempFile, "a:0")
+		if err != nil {
+			return nil, fmt.Errorf("measuring the phase of track %d failed: %v", enc.SourceIndex, err)
+		}
+		fmt.Printf("Track %d: phase correlation %.2f, %.1f%% out of phase\n", enc.SourceIndex, phase.Mean, phase.OutOfPhase*100)
+		if plan.MinPhase != 0 && phase.Mean < plan.MinPhase {
+			return nil, fmt.Errorf("track %d: phase correlation %.2f is below -min-phase %.2f; the downmix would lose content on mono speakers",
+				enc.SourceIndex, phase.Mean, plan.MinPhase)
+		}
+		if phase.Mean < qcPhaseWarning {
+			warnings = append(warnings, Warning{"qc-phase", fmt.Sprintf(
+				"track %d: downmix is poorly correlated (%.2f, %.1f%% out of phase) and may collapse on mono speakers",
+				enc.SourceIndex, phase.Mean, phase.OutOfPhase*100)})
+		}
+	}
+	return warnings, nil
+}
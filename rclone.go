@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// rclonePrefix marks inputs and publish targets handled by rclone, as in
+// rclone:remote:path/movie.mkv.
+const rclonePrefix = "rclone:"
+
+// rcloneSource returns the rclone path of an rclone:remote:path input.
+func rcloneSource(input string) (string, bool) {
+	remote, ok := strings.CutPrefix(input, rclonePrefix)
+	if !ok || !strings.Contains(remote, ":") || strings.HasSuffix(remote, ":") {
+		return "", false
+	}
+	return remote, true
+}
+
+// fetchRemoteSource downloads a file from an rclone remote, together with its
+// sidecar if it has one, into a new directory below tempDir (or the system
+// temp directory). The file keeps its name, so the output is named after it.
+func fetchRemoteSource(ctx context.Context, remote, tempDir string) (string, error) {
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	dir, err := os.MkdirTemp(tempDir, fmt.Sprintf("mkv21_rclone_%d_", os.Getpid()))
+	if err != nil {
+		return "", err
+	}
+	local := filepath.Join(dir, path.Base(remote))
+
+	fmt.Printf("Downloading %s%s...\n", rclonePrefix, remote)
+	if err := runTransferCommand(ctx, nil, "rclone", "copyto", remote, local); err != nil {
+		os.RemoveAll(dir)
+		if ctx.Err() != nil {
+			return "", errInterrupted
+		}
+		return "", fmt.Errorf("downloading %s failed: %v", remote, err)
+	}
+	// Most files have no sidecar, so a failed download is expected
+	runTransferCommand(ctx, nil, "rclone", "copyto", remote+sidecarSuffix, local+sidecarSuffix)
+	return local, nil
+}
+
+// remoteOutputTarget returns the -publish target putting the output next to
+// its rclone source.
+func remoteOutputTarget(remote string) string {
+	dir := path.Dir(remote)
+	if !strings.Contains(dir, ":") {
+		// "remote:movie.mkv" is in the remote's root
+		dir = remote[:strings.Index(remote, ":")+1]
+	}
+	return rclonePrefix + dir
+}
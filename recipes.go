@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// recipe is a common workflow: a command line with what it is for. The
+// registry feeds "examples", the -help output and, as JSON, front ends
+// building a job form.
+type recipe struct {
+	Name    string   `json:"name"`
+	Summary string   `json:"summary"`
+	Args    []string `json:"args"`            // Options and arguments after the program
+	Notes   string   `json:"notes,omitempty"` // When to prefer or avoid it
+	Help    bool     `json:"-"`               // Also shown in -help
+}
+
+// recipes are the registered workflows, most common first. Adding one only
+// needs a new entry here.
+var recipes = []recipe{
+	{
+		Name:    "headphones",
+		Summary: "Stereo for headphones and laptops, loudness normalised",
+		Args:    []string{"-device", "headphones", "movie.mkv"},
+		Notes:   "Opus at -16 LUFS; see -device list for the other playback devices.",
+		Help:    true,
+	},
+	{
+		Name:    "night",
+		Summary: "Quiet late-night listening with compressed dynamics",
+		Args:    []string{"-preset", "nightmode", "-loudnorm", "-24", "movie.mkv"},
+		Notes:   "Use -preset dialogue-boost instead to keep the dynamics but lift voices.",
+		Help:    true,
+	},
+	{
+		Name:    "speech",
+		Summary: "Clear dialogue for hard-of-hearing viewers",
+		Args:    []string{"-preset", "speech", "-lang", "en", "movie.mkv"},
+	},
+	{
+		Name:    "soundbar",
+		Summary: "2.1 with its own LFE channel for a soundbar with subwoofer",
+		Args:    []string{"-device", "soundbar 2.1", "movie.mkv"},
+	},
+	{
+		Name:    "replace-audio",
+		Summary: "Replace the surround tracks with their downmix, in place",
+		Args:    []string{"-keep-original=false", "-replace", "-backup", "movie.mkv"},
+		Notes:   "The output is verified before the source is replaced; -backup keeps the original as .bak.",
+		Help:    true,
+	},
+	{
+		Name:    "library",
+		Summary: "Convert a whole library, skipping files already done",
+		Args:    []string{"-r", "-jobs", "2", "-progress", "compact", "/media/movies"},
+		Notes:   "Preview with the plan command first: go run script.go plan -r /media/movies",
+		Help:    true,
+	},
+	{
+		Name:    "upgrade",
+		Summary: "Re-encode earlier outputs made with older settings",
+		Args:    []string{"upgrade", "-device", "headphones", "/media/movies"},
+	},
+	{
+		Name:    "streaming",
+		Summary: "Output laid out for streaming and fast seeking",
+		Args:    []string{"-target", "streaming", "-output-dir", "/srv/stream", "movie.mkv"},
+	},
+	{
+		Name:    "nas",
+		Summary: "Convert from slow network storage without seek storms",
+		Args:    []string{"-stage-dir", "/var/tmp", "-stage-verify", "crc32c", "-cache-dir", "/var/cache/mkv21", "/mnt/nas/movie.mkv"},
+	},
+	{
+		Name:    "fix-metadata",
+		Summary: "Only fix track languages and titles, without re-encoding",
+		Args:    []string{"-metadata-only", "-normalize", "all", "movie.mkv"},
+	},
+}
+
+// commandLine shows how a recipe is run.
+func (r recipe) commandLine() string {
+	args := make([]string, len(r.Args))
+	for i, arg := range r.Args {
+		if strings.ContainsAny(arg, " \t'\"") {
+			arg = "'" + arg + "'"
+		}
+		args[i] = arg
+	}
+	return "go run script.go " + strings.Join(args, " ")
+}
+
+// findRecipe looks a recipe up by name.
+func findRecipe(name string) (recipe, bool) {
+	for _, r := range recipes {
+		if strings.EqualFold(r.Name, name) {
+			return r, true
+		}
+	}
+	return recipe{}, false
+}
+
+// printRecipes writes the recipes, with their notes unless brief.
+func printRecipes(w io.Writer, list []recipe, brief bool) {
+	for _, r := range list {
+		fmt.Fprintf(w, "  %s: %s\n      %s\n", r.Name, r.Summary, r.commandLine())
+		if !brief && r.Notes != "" {
+			fmt.Fprintf(w, "      %s\n", r.Notes)
+		}
+	}
+}
+
+// printHelpRecipes adds the most common recipes to the -help output.
+func printHelpRecipes(w io.Writer) {
+	var list []recipe
+	for _, r := range recipes {
+		if r.Help {
+			list = append(list, r)
+		}
+	}
+	fmt.Fprintln(w, "\nExamples:")
+	printRecipes(w, list, true)
+	fmt.Fprintln(w, "Run \"go run script.go examples\" for more.")
+	fmt.Fprintln(w, "\nOptions:")
+}
+
+// runExamples implements the "examples [name]" command, which lists the
+// recipes or shows one of them.
+func runExamples(args []string) {
+	cmd := flag.NewFlagSet("examples", flag.ExitOnError)
+	asJSON := cmd.Bool("json", false, "print the recipes as JSON")
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "Usage: go run script.go examples [options] [name]")
+		cmd.PrintDefaults()
+	}
+	cmd.Parse(args)
+
+	list := recipes
+	if cmd.NArg() > 0 {
+		r, ok := findRecipe(cmd.Arg(0))
+		if !ok {
+			fmt.Printf("Error: no example named %q\n", cmd.Arg(0))
+			os.Exit(1)
+		}
+		list = []recipe{r}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(list); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	printRecipes(os.Stdout, list, false)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ReleaseInfo holds the details recognised in a scene/P2P style release name
+// such as "Movie.Title.2019.1080p.BluRay.DTS-HD.MA.5.1.x264-GROUP.mkv".
+type ReleaseInfo struct {
+	Title         string // Human readable title (dots and underscores replaced)
+	Year          string // Release year, if present
+	Season        string // Season number for episodes (e.g., "01")
+	Episode       string // Episode number for episodes (e.g., "05")
+	Resolution    string // Normalised resolution token (e.g., "1080p", "2160p")
+	Source        string // Normalised source token (e.g., "BluRay", "WEB-DL")
+	AudioCodec    string // Normalised audio codec token (e.g., "DTS-HD MA", "TrueHD")
+	AudioChannels string // Channel count token (e.g., "5.1", "7.1")
+	Group         string // Release group, if present
+}
+
+// releaseToken maps a case-insensitive pattern to its normalised name.
+type releaseToken struct {
+	pattern *regexp.Regexp
+	name    string
+}
+
+// releaseRe compiles a case-insensitive token pattern that must stand
+// alone. Unlike \b, "_" separates tokens too, as in "Movie_2019_1080p".
+func releaseRe(pattern string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(?:` + pattern + `)(?:[^a-z0-9]|$)`)
+}
+
+var (
+	releaseYearRe     = releaseRe(`(19\d{2}|20\d{2})`)
+	releaseEpisodeRe  = releaseRe(`S(\d{1,2})E(\d{1,3})`)
+	releaseChannelsRe = regexp.MustCompile(`(?:^|[^0-9])([2-9])[ .]([01])(?:[^0-9]|$)`)
+	releaseGroupRe    = regexp.MustCompile(`-([A-Za-z0-9]+)$`)
+
+	releaseResolutions = []releaseToken{
+		{releaseRe(`2160p|4k|uhd`), "2160p"},
+		{releaseRe(`1080p`), "1080p"},
+		{releaseRe(`1080i`), "1080i"},
+		{releaseRe(`720p`), "720p"},
+		{releaseRe(`576p`), "576p"},
+		{releaseRe(`480p`), "480p"},
+	}
+
+	releaseSources = []releaseToken{
+		{releaseRe(`bd-?remux|remux`), "Remux"},
+		{releaseRe(`blu-?ray|bdrip|brrip`), "BluRay"},
+		{releaseRe(`web-?dl`), "WEB-DL"},
+		{releaseRe(`web-?rip`), "WEBRip"},
+		{releaseRe(`hdtv`), "HDTV"},
+		{releaseRe(`dvd-?rip|dvd`), "DVD"},
+	}
+
+	// Order matters: more specific codecs must be matched first. Atmos is
+	// carried by TrueHD or E-AC3, so only the codec token counts.
+	releaseAudioCodecs = []releaseToken{
+		{releaseRe(`truehd`), "TrueHD"},
+		{releaseRe(`dts[ .-]?hd[ .-]?ma`), "DTS-HD MA"},
+		{releaseRe(`dts[ .-]?x`), "DTS:X"},
+		{releaseRe(`dts[ .-]?hd`), "DTS-HD"},
+		{releaseRe(`dts`), "DTS"},
+		{releaseRe(`e-?ac-?3|ddp(?:[257][ .]?[01])?|dd\+(?:[257][ .]?[01])?`), "E-AC3"},
+		{releaseRe(`ac-?3|dd(?:[257][ .]?[01])?`), "AC3"},
+		{releaseRe(`flac`), "FLAC"},
+		{releaseRe(`lpcm|pcm`), "PCM"},
+		{releaseRe(`aac(?:[257][ .]?[01])?`), "AAC"},
+		{releaseRe(`opus`), "Opus"},
+	}
+)
+
+// parseReleaseName extracts release metadata from a file name or path.
+// Unknown fields are left empty; the parser never fails.
+func parseReleaseName(name string) ReleaseInfo {
+	base := filepath.Base(name)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	var info ReleaseInfo
+	info.Resolution = matchReleaseToken(base, releaseResolutions)
+	info.Source = matchReleaseToken(base, releaseSources)
+	info.AudioCodec = matchReleaseToken(base, releaseAudioCodecs)
+
+	if m := releaseChannelsRe.FindStringSubmatch(base); m != nil {
+		info.AudioChannels = m[1] + "." + m[2]
+	}
+	if loc := releaseGroupRe.FindStringSubmatchIndex(base); loc != nil && !insideReleaseToken(base, loc[0]) {
+		info.Group = base[loc[2]:loc[3]]
+	}
+
+	// The title is everything before the first year, episode or quality token
+	titleEnd := len(base)
+	if loc := releaseEpisodeRe.FindStringSubmatchIndex(base); loc != nil {
+		info.Season = padReleaseNumber(base[loc[2]:loc[3]])
+		info.Episode = padReleaseNumber(base[loc[4]:loc[5]])
+		titleEnd = min(titleEnd, loc[0])
+	}
+	// Skip a leading year so titles like "2012.2009.1080p" keep their name
+	for start := 0; start < len(base); {
+		loc := releaseYearRe.FindStringSubmatchIndex(base[start:])
+		if loc == nil {
+			break
+		}
+		if start+loc[2] == 0 {
+			// Matches consume the separator, so continue right after the year
+			start += loc[3]
+			continue
+		}
+		info.Year = base[start+loc[2] : start+loc[3]]
+		titleEnd = min(titleEnd, start+loc[0])
+		break
+	}
+	for _, tokens := range [][]releaseToken{releaseResolutions, releaseSources, releaseAudioCodecs} {
+		for _, t := range tokens {
+			if loc := t.pattern.FindStringIndex(base); loc != nil && loc[0] > 0 {
+				titleEnd = min(titleEnd, loc[0])
+			}
+		}
+	}
+
+	title := strings.NewReplacer(".", " ", "_", " ").Replace(base[:titleEnd])
+	info.Title = strings.TrimSpace(strings.Trim(strings.TrimSpace(title), "-([ "))
+	return info
+}
+
+// IsLossless reports whether the release advertises a lossless audio codec,
+// which usually warrants transcoding the original tracks as well.
+func (r ReleaseInfo) IsLossless() bool {
+	switch r.AudioCodec {
+	case "TrueHD", "DTS-HD MA", "DTS:X", "DTS-HD", "FLAC", "PCM":
+		return true
+	}
+	return false
+}
+
+// releaseHints are the settings a release name suggests. Lossless sources
+// keep enough detail through the downmix to be worth the higher bitrates
+// -bitrate auto picks for them.
+func releaseHints(r ReleaseInfo) map[string]string {
+	hints := map[string]string{}
+	if r.IsLossless() {
+		hints["bitrate"] = bitrateAuto
+	}
+	return hints
+}
+
+// loadReleaseHints applies the releaseHints of inputFile's name with
+// -release-hints, to settings nothing else has set.
+func loadReleaseHints(inputFile string, explicit map[string]bool) error {
+	if f := flag.Lookup("release-hints"); f == nil || f.Value.String() != "true" {
+		return nil
+	}
+	release := parseReleaseName(inputFile)
+	for key, value := range releaseHints(release) {
+		target := flag.Lookup(key)
+		if explicit[key] || target.Value.String() != target.DefValue {
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return fmt.Errorf("release hint %s: %v", key, err)
+		}
+		fmt.Printf("%s audio in the release name: using -%s %s\n", release.AudioCodec, key, value)
+	}
+	return nil
+}
+
+// TemplateVars returns the parsed fields keyed by their template name, as
+// in .Release of job summaries.
+func (r ReleaseInfo) TemplateVars() map[string]string {
+	return map[string]string{
+		"title":      r.Title,
+		"year":       r.Year,
+		"season":     r.Season,
+		"episode":    r.Episode,
+		"resolution": r.Resolution,
+		"source":     r.Source,
+		"acodec":     r.AudioCodec,
+		"channels":   r.AudioChannels,
+		"group":      r.Group,
+	}
+}
+
+// matchReleaseToken returns the name of the first token found in s.
+func matchReleaseToken(s string, tokens []releaseToken) string {
+	for _, t := range tokens {
+		if t.pattern.MatchString(s) {
+			return t.name
+		}
+	}
+	return ""
+}
+
+// insideReleaseToken reports whether position i of s is part of a source
+// or codec token, like the "-" of "DTS-HD" or "WEB-DL".
+func insideReleaseToken(s string, i int) bool {
+	for _, tokens := range [][]releaseToken{releaseSources, releaseAudioCodecs} {
+		for _, t := range tokens {
+			for _, loc := range t.pattern.FindAllStringIndex(s, -1) {
+				// Leave out the separators around the token
+				token := strings.TrimFunc(s[loc[0]:loc[1]], func(r rune) bool { return !isAlnum(r) })
+				from := loc[0] + strings.Index(s[loc[0]:loc[1]], token)
+				if from < i && i < from+len(token) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isAlnum reports whether r is an ASCII letter or digit.
+func isAlnum(r rune) bool {
+	return r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+// padReleaseNumber zero-pads season/episode numbers to two digits.
+func padReleaseNumber(n string) string {
+	if len(n) < 2 {
+		return "0" + n
+	}
+	return n
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseReleaseName(t *testing.T) {
+	tests := []struct {
+		name string
+		want ReleaseInfo
+	}{
+		{"Movie.Title.2019.1080p.BluRay.DTS-HD.MA.5.1.x264-GROUP.mkv", ReleaseInfo{
+			Title: "Movie Title", Year: "2019", Resolution: "1080p", Source: "BluRay",
+			AudioCodec: "DTS-HD MA", AudioChannels: "5.1", Group: "GROUP"}},
+		{"Show.Name.S01E05.720p.WEB-DL.DDP5.1.Atmos.H.264-GRP.mkv", ReleaseInfo{
+			Title: "Show Name", Season: "01", Episode: "05", Resolution: "720p", Source: "WEB-DL",
+			AudioCodec: "E-AC3", AudioChannels: "5.1", Group: "GRP"}},
+		{"Movie.2021.2160p.WEB-DL.EAC3.Atmos.HEVC.mkv", ReleaseInfo{
+			Title: "Movie", Year: "2021", Resolution: "2160p", Source: "WEB-DL", AudioCodec: "E-AC3"}},
+		{"Movie.2018.2160p.UHD.BluRay.Remux.TrueHD.Atmos.7.1-FGT.mkv", ReleaseInfo{
+			Title: "Movie", Year: "2018", Resolution: "2160p", Source: "Remux",
+			AudioCodec: "TrueHD", AudioChannels: "7.1", Group: "FGT"}},
+		{"Movie_Title_2019_1080p_BluRay_DTS_x264.mkv", ReleaseInfo{
+			Title: "Movie Title", Year: "2019", Resolution: "1080p", Source: "BluRay", AudioCodec: "DTS"}},
+		{"2012.2009.1080p.BluRay.AAC5.1.mkv", ReleaseInfo{
+			Title: "2012", Year: "2009", Resolution: "1080p", Source: "BluRay",
+			AudioCodec: "AAC", AudioChannels: "5.1"}},
+		{"Movie.2019.1080p.BluRay.DTS-HD.mkv", ReleaseInfo{
+			Title: "Movie", Year: "2019", Resolution: "1080p", Source: "BluRay", AudioCodec: "DTS-HD"}},
+		{"Movie.2019.1080p.WEB-DL.mkv", ReleaseInfo{
+			Title: "Movie", Year: "2019", Resolution: "1080p", Source: "WEB-DL"}},
+		{"/media/movies/Some Movie (2004).mkv", ReleaseInfo{Title: "Some Movie", Year: "2004"}},
+	}
+	for _, tt := range tests {
+		if got := parseReleaseName(tt.name); got != tt.want {
+			t.Errorf("parseReleaseName(%q)\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReleaseIsLossless(t *testing.T) {
+	tests := map[string]bool{
+		"Movie.2019.1080p.BluRay.TrueHD.7.1.mkv":    true,
+		"Movie.2019.1080p.BluRay.DTS-HD.MA.5.1.mkv": true,
+		"Movie.2019.1080p.BluRay.FLAC.2.0.mkv":      true,
+		"Movie.2019.1080p.WEB-DL.DDP5.1.Atmos.mkv":  false,
+		"Movie.2019.1080p.WEB-DL.EAC3.Atmos.mkv":    false,
+		"Movie.2019.1080p.BluRay.DTS.5.1.mkv":       false,
+		"Movie.2019.1080p.mkv":                      false,
+	}
+	for name, want := range tests {
+		if got := parseReleaseName(name).IsLossless(); got != want {
+			t.Errorf("%s: IsLossless() = %v, want %v", name, got, want)
+		}
+	}
+}
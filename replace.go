@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// backupSuffix is appended to the original when -replace keeps a backup.
+const backupSuffix = ".bak"
+
+// replaceOriginal swaps the verified output in for the source file. The
+// output is synced and renamed over the source in one step, so the source
+// path always holds a complete file. With Backup the original is kept as
+// <input>.bak; with TrashDir it is moved there instead.
+func replaceOriginal(plan *Plan) error {
+	if err := syncFile(plan.Output); err != nil {
+		return fmt.Errorf("syncing output failed: %v", err)
+	}
+	if err := auditPlan(plan, "replace", auditKept(plan)); err != nil {
+		return err
+	}
+
+	// Keep the original under its new name before it is replaced
+	switch {
+	case plan.TrashDir != "":
+		if err := os.MkdirAll(plan.TrashDir, 0755); err != nil {
+			return err
+		}
+		trashed := filepath.Join(plan.TrashDir, filepath.Base(plan.Input))
+		if err := linkOrCopy(plan.Input, trashed); err != nil {
+			return fmt.Errorf("moving original to trash failed: %v", err)
+		}
+		fmt.Println("Original moved to", trashed)
+	case plan.Backup:
+		if err := linkOrCopy(plan.Input, plan.Input+backupSuffix); err != nil {
+			return fmt.Errorf("backing up original failed: %v", err)
+		}
+		fmt.Println("Original kept as", plan.Input+backupSuffix)
+	}
+
+	if err := os.Rename(plan.Output, plan.Input); err != nil {
+		return fmt.Errorf("replacing original failed: %v", err)
+	}
+	syncDir(filepath.Dir(plan.Input))
+	plan.Output = plan.Input
+	return nil
+}
+
+// linkOrCopy makes dst a copy of src, as a hard link where possible so no
+// data is duplicated. An existing dst is an error, so earlier backups are
+// never overwritten.
+func linkOrCopy(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// syncFile flushes a file's data to disk.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// syncDir flushes a directory so a rename in it survives a crash. Errors are
+// ignored since not every platform can sync directories.
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
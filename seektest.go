@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// seekTestSeconds is how much is decoded after each seek.
+const seekTestSeconds = 2
+
+// maxSeekDrift is how far before the requested position a seek may land.
+// Seeks go back to the previous keyframe, so this is a generous GOP length;
+// landing further off means the seek index is broken.
+const maxSeekDrift = 15.0
+
+// seekTest seeks to random positions of the output and decodes a little
+// after each, which catches broken cue indexes and muxing problems a linear
+// decode doesn't. With a player command, the player does the decoding.
+func seekTest(plan *Plan) error {
+	if plan.SeekTests <= 0 {
+		return nil
+	}
+	duration, err := probeDuration(plan.Output)
+	if err != nil || duration <= seekTestSeconds {
+		return nil // Nothing to seek in
+	}
+	positions := make([]float64, plan.SeekTests)
+	for i := range positions {
+		positions[i] = math.Floor(rand.Float64() * (duration - seekTestSeconds))
+	}
+	sort.Float64s(positions)
+
+	for _, pos := range positions {
+		var err error
+		if plan.PlayerCmd != "" {
+			err = runPlayerAt(plan.PlayerCmd, plan.Output, pos)
+		} else {
+			err = decodeAt(plan, pos)
+		}
+		if err != nil {
+			return fmt.Errorf("seek test at %s failed: %v", humanDuration(pos), err)
+		}
+	}
+	fmt.Printf("Seek test: %d random position(s) play back fine\n", len(positions))
+	return nil
+}
+
+// decodeAt seeks to pos and checks where the seek landed, then decodes the
+// video and the new tracks from there.
+func decodeAt(plan *Plan, pos float64) error {
+	start := strconv.FormatFloat(pos, 'f', 3, 64)
+	output, err := exec.Command(ffprobePath, "-v", "error", "-select_streams", "v:0",
+		"-read_intervals", start+"%+#1", "-show_entries", "frame=best_effort_timestamp_time",
+		"-of", "csv=p=0", plan.Output).Output()
+	if err != nil {
+		return fmt.Errorf("seeking failed: %v", err)
+	}
+	if value := strings.TrimSpace(string(output)); value != "" {
+		landed, err := strconv.ParseFloat(strings.Split(value, "\n")[0], 64)
+		if err == nil && (landed > pos+1 || landed < pos-maxSeekDrift) {
+			return fmt.Errorf("landed at %s; the seek index is broken", humanDuration(landed))
+		}
+	}
+
+	args := []string{"-v", "error", "-ss", start, "-i", plan.Output, "-t", strconv.Itoa(seekTestSeconds), "-map", "0:v:0?"}
+	for i, out := range plan.outputStreams() {
+		if out.Encode >= 0 {
+			args = append(args, "-map", fmt.Sprintf("0:%d", i))
+		}
+	}
+	args = append(args, "-f", "null", "-")
+	return runSourceScan(plan.Output, "decoding after a seek", args)
+}
+
+// runPlayerAt runs the -player-cmd with {file} and {start} filled in, e.g.
+// "mpv --vo=null --ao=null --start={start} --length=2 {file}".
+func runPlayerAt(command, file string, pos float64) error {
+	cmd := exec.Command("sh", "-c", strings.NewReplacer(
+		"{file}", shellQuote(file),
+		"{start}", strconv.FormatFloat(pos, 'f', 3, 64),
+	).Replace(command))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("player failed: %v\nOutput: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sidecarSuffix is appended to an input file name to find its per-title
+// overrides, e.g. "movie.mkv.mkv21.yaml".
+const sidecarSuffix = ".mkv21.yaml"
+
+// parseSimpleYAML parses a flat YAML document of "key: value" lines.
+// Comments, blank lines and quoted values are supported; nesting is not.
+func parseSimpleYAML(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		// Quoted values may contain '#'; unquoted ones end at a comment
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		} else if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// sidecarSettings are the keys a sidecar may set: per-title downmix and
+// track selection settings. Sidecars sit next to the media and may come
+// from anywhere, so nothing that runs commands, touches other files or
+// replaces the source is allowed. Values that end up in the filter graph,
+// like the matrices and the gain, are checked by buildPlan.
+var sidecarSettings = map[string]bool{
+	"matrix51": true, "matrix71": true, "gain": true, "preset": true, "layout": true,
+	"loudnorm": true, "loudnorm-lra": true, "loudnorm-tp": true,
+	"acodec": true, "bitrate": true, "compression-level": true, "dialnorm": true, "device": true,
+	"tracks": true, "lang": true, "skip-commentary": true, "keep-original": true,
+	"drop-tracks": true, "drop-lang": true, "default-audio": true,
+	"ad-policy": true, "sdh-policy": true, "program": true, "tempo": true,
+}
+
+// configFileName is the global configuration file inside the user config
+// directory, e.g. ~/.config/mkv-5.1to2.1/config.yaml.
+const configFileName = "mkv-5.1to2.1/config.yaml"
+
+// flagAliases maps short flag names to the long names they share a value
+// with. Every alias must be listed, or resetSettings clears the shared value.
+var flagAliases = map[string]string{"j": "jobs", "tmpdir": "temp-dir"}
+
+// explicitFlags returns the flags given on the command line. A flag given by
+// its short name counts as given under both names.
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for short, long := range flagAliases {
+		if explicit[short] || explicit[long] {
+			explicit[short], explicit[long] = true, true
+		}
+	}
+	return explicit
+}
+
+// applySettings sets every flag named in values that wasn't given on the
+// command line, so explicit flags always take precedence. A non-nil allowed
+// limits the keys that may be set.
+func applySettings(values map[string]string, source string, explicit, allowed map[string]bool) error {
+	for key, value := range values {
+		if flag.Lookup(key) == nil {
+			return fmt.Errorf("%s: unknown setting %q", source, key)
+		}
+		if hardeningSettings[key] {
+			return fmt.Errorf("%s: %q only works on the command line", source, key)
+		}
+		if allowed != nil && !allowed[key] {
+			return fmt.Errorf("%s: setting %q is not allowed here", source, key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return fmt.Errorf("%s: invalid value for %q: %v", source, key, err)
+		}
+	}
+	return nil
+}
+
+// resetSettings returns every flag not given on the command line to its
+// default, so settings from one file's sidecar don't leak into the next.
+func resetSettings(explicit map[string]bool) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if !explicit[f.Name] && f.Value.String() != f.DefValue {
+			flag.Set(f.Name, f.DefValue)
+		}
+	})
+}
+
+// loadSettings resolves the settings for inputFile: flags take precedence
+// over its sidecar, which takes precedence over the configuration file, the
+// -device profile and last the -release-hints.
+func loadSettings(inputFile string, explicit map[string]bool) error {
+	resetSettings(explicit)
+	if err := loadConfig(explicit); err != nil {
+		return err
+	}
+	if err := loadSidecar(inputFile, explicit); err != nil {
+		return err
+	}
+	if err := loadDevice(explicit); err != nil {
+		return err
+	}
+	return loadReleaseHints(inputFile, explicit)
+}
+
+// configPath returns the configuration file to use: -config if given,
+// otherwise the one in the user config directory.
+func configPath() string {
+	if f := flag.Lookup("config"); f != nil && f.Value.String() != "" {
+		return f.Value.String()
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, configFileName)
+}
+
+// loadConfig applies the global configuration file, if there is one. Keys
+// are the long flag names, like in sidecars.
+func loadConfig(explicit map[string]bool) error {
+	path := configPath()
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil && explicit["config"] {
+		return err
+	}
+	return loadSettingsFile(path, explicit, nil)
+}
+
+// loadSidecar applies the per-title overrides stored next to inputFile, if
+// any. Keys are the long flag names, e.g. "gain: 1.2", limited to
+// sidecarSettings.
+func loadSidecar(inputFile string, explicit map[string]bool) error {
+	path := inputFile + sidecarSuffix
+	if _, err := os.Stat(path); err == nil {
+		fmt.Println("Applying per-title settings from", path)
+	}
+	return loadSettingsFile(path, explicit, sidecarSettings)
+}
+
+// loadSettingsFile applies a settings file; a missing file is not an error.
+func loadSettingsFile(path string, explicit, allowed map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	values, err := parseSimpleYAML(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return applySettings(values, path, explicit, allowed)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// childStopTimeout is how long ffmpeg gets to finish up after an interrupt
+// before it is killed.
+const childStopTimeout = 5 * time.Second
+
+// errInterrupted is returned by work cut short by SIGINT or SIGTERM.
+var errInterrupted = errors.New("interrupted")
+
+// interruptContext returns a context that is cancelled on the first SIGINT
+// or SIGTERM, so the run can stop its child processes and remove partial
+// files. A second signal kills the process right away.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case <-signals:
+			fmt.Println("Interrupted, cleaning up (press Ctrl-C again to force)")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// interruptibleCommand is exec.Command that asks the child to stop with
+// SIGINT when ctx is cancelled, and kills it if it hasn't exited after
+// childStopTimeout.
+func interruptibleCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = childStopTimeout
+	return cmd
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// soakInputName is the synthetic source the soak test converts over and over.
+const soakInputName = "soak_source.mkv"
+
+// soakOptions are the settings of the hidden soak command.
+type soakOptions struct {
+	Duration time.Duration // How long to keep converting
+	Report   time.Duration // How often to print a resource sample
+	Clip     time.Duration // Length of the synthetic source
+}
+
+// soakFlags registers the soak command's flags. They are only added when the
+// command is used, so they don't show up in the normal usage.
+func soakFlags() *soakOptions {
+	s := &soakOptions{}
+	flag.DurationVar(&s.Duration, "soak-duration", time.Hour, "how long to keep converting the synthetic source")
+	flag.DurationVar(&s.Report, "soak-report", time.Minute, "how often to print goroutine, file descriptor, temp file and heap counts")
+	flag.DurationVar(&s.Clip, "soak-clip", 30*time.Second, "length of the synthetic 5.1 source")
+	return s
+}
+
+// soakSample is the resource usage between two conversions, when nothing
+// should be running or open.
+type soakSample struct {
+	Elapsed    time.Duration
+	Runs       int
+	Failures   int
+	Goroutines int
+	FDs        int // -1 where open descriptors can't be counted
+	TempFiles  int
+	HeapMB     float64
+}
+
+// runSoak converts a synthetic 5.1 file in dir through the full pipeline
+// until the soak duration is over or the run is interrupted, printing a
+// resource sample every report interval. It reports whether goroutines,
+// file descriptors and temporary files stayed at the level of the first
+// sample, taken after one warm-up conversion.
+func runSoak(ctx context.Context, dir string, flags *Options, explicit map[string]bool, s *soakOptions) bool {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		fmt.Println("Error:", err)
+		return false
+	}
+	input := filepath.Join(dir, soakInputName)
+	if err := writeSoakSource(input, s.Clip); err != nil {
+		fmt.Println("Error:", err)
+		return false
+	}
+
+	// Every run converts the same file again
+	forced := map[string]bool{"force": true}
+	for name := range explicit {
+		forced[name] = true
+	}
+	flags.Force = true
+
+	started := time.Now()
+	var samples []soakSample
+	runs, failures := 0, 0
+	nextReport := started
+	fmt.Printf("Soak test for %s in %s\n", s.Duration, dir)
+	fmt.Println("elapsed    runs  failed  goroutines  fds  temp files  heap MB")
+	for ctx.Err() == nil && time.Since(started) < s.Duration {
+		plan, opts, err := preparePlan(ctx, input, flags, forced)
+		if err == nil {
+			err = runPlan(ctx, plan, opts, nil)
+		}
+		runs++
+		if err != nil && ctx.Err() == nil {
+			failures++
+			fmt.Printf("Error: run %d: %v\n", runs, err)
+		}
+		if plan != nil {
+			os.Remove(plan.Output)
+		}
+
+		if runs == 1 || time.Now().After(nextReport) {
+			sample := sampleSoak(dir, flags.TempDir, started, runs, failures)
+			samples = append(samples, sample)
+			fmt.Printf("%-9s %5d %7d %11d %4d %11d %8.1f\n", humanDuration(sample.Elapsed.Seconds()),
+				sample.Runs, sample.Failures, sample.Goroutines, sample.FDs, sample.TempFiles, sample.HeapMB)
+			nextReport = time.Now().Add(s.Report)
+		}
+	}
+	os.Remove(input)
+
+	final := sampleSoak(dir, flags.TempDir, started, runs, failures)
+	samples = append(samples, final)
+	return printSoakReport(samples)
+}
+
+// writeSoakSource writes a small MKV with a video track and a 5.1 track with
+// a different tone on every channel, so the downmix has real work to do.
+func writeSoakSource(path string, length time.Duration) error {
+	seconds := fmt.Sprintf("%.3f", length.Seconds())
+	tones := []string{"sin(440*2*PI*t)", "sin(554*2*PI*t)", "sin(659*2*PI*t)", "sin(55*2*PI*t)", "sin(330*2*PI*t)", "sin(392*2*PI*t)"}
+	cmd := exec.Command(ffmpegPath, "-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "testsrc=size=320x180:rate=25:duration="+seconds,
+		"-f", "lavfi", "-i", "aevalsrc="+strings.Join(tones, "|")+":c=5.1:s=48000:d="+seconds,
+		"-map", "0", "-map", "1", "-c:v", "mpeg4", "-c:a", "flac", "-metadata:s:a:0", "language=eng",
+		"-y", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("creating the synthetic source failed: %v\nOutput: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// sampleSoak measures the resources held by the process right now.
+func sampleSoak(dir, tempDir string, started time.Time, runs, failures int) soakSample {
+	// Let finished goroutines exit and closed files be collected
+	runtime.GC()
+	time.Sleep(100 * time.Millisecond)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return soakSample{
+		Elapsed:    time.Since(started),
+		Runs:       runs,
+		Failures:   failures,
+		Goroutines: runtime.NumGoroutine(),
+		FDs:        countOpenFiles(),
+		TempFiles:  countSoakTempFiles(dir, tempDir),
+		HeapMB:     float64(mem.HeapAlloc) / (1 << 20),
+	}
+}
+
+// countOpenFiles returns the number of open file descriptors of the process,
+// or -1 on systems without /proc.
+func countOpenFiles() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// countSoakTempFiles counts the files left in the soak directory besides its
+// source, and this process's work files in the temp directory.
+func countSoakTempFiles(dir, tempDir string) int {
+	count := 0
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() != soakInputName {
+			count++
+		}
+	}
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	matches, _ := filepath.Glob(filepath.Join(tempDir, fmt.Sprintf("mkv21_*_%d_*", os.Getpid())))
+	return count + len(matches)
+}
+
+// printSoakReport compares the last sample with the first and reports
+// whether nothing leaked.
+func printSoakReport(samples []soakSample) bool {
+	first, last := samples[0], samples[len(samples)-1]
+	fmt.Println()
+	fmt.Printf("Soak summary: %d runs in %s, %d failed\n", last.Runs, humanDuration(last.Elapsed.Seconds()), last.Failures)
+	ok := last.Failures == 0
+	check := func(name string, before, after int) {
+		status := "ok"
+		if after > before {
+			status = "LEAK"
+			ok = false
+		}
+		fmt.Printf("  %-11s %d -> %d  %s\n", name, before, after, status)
+	}
+	check("goroutines", first.Goroutines, last.Goroutines)
+	if first.FDs >= 0 {
+		check("fds", first.FDs, last.FDs)
+	}
+	check("temp files", first.TempFiles, last.TempFiles)
+	fmt.Printf("  %-11s %.1f -> %.1f MB\n", "heap", first.HeapMB, last.HeapMB)
+	return ok
+}
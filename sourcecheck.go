@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Source check depths, from cheapest to most thorough.
+const (
+	sourceCheckOff     = "off"     // No check
+	sourceCheckQuick   = "quick"   // Container readable and packets present up to the end
+	sourceCheckPackets = "packets" // Demux every packet of the file
+	sourceCheckDecode  = "decode"  // Also decode the audio tracks that will be downmixed
+)
+
+// sourceTailWindow is how close to the stated duration the last packets of
+// a complete file must be, in seconds.
+const sourceTailWindow = 30.0
+
+// maxSourceErrors caps how many ffmpeg error lines a failed check reports.
+const maxSourceErrors = 5
+
+// validateSourceCheck checks a -check value.
+func validateSourceCheck(depth string) error {
+	switch depth {
+	case "", sourceCheckOff, sourceCheckQuick, sourceCheckPackets, sourceCheckDecode:
+		return nil
+	}
+	return fmt.Errorf("unknown source check %q (use %s, %s, %s or %s)", depth,
+		sourceCheckOff, sourceCheckQuick, sourceCheckPackets, sourceCheckDecode)
+}
+
+// checkSource verifies that the source can be read before any time is spent
+// encoding it. Each depth includes the checks of the cheaper ones.
+func checkSource(plan *Plan) error {
+	depth := plan.SourceCheck
+	if depth == "" || depth == sourceCheckOff {
+		return nil
+	}
+
+	duration, err := probeDuration(plan.Input)
+	if err != nil {
+		return fmt.Errorf("source %s is unreadable: %v", plan.Input, err)
+	}
+	if err := checkSourceTail(plan.Input, duration); err != nil {
+		return err
+	}
+	if depth == sourceCheckQuick {
+		return nil
+	}
+
+	fmt.Printf("Scanning %s for corrupt packets...\n", plan.Input)
+	args := []string{"-v", "error", "-i", plan.Input, "-map", "0", "-c", "copy", "-f", "null", "-"}
+	if err := runSourceScan(plan.Input, "demuxing", args); err != nil {
+		return err
+	}
+	if depth == sourceCheckPackets {
+		return nil
+	}
+
+	for _, enc := range plan.Encodes {
+		fmt.Printf("Decoding track %d of %s...\n", enc.SourceIndex, plan.Input)
+		args := []string{"-v", "error", "-i", plan.Input, "-map", fmt.Sprintf("0:%d", enc.SourceIndex), "-f", "null", "-"}
+		if err := runSourceScan(plan.Input, fmt.Sprintf("decoding track %d", enc.SourceIndex), args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSourceTail reads the packets at the end of the file and fails if they
+// stop well before the duration the container claims, which is what a
+// truncated download or copy looks like.
+func checkSourceTail(file string, duration float64) error {
+	if duration <= sourceTailWindow {
+		return nil
+	}
+	start := duration - sourceTailWindow*2
+	output, err := exec.Command(ffprobePath, "-v", "error",
+		"-read_intervals", fmt.Sprintf("%.3f%%", start),
+		"-show_entries", "packet=pts_time", "-of", "csv=p=0", file).Output()
+	if err != nil {
+		return fmt.Errorf("source %s could not be read near its end: %v", file, err)
+	}
+
+	last := 0.0
+	for _, line := range strings.Split(string(output), "\n") {
+		if t, err := strconv.ParseFloat(strings.TrimSpace(strings.Trim(line, ",")), 64); err == nil && t > last {
+			last = t
+		}
+	}
+	if last < duration-sourceTailWindow {
+		return fmt.Errorf("source %s looks truncated: the container claims %.0fs but the last packet is at %.0fs",
+			file, duration, last)
+	}
+	return nil
+}
+
+// runSourceScan runs an ffmpeg pass that only reads the source and fails with
+// the first errors ffmpeg reported.
+func runSourceScan(file, what string, args []string) error {
+	cmd := exec.Command(ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+
+	var problems []string
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			problems = append(problems, line)
+		}
+	}
+	if runErr == nil && len(problems) == 0 {
+		return nil
+	}
+
+	count := len(problems)
+	if count > maxSourceErrors {
+		problems = problems[:maxSourceErrors]
+	}
+	msg := fmt.Sprintf("%s is damaged: %s reported %d error(s)", file, what, count)
+	if runErr != nil {
+		msg += fmt.Sprintf(" and failed (%v)", runErr)
+	}
+	return fmt.Errorf("%s:\n  %s", msg, strings.Join(problems, "\n  "))
+}
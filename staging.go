@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultStageChunk is the read size used when staging a source. Large
+// sequential reads keep a spinning disk streaming instead of seeking.
+const defaultStageChunk = "16M"
+
+// parseByteSize parses a size like "16M", "512k" or "1G" (binary units).
+func parseByteSize(s string) (int64, error) {
+	factor, value := int64(1), s
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		factor = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		factor = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		factor = 1 << 30
+	}
+	if factor > 1 {
+		value = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * factor, nil
+}
+
+// source returns the file the encodes and the merge read from: the staged
+// copy if the source was staged, otherwise the input itself.
+func (p *Plan) source() string {
+	if p.staged != "" {
+		return p.staged
+	}
+	return p.Input
+}
+
+// stageInput copies the source into StageDir in StageChunk reads, so the
+// parallel encodes read a local copy instead of each seeking through the
+// original on slow storage. With StageReadahead the kernel is asked to
+// fetch that much ahead of the reads. The copy's throughput is reported so
+// chunk and readahead sizes can be compared. With StageVerify the copy is
+// checked against the source's checksum.
+func stageInput(ctx context.Context, plan *Plan) error {
+	if plan.StageDir == "" {
+		return nil
+	}
+	chunk, err := parseByteSize(plan.StageChunk)
+	if err != nil {
+		return fmt.Errorf("invalid -stage-chunk: %v", err)
+	}
+	var readahead int64
+	if plan.StageReadahead != "" {
+		if readahead, err = parseByteSize(plan.StageReadahead); err != nil {
+			return fmt.Errorf("invalid -stage-readahead: %v", err)
+		}
+	}
+
+	src, err := os.Open(plan.Input)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	staged := filepath.Join(plan.StageDir, jobFileName(plan.JobID, "source"+filepath.Ext(plan.Input)))
+	dst, err := os.Create(staged)
+	if err != nil {
+		return err
+	}
+
+	// Network reads wait for each other, not for local encodes
+	if sourceIOProfile(plan.Input) == ioNetwork {
+		networkTransfers <- struct{}{}
+		defer func() { <-networkTransfers }()
+	}
+	fmt.Printf("Staging source to %s in %s reads%s...\n", staged, humanSize(chunk), readaheadNote(readahead))
+	started := time.Now()
+	var w io.Writer = dst
+	var sum *streamHasher
+	if plan.StageVerify != "" {
+		sum = newStreamHasher(plan.StageVerify)
+		w = io.MultiWriter(dst, sum)
+	}
+	adviseSequential(src)
+	n, err := copyChunks(ctx, w, src, chunk, readahead)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && sum != nil {
+		err = verifyStaged(staged, plan.StageVerify, sum.Sum())
+	}
+	if err != nil {
+		os.Remove(staged)
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		return fmt.Errorf("staging source failed: %v", err)
+	}
+	elapsed := time.Since(started).Seconds()
+	if elapsed > 0 {
+		fmt.Printf("Staged %s in %s (%s/s)\n", humanSize(n), humanDuration(elapsed), humanSize(int64(float64(n)/elapsed)))
+	}
+	plan.staged = staged
+	return nil
+}
+
+// copyChunks copies src to w in reads of chunk bytes until src ends or ctx
+// is cancelled. With a readahead, the kernel is told before each read which
+// part of src comes next.
+func copyChunks(ctx context.Context, w io.Writer, src *os.File, chunk, readahead int64) (int64, error) {
+	buf := make([]byte, chunk)
+	var n int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if readahead > 0 {
+			adviseWillNeed(src, n+chunk, readahead)
+		}
+		read, err := io.ReadFull(src, buf)
+		if read > 0 {
+			if _, werr := w.Write(buf[:read]); werr != nil {
+				return n, werr
+			}
+			n += int64(read)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// readaheadNote describes a readahead for the staging message.
+func readaheadNote(readahead int64) string {
+	if readahead <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" with %s readahead", humanSize(readahead))
+}
+
+// verifyStaged compares the staged copy with the checksum the source had
+// while it was read, so the source is read only once.
+func verifyStaged(staged, algo, want string) error {
+	started := time.Now()
+	got, err := hashFile(staged, algo)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("the staged copy differs from the source (%s %s, expected %s)", algo, got, want)
+	}
+	logDebug("Staged copy verified with %s in %s", algo, humanDuration(time.Since(started).Seconds()))
+	return nil
+}
+
+// removeStagedInput deletes the staged copy of the source, if any.
+func removeStagedInput(plan *Plan) {
+	if plan.staged == "" {
+		return
+	}
+	if err := os.Remove(plan.staged); err != nil {
+		fmt.Printf("Failed to delete staged source %s: %v\n", plan.staged, err)
+	}
+	plan.staged = ""
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+// addStatisticsTags writes the Matroska statistics tags (BPS, DURATION,
+// NUMBER_OF_FRAMES, NUMBER_OF_BYTES) for every track, the same way mkvmerge
+// does, so media servers show correct bitrates for the new tracks.
+func addStatisticsTags(file string) error {
+	if _, err := exec.LookPath("mkvpropedit"); err != nil {
+		return fmt.Errorf("mkvpropedit (MKVToolNix) is required for statistics tags: %v", err)
+	}
+
+	cmd := exec.Command("mkvpropedit", file, "--add-track-statistics-tags")
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mkvpropedit failed: %v\nOutput: %s", err, output.String())
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import "fmt"
+
+// I/O profiles of a source, used to mix network-bound and CPU-bound work.
+const (
+	ioLocal   = "local"   // Read from local disk; encoding is CPU-bound
+	ioNetwork = "network" // Read over the network; staging or reading is network-bound
+)
+
+// networkTransfers lets one network-bound staging copy run at a time, so
+// downloads don't compete for the link while local files keep the CPU busy.
+var networkTransfers = make(chan struct{}, 1)
+
+// sourceIOProfile returns the I/O profile of a source file.
+func sourceIOProfile(path string) string {
+	if _, ok := rcloneSource(path); ok || networkFilesystem(path) {
+		return ioNetwork
+	}
+	return ioLocal
+}
+
+// scheduleByIO reorders batch inputs so network and local sources alternate,
+// keeping their relative order. Running files then overlap downloads with
+// encodes instead of doing all the heavy transfers first.
+func scheduleByIO(files []string) []string {
+	var network, local []string
+	for _, file := range files {
+		if sourceIOProfile(file) == ioNetwork {
+			network = append(network, file)
+		} else {
+			local = append(local, file)
+		}
+	}
+	if len(network) == 0 || len(local) == 0 {
+		return files
+	}
+	fmt.Printf("Interleaving %d network and %d local sources\n", len(network), len(local))
+	scheduled := make([]string, 0, len(files))
+	for len(network) > 0 || len(local) > 0 {
+		if len(network) > 0 {
+			scheduled = append(scheduled, network[0])
+			network = network[1:]
+		}
+		if len(local) > 0 {
+			scheduled = append(scheduled, local[0])
+			local = local[1:]
+		}
+	}
+	return scheduled
+}
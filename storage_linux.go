@@ -0,0 +1,26 @@
+package main
+
+import "syscall"
+
+// networkFilesystemTypes are the statfs magic numbers of filesystems whose
+// reads go over the network. FUSE is included as it is mostly used for
+// sshfs and rclone mounts.
+var networkFilesystemTypes = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517b:     true, // SMB
+	0xff534d42: true, // CIFS
+	0xfe534d42: true, // SMB2
+	0x65735546: true, // FUSE
+	0x00c36400: true, // Ceph
+	0x5346414f: true, // AFS
+	0x01021997: true, // 9P
+}
+
+// networkFilesystem reports whether path is on a network filesystem.
+func networkFilesystem(path string) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return false
+	}
+	return networkFilesystemTypes[uint32(fs.Type)]
+}
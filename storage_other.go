@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// networkFilesystem is only implemented on Linux; elsewhere every path is
+// treated as local storage.
+func networkFilesystem(path string) bool {
+	return false
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// webhookTimeout bounds a webhook request, so an unreachable endpoint
+// doesn't hold up a batch.
+const webhookTimeout = 30 * time.Second
+
+// defaultSummaryTemplate renders the plain-text job summary.
+const defaultSummaryTemplate = `{{if eq .Status "ok"}}Converted{{else}}FAILED{{end}}: {{.Input}}
+{{- if .Title}}
+Title:    {{.Title}}{{end}}
+Output:   {{.Output}}{{if .OutputSize}} ({{humanSize .OutputSize}}){{end}}
+Source:   {{humanSize .InputSize}}{{if .MediaDuration}}, {{humanDuration .MediaDuration}}{{end}}
+Took:     {{humanDuration .Elapsed}}
+{{- range .Tracks}}
+Track {{.SourceIndex}}: {{.Title}} ({{.Language}}, from {{.Layout}}{{if .Bitrate}}, {{.Bitrate}}{{end}}){{end}}
+{{- if .SeekIndex}}
+Seek:     {{.SeekIndex}}{{end}}
+{{- range .Warnings}}
+Warning:  {{.Message}}{{end}}
+{{- range .Excluded}}
+Excluded track {{.SourceIndex}} after {{.Attempts}} attempt(s): {{.Error}}{{end}}
+{{- if .Error}}
+Error:    {{.Error}}{{end}}
+`
+
+// JobSummary describes a finished job for notifications, post-hooks and
+// -json output. Status is ok, failed or, for files left alone, skipped.
+type JobSummary struct {
+	Status        string            `json:"status"` // ok, failed or skipped
+	Error         string            `json:"error,omitempty"`
+	Input         string            `json:"input"`
+	Output        string            `json:"output"`
+	Title         string            `json:"title,omitempty"`
+	Release       map[string]string `json:"release,omitempty"` // Tokens of the release name, see ReleaseInfo.TemplateVars
+	InputSize     int64             `json:"input_size"`
+	OutputSize    int64             `json:"output_size,omitempty"`
+	MediaDuration float64           `json:"media_duration,omitempty"` // Seconds of media in the source
+	Elapsed       float64           `json:"elapsed"`                  // Seconds the job took
+	SizeDelta     int64             `json:"size_delta,omitempty"`     // Output size minus input size
+	TracksFound   int               `json:"tracks_found"`             // Audio tracks in the source
+	Tracks        []SummaryTrack    `json:"tracks"`                   // Tracks added
+	Excluded      []PlanExclusion   `json:"excluded,omitempty"`
+	Warnings      []Warning         `json:"warnings,omitempty"`
+	Verification  string            `json:"verification,omitempty"` // passed, failed or off; empty if the output wasn't verified
+	SeekIndex     string            `json:"seek_index,omitempty"`   // Result of the cues check, empty if not checked
+}
+
+// SummaryTrack is a track added by the job.
+type SummaryTrack struct {
+	SourceIndex int     `json:"source_index"`
+	Layout      string  `json:"layout"`
+	Language    string  `json:"language"`
+	Title       string  `json:"title"`
+	Codec       string  `json:"codec"`
+	Channels    int     `json:"channels"`
+	Bitrate     string  `json:"bitrate,omitempty"`  // Empty for lossless codecs
+	Content     string  `json:"content,omitempty"`  // speech or music, with -bitrate auto
+	Loudness    float64 `json:"loudness,omitempty"` // Integrated loudness in LUFS, measured or the -loudnorm target
+	Elapsed     float64 `json:"encode_seconds"`     // Time the encode took, 0 if it came from the cache or an earlier run
+}
+
+// mediaTitle names the plan's movie or episode for reports: the TMDb title
+// if there is one, otherwise the one in the file name.
+func (p *Plan) mediaTitle() string {
+	if p.Media != nil {
+		return p.Media.DisplayName()
+	}
+	return parseReleaseName(p.Input).Title
+}
+
+// newJobSummary describes the outcome of executing plan.
+func newJobSummary(plan *Plan, started time.Time, runErr error) JobSummary {
+	summary := JobSummary{
+		Status:       "ok",
+		Input:        plan.Input,
+		Output:       plan.Output,
+		Title:        plan.mediaTitle(),
+		Release:      map[string]string{},
+		Elapsed:      time.Since(started).Seconds(),
+		Tracks:       []SummaryTrack{},
+		Excluded:     plan.Excluded,
+		Warnings:     plan.Warnings,
+		SeekIndex:    plan.seekIndex,
+		Verification: plan.verification,
+	}
+	for key, value := range parseReleaseName(plan.Input).TemplateVars() {
+		if value != "" {
+			summary.Release[key] = value
+		}
+	}
+	if runErr != nil {
+		summary.Status = "failed"
+		summary.Error = runErr.Error()
+	}
+	if info, err := os.Stat(plan.Input); err == nil {
+		summary.InputSize = info.Size()
+	}
+	if info, err := os.Stat(plan.Output); err == nil && runErr == nil {
+		summary.OutputSize = info.Size()
+		summary.SizeDelta = summary.OutputSize - summary.InputSize
+	}
+	if d, err := probeDuration(plan.Input); err == nil {
+		summary.MediaDuration = d
+	}
+	for _, enc := range plan.Encodes {
+		summary.Tracks = append(summary.Tracks, SummaryTrack{
+			SourceIndex: enc.SourceIndex,
+			Layout:      enc.Layout,
+			Language:    enc.Language,
+			Title:       enc.Title,
+			Codec:       encodeCodec(enc),
+			Channels:    encodeChannels(enc),
+			Bitrate:     encodeBitrateArg(enc),
+			Content:     enc.Content,
+			Loudness:    encodeLoudness(enc),
+			Elapsed:     plan.state.encodeElapsed(enc.TempFile),
+		})
+	}
+	for _, s := range plan.Streams {
+		if s.Type == "audio" {
+			summary.TracksFound++
+		}
+	}
+	return summary
+}
+
+// summaryFuncs are the functions available to summary templates.
+var summaryFuncs = template.FuncMap{
+	"humanSize":     humanSize,
+	"humanDuration": humanDuration,
+	"shellQuote":    shellQuote,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// renderSummary renders the summary with the template in file, or the
+// default template if file is empty.
+func renderSummary(summary JobSummary, file string) (string, error) {
+	text := defaultSummaryTemplate
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("summary").Funcs(summaryFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid summary template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, summary); err != nil {
+		return "", fmt.Errorf("rendering summary failed: %v", err)
+	}
+
+	// File names may contain control characters that mangle mails and terminals
+	return strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\n' && r != '\t' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, buf.String()), nil
+}
+
+// runHook runs a hook command through the shell. The summaries are passed
+// in environment variables rather than on the command line, so file names
+// can't break out of the command.
+func runHook(name, command string, plan *Plan, summary JobSummary) error {
+	text, err := renderSummary(summary, plan.SummaryTemplate)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"MKV21_STATUS="+summary.Status,
+		"MKV21_INPUT="+summary.Input,
+		"MKV21_OUTPUT="+summary.Output,
+		"MKV21_SUMMARY="+text,
+		"MKV21_SUMMARY_JSON="+string(data))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", name, err)
+	}
+	return nil
+}
+
+// postWebhook POSTs the JSON summary to url.
+func postWebhook(url string, summary JobSummary) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("webhook: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mkv-5.1to2.1")
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook failed: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// hasHooks reports whether anything wants to hear about finished jobs.
+func (p *Plan) hasHooks() bool {
+	return p.PostHook != "" || p.OnSuccess != "" || p.OnFailure != "" || p.WebhookURL != ""
+}
+
+// finishJob builds the job summary and hands it to the post-hook, the
+// success or failure hook and the webhook. Hook errors are reported but
+// don't change the outcome of the job.
+func finishJob(plan *Plan, started time.Time, runErr error) {
+	if !plan.hasHooks() && jsonSummaries == nil {
+		return
+	}
+	summary := newJobSummary(plan, started, runErr)
+	writeJSONSummary(summary)
+	hooks := []struct{ name, command string }{{"post-hook", plan.PostHook}}
+	if runErr == nil {
+		hooks = append(hooks, struct{ name, command string }{"success hook", plan.OnSuccess})
+	} else {
+		hooks = append(hooks, struct{ name, command string }{"failure hook", plan.OnFailure})
+	}
+	for _, hook := range hooks {
+		if hook.command == "" {
+			continue
+		}
+		if err := runHook(hook.name, hook.command, plan, summary); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+	if plan.WebhookURL != "" {
+		if err := postWebhook(plan.WebhookURL, summary); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+}
+
+// finishUnplannedJob reports a file that failed before it had a plan, so
+// hooks hear about every failure.
+func finishUnplannedJob(input string, opts *Options, started time.Time, runErr error) {
+	plan := &Plan{Input: input}
+	setPlanHooks(plan, *opts)
+	finishJob(plan, started, runErr)
+}
+
+// jsonSummaries receives a summary line per file with -json, and is nil
+// otherwise.
+var jsonSummaries io.Writer
+
+// jsonSummariesMu keeps the lines of parallel files apart.
+var jsonSummariesMu sync.Mutex
+
+// writeJSONSummary prints the summary as one JSON line with -json.
+func writeJSONSummary(summary JobSummary) {
+	if jsonSummaries == nil {
+		return
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	jsonSummariesMu.Lock()
+	defer jsonSummariesMu.Unlock()
+	jsonSummaries.Write(append(data, '\n'))
+}
+
+// reportUnprocessed writes the -json summary of a file that was never
+// executed, e.g. one skipped as already converted. Hooks aren't run for
+// these.
+func reportUnprocessed(input, status, reason string) {
+	if jsonSummaries == nil {
+		return
+	}
+	summary := JobSummary{Status: status, Input: input, Error: reason, Tracks: []SummaryTrack{}}
+	if info, err := os.Stat(input); err == nil {
+		summary.InputSize = info.Size()
+	}
+	writeJSONSummary(summary)
+}
+
+// setPlanHooks copies the hook settings into a plan.
+func setPlanHooks(plan *Plan, opts Options) {
+	plan.PostHook = opts.PostHook
+	plan.OnSuccess = opts.OnSuccess
+	plan.OnFailure = opts.OnFailure
+	plan.WebhookURL = opts.WebhookURL
+	plan.SummaryTemplate = opts.SummaryTemplate
+}
+
+// humanSize formats a byte count, e.g. "1.4 GB".
+func humanSize(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(bytes)
+	i := 0
+	for size >= 1000 && i < len(units)-1 {
+		size /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
+// humanDuration formats seconds as e.g. "1h02m" or "45s".
+func humanDuration(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(time.Second)
+	switch {
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%ds", int(d.Seconds()))
+}
+
+// shellQuote quotes a string for use as a single POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Filters changing the speed of the new tracks without changing their pitch,
+// selectable with -tempo-filter.
+const (
+	tempoAtempo     = "atempo"     // ffmpeg's built-in time stretcher
+	tempoRubberband = "rubberband" // Better quality, needs ffmpeg with librubberband
+)
+
+// tempoPresets are named -tempo conversions. PAL releases of film content
+// run 4% fast; "pal" slows them back to film speed.
+var tempoPresets = map[string]string{
+	"pal":   "25:24000/1001",
+	"pal24": "25:24",
+}
+
+// parseTempo returns the speed factor of a -tempo value: a preset or
+// "from:to" frame rates, each a number or a fraction such as 24000/1001.
+// Below 1 the output plays slower than the source. An empty value gives 0.
+func parseTempo(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if preset, ok := tempoPresets[strings.ToLower(value)]; ok {
+		value = preset
+	}
+	from, to, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid -tempo %q (use pal, pal24 or from:to frame rates, e.g. 25:23.976)", value)
+	}
+	fromRate, err := parseFrameRate(from)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -tempo %q: %v", value, err)
+	}
+	toRate, err := parseFrameRate(to)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -tempo %q: %v", value, err)
+	}
+	factor := toRate / fromRate
+	if factor < 0.5 || factor > 2 {
+		return 0, fmt.Errorf("-tempo %q changes the speed by more than a factor of two", value)
+	}
+	return factor, nil
+}
+
+// parseFrameRate parses a frame rate given as a number or a fraction.
+func parseFrameRate(value string) (float64, error) {
+	num, den, fraction := strings.Cut(value, "/")
+	rate, err := strconv.ParseFloat(num, 64)
+	if err == nil && fraction {
+		var d float64
+		if d, err = strconv.ParseFloat(den, 64); err == nil {
+			if d == 0 {
+				return 0, fmt.Errorf("frame rate %q divides by zero", value)
+			}
+			rate /= d
+		}
+	}
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid frame rate %q", value)
+	}
+	return rate, nil
+}
+
+// validateTempoFilter checks a -tempo-filter value.
+func validateTempoFilter(filter string) error {
+	switch filter {
+	case "", tempoAtempo, tempoRubberband:
+		return nil
+	}
+	return fmt.Errorf("unknown tempo filter %q (use %s or %s)", filter, tempoAtempo, tempoRubberband)
+}
+
+// tempoFilter returns the filter appended to the downmix to play it at the
+// given speed with its pitch kept, or "" at the original speed.
+func tempoFilter(factor float64, filter string) string {
+	if factor == 0 || factor == 1 {
+		return ""
+	}
+	speed := strconv.FormatFloat(factor, 'f', 6, 64)
+	if filter == tempoRubberband {
+		return ",rubberband=tempo=" + speed + ":pitchq=quality"
+	}
+	return ",atempo=" + speed
+}
+
+// checkTempoPlan makes sure a retimed plan keeps everything in sync. The
+// merge scales the timestamps of every copied stream, which only works for
+// video and subtitles; audio that isn't re-encoded would play at the wrong
+// speed.
+func checkTempoPlan(plan *Plan) error {
+	if plan.Tempo == 0 {
+		return nil
+	}
+	if plan.PreserveEditions {
+		return fmt.Errorf("-tempo can't be combined with -preserve-editions, whose chapters wouldn't be retimed")
+	}
+	for _, s := range plan.Streams {
+		if s.Type == "audio" && s.Action == "keep" {
+			return fmt.Errorf("-tempo retimes the whole file, but audio stream %d is copied and would play at the wrong speed; drop it with -drop-tracks or -keep-original=false", s.Index)
+		}
+	}
+	return nil
+}
+
+// retimed converts a duration of the source to the output's.
+func (p *Plan) retimed(seconds float64) float64 {
+	if p.Tempo == 0 {
+		return seconds
+	}
+	return seconds / p.Tempo
+}
+
+// tempoInputArgs returns the options scaling the timestamps of the source
+// to the output speed, placed before it is opened.
+func (p *Plan) tempoInputArgs() []string {
+	if p.Tempo == 0 {
+		return nil
+	}
+	return []string{"-itsscale", strconv.FormatFloat(1/p.Tempo, 'f', 9, 64)}
+}
+
+// chapterFile returns the ffmetadata file holding the retimed chapters.
+func (p *Plan) chapterFile() string {
+	return p.workPath("chapters.ffmeta")
+}
+
+// writeRetimedChapters writes the source's chapters, scaled to the output
+// speed, as an ffmetadata file for the merge.
+func writeRetimedChapters(plan *Plan) error {
+	output, err := exec.Command(ffprobePath, "-loglevel", "error", "-show_chapters", "-of", "json", plan.Input).Output()
+	if err != nil {
+		return fmt.Errorf("ffprobe failed with error: %s", err)
+	}
+	var result struct {
+		Chapters []struct {
+			StartTime string            `json:"start_time"`
+			EndTime   string            `json:"end_time"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"chapters"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return probeError{plan.Input, -1, err.Error()}
+	}
+
+	var b strings.Builder
+	b.WriteString(";FFMETADATA1\n")
+	for _, c := range result.Chapters {
+		start, _ := strconv.ParseFloat(c.StartTime, 64)
+		end, _ := strconv.ParseFloat(c.EndTime, 64)
+		fmt.Fprintf(&b, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%.0f\nEND=%.0f\n", plan.retimed(start)*1000, plan.retimed(end)*1000)
+		if title := c.Tags["title"]; title != "" {
+			b.WriteString("title=" + escapeFFMetadata(title) + "\n")
+		}
+	}
+	return os.WriteFile(plan.chapterFile(), []byte(b.String()), 0644)
+}
+
+// escapeFFMetadata escapes the characters ffmetadata files treat specially.
+func escapeFFMetadata(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n").Replace(value)
+}
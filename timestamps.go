@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+)
+
+// durationTolerance is the allowed difference between source and output
+// stream durations, in seconds.
+const durationTolerance = 0.1
+
+// videoTiming holds the timestamp related facts of a single video stream.
+type videoTiming struct {
+	Packets   int64   // Number of packets read from the stream
+	Duration  float64 // Stream duration in seconds, 0 if unknown
+	StartTime float64 // First timestamp in seconds
+}
+
+// probeVideoTiming counts the packets of each video stream and reads its
+// duration and start time. Counting requires a demux pass over the file.
+// If keep is set, only streams it accepts are returned.
+func probeVideoTiming(file string, keep func(index int) bool) ([]videoTiming, error) {
+	output, err := exec.Command(ffprobePath, "-loglevel", "error",
+		"-select_streams", "v", "-count_packets",
+		"-show_entries", "stream=index,nb_read_packets,duration,start_time:stream_disposition=attached_pic:stream_tags=DURATION",
+		"-of", "json", file).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed with error: %s", err)
+	}
+
+	var result struct {
+		Streams []struct {
+			Index       int               `json:"index"`
+			Packets     string            `json:"nb_read_packets"`
+			Duration    string            `json:"duration"`
+			StartTime   string            `json:"start_time"`
+			Disposition map[string]int    `json:"disposition"`
+			Tags        map[string]string `json:"tags"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, probeError{file, -1, err.Error()}
+	}
+
+	var timings []videoTiming
+	for _, s := range result.Streams {
+		if s.Disposition["attached_pic"] == 1 || (keep != nil && !keep(s.Index)) {
+			continue
+		}
+		t := videoTiming{}
+		t.Packets, _ = strconv.ParseInt(s.Packets, 10, 64)
+		t.StartTime, _ = strconv.ParseFloat(s.StartTime, 64)
+		t.Duration, _ = strconv.ParseFloat(s.Duration, 64)
+		// Matroska stores stream durations as a tag instead
+		if t.Duration == 0 {
+			t.Duration = parseClockDuration(s.Tags["DURATION"])
+		}
+		timings = append(timings, t)
+	}
+	return timings, nil
+}
+
+// parseClockDuration parses an "HH:MM:SS.fraction" duration into seconds,
+// returning 0 if it is malformed.
+func parseClockDuration(value string) float64 {
+	var h, m int
+	var sec float64
+	if _, err := fmt.Sscanf(value, "%d:%d:%f", &h, &m, &sec); err != nil {
+		return 0
+	}
+	return float64(h*3600+m*60) + sec
+}
+
+// validateTimestamps checks that every video stream of the output has the
+// same number of frames and the same duration as its source stream, and that
+// the output doesn't start with negative timestamps. Encoders may drop or
+// repeat frames, so re-encoded video only needs the same duration.
+func validateTimestamps(plan *Plan) error {
+	want, err := probeVideoTiming(plan.Input, plan.keeps)
+	if err != nil {
+		return err
+	}
+	got, err := probeVideoTiming(plan.Output, nil)
+	if err != nil {
+		return err
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("output has %d video streams, source has %d", len(got), len(want))
+	}
+
+	for i := range want {
+		want[i].Duration = plan.retimed(want[i].Duration)
+		if got[i].Packets != want[i].Packets && !plan.reencodesVideo() {
+			return fmt.Errorf("video stream %d has %d frames in the output but %d in the source", i, got[i].Packets, want[i].Packets)
+		}
+		if want[i].Duration > 0 && math.Abs(got[i].Duration-want[i].Duration) > durationTolerance {
+			return fmt.Errorf("video stream %d lasts %.3fs in the output but %.3fs in the source", i, got[i].Duration, want[i].Duration)
+		}
+		if got[i].StartTime < 0 {
+			return fmt.Errorf("video stream %d starts at negative timestamp %.3fs; retry with -fix-timestamps", i, got[i].StartTime)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tmdbBaseURL = "https://api.themoviedb.org/3"
+
+// MediaTitle is the resolved movie or episode name for a file.
+type MediaTitle struct {
+	Title        string `json:"title"`                   // Movie or show title
+	Year         string `json:"year,omitempty"`          // Release or first-air year
+	Season       string `json:"season,omitempty"`        // Season number for episodes
+	Episode      string `json:"episode,omitempty"`       // Episode number for episodes
+	EpisodeTitle string `json:"episode_title,omitempty"` // Episode name, if known
+}
+
+// DisplayName formats the title for reports and console output.
+func (m MediaTitle) DisplayName() string {
+	if m.Season != "" && m.Episode != "" {
+		name := fmt.Sprintf("%s - S%sE%s", m.Title, m.Season, m.Episode)
+		if m.EpisodeTitle != "" {
+			name += " - " + m.EpisodeTitle
+		}
+		return name
+	}
+	if m.Year != "" {
+		return fmt.Sprintf("%s (%s)", m.Title, m.Year)
+	}
+	return m.Title
+}
+
+// TMDbClient resolves release names to titles using the TMDb API.
+// Lookups are cached on disk so repeated runs don't hit the API again.
+type TMDbClient struct {
+	apiKey    string
+	http      *http.Client
+	cachePath string
+
+	mu    sync.Mutex
+	cache map[string]MediaTitle
+}
+
+// newTMDbClient creates a client using the given API key. The cache lives in
+// the user cache directory; if that is unavailable, caching is disabled.
+func newTMDbClient(apiKey string) *TMDbClient {
+	c := &TMDbClient{
+		apiKey: apiKey,
+		http:   &http.Client{Timeout: 10 * time.Second},
+		cache:  make(map[string]MediaTitle),
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		c.cachePath = filepath.Join(dir, "mkv-5.1to2.1", "tmdb.json")
+		if data, err := os.ReadFile(c.cachePath); err == nil {
+			json.Unmarshal(data, &c.cache)
+		}
+	}
+	return c
+}
+
+// Lookup resolves a file name to a movie or episode title.
+func (c *TMDbClient) Lookup(file string) (MediaTitle, error) {
+	release := parseReleaseName(file)
+	if release.Title == "" {
+		return MediaTitle{}, fmt.Errorf("no title found in file name: %s", file)
+	}
+
+	key := strings.ToLower(strings.Join([]string{release.Title, release.Year, release.Season, release.Episode}, "|"))
+	c.mu.Lock()
+	cached, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	var title MediaTitle
+	var err error
+	if release.Season != "" && release.Episode != "" {
+		title, err = c.lookupEpisode(release)
+	} else {
+		title, err = c.lookupMovie(release)
+	}
+	if err != nil {
+		return MediaTitle{}, err
+	}
+
+	c.mu.Lock()
+	c.cache[key] = title
+	c.saveCache()
+	c.mu.Unlock()
+	return title, nil
+}
+
+// lookupMovie searches TMDb for a movie by title and year.
+func (c *TMDbClient) lookupMovie(release ReleaseInfo) (MediaTitle, error) {
+	params := url.Values{"query": {release.Title}}
+	if release.Year != "" {
+		params.Set("year", release.Year)
+	}
+	var result struct {
+		Results []struct {
+			Title       string `json:"title"`
+			ReleaseDate string `json:"release_date"`
+		} `json:"results"`
+	}
+	if err := c.get("/search/movie", params, &result); err != nil {
+		return MediaTitle{}, err
+	}
+	if len(result.Results) == 0 {
+		return MediaTitle{}, fmt.Errorf("no TMDb movie found for %q", release.Title)
+	}
+	movie := result.Results[0]
+	return MediaTitle{Title: movie.Title, Year: yearOf(movie.ReleaseDate)}, nil
+}
+
+// lookupEpisode searches TMDb for a show and then fetches the episode name.
+func (c *TMDbClient) lookupEpisode(release ReleaseInfo) (MediaTitle, error) {
+	var shows struct {
+		Results []struct {
+			ID           int    `json:"id"`
+			Name         string `json:"name"`
+			FirstAirDate string `json:"first_air_date"`
+		} `json:"results"`
+	}
+	if err := c.get("/search/tv", url.Values{"query": {release.Title}}, &shows); err != nil {
+		return MediaTitle{}, err
+	}
+	if len(shows.Results) == 0 {
+		return MediaTitle{}, fmt.Errorf("no TMDb show found for %q", release.Title)
+	}
+	show := shows.Results[0]
+	title := MediaTitle{
+		Title:   show.Name,
+		Year:    yearOf(show.FirstAirDate),
+		Season:  release.Season,
+		Episode: release.Episode,
+	}
+
+	var episode struct {
+		Name string `json:"name"`
+	}
+	path := fmt.Sprintf("/tv/%d/season/%s/episode/%s", show.ID,
+		strings.TrimLeft(release.Season, "0"), strings.TrimLeft(release.Episode, "0"))
+	if err := c.get(path, nil, &episode); err == nil {
+		title.EpisodeTitle = episode.Name
+	}
+	return title, nil
+}
+
+// get performs an authenticated GET request and decodes the JSON response.
+// API read access tokens go in the Authorization header, v3 API keys in the
+// query, which is kept out of errors as they end up in logs.
+func (c *TMDbClient) get(path string, params url.Values, v interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	bearer := strings.HasPrefix(c.apiKey, "eyJ")
+	if !bearer {
+		params.Set("api_key", c.apiKey)
+	}
+	req, err := http.NewRequest(http.MethodGet, tmdbBaseURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("TMDb request %s failed", path)
+	}
+	if bearer {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return fmt.Errorf("TMDb request %s failed: %s", path, strings.ReplaceAll(err.Error(), c.apiKey, "<key>"))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("TMDb request %s failed with status %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// saveCache writes the lookup cache to disk. Errors are ignored since the
+// cache is only an optimisation. Must be called with c.mu held.
+func (c *TMDbClient) saveCache() {
+	if c.cachePath == "" {
+		return
+	}
+	data, err := json.MarshalIndent(c.cache, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(c.cachePath), 0755)
+	os.WriteFile(c.cachePath, data, 0644)
+}
+
+// yearOf returns the year part of a TMDb "YYYY-MM-DD" date.
+func yearOf(date string) string {
+	if len(date) >= 4 {
+		return date[:4]
+	}
+	return ""
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Executables of ffmpeg and ffprobe. Plain names are looked up in PATH; the
+// environment sets them for every command, -ffmpeg-path and -ffprobe-path
+// for conversions.
+var (
+	ffmpegPath  = envOr("FFMPEG_PATH", "ffmpeg")
+	ffprobePath = envOr("FFPROBE_PATH", "ffprobe")
+)
+
+// minFFmpegVersion is the oldest ffmpeg release the filters and muxer
+// options used here are known to work with.
+var minFFmpegVersion = [2]int{4, 4}
+
+// streamingFFmpegVersion is the first release with the cues_to_front muxer
+// option of -target streaming.
+var streamingFFmpegVersion = [2]int{6, 0}
+
+// ffmpegVersionRe matches the release in the first line of "ffmpeg
+// -version", e.g. "ffmpeg version 6.1.1" or "ffmpeg version n7.0". Git
+// builds ("N-113000-g...") have no release and aren't checked.
+var ffmpegVersionRe = regexp.MustCompile(`version n?(\d+)\.(\d+)`)
+
+// envOr returns the environment variable key, or fallback if it is unset.
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// setToolPaths applies -ffmpeg-path and -ffprobe-path. Without an ffprobe
+// path, an ffprobe next to a given ffmpeg is preferred, as builds usually
+// ship both.
+func setToolPaths(opts Options) {
+	ffmpegPath = opts.FFmpegPath
+	if opts.FFprobePath != "" {
+		ffprobePath = opts.FFprobePath
+		return
+	}
+	if strings.ContainsRune(ffmpegPath, filepath.Separator) {
+		sibling := filepath.Join(filepath.Dir(ffmpegPath), strings.Replace(filepath.Base(ffmpegPath), "ffmpeg", "ffprobe", 1))
+		if _, err := os.Stat(sibling); err == nil {
+			ffprobePath = sibling
+		}
+	}
+}
+
+// checkFFprobe makes sure ffprobe can be run, for commands that only probe.
+func checkFFprobe() error {
+	if _, err := exec.LookPath(ffprobePath); err != nil {
+		return fmt.Errorf("ffprobe not found (%v); install ffmpeg or point -ffprobe-path or $FFPROBE_PATH at it", err)
+	}
+	if err := exec.Command(ffprobePath, "-hide_banner", "-version").Run(); err != nil {
+		return fmt.Errorf("running %s failed: %v", ffprobePath, err)
+	}
+	return nil
+}
+
+// ffmpegVersion is the release checkTools found, zero for git builds.
+var ffmpegVersion [2]int
+
+// Encoders and filters of ffmpeg, listed once by checkCapabilities.
+var ffmpegEncoders, ffmpegFilters map[string]bool
+
+// checkTools makes sure ffmpeg and ffprobe can be run and ffmpeg is recent
+// enough, so a missing piece fails the run at startup instead of deep into
+// an encode.
+func checkTools() error {
+	for _, tool := range []struct{ name, path, flag string }{
+		{"ffmpeg", ffmpegPath, "-ffmpeg-path or $FFMPEG_PATH"},
+		{"ffprobe", ffprobePath, "-ffprobe-path or $FFPROBE_PATH"},
+	} {
+		if _, err := exec.LookPath(tool.path); err != nil {
+			return fmt.Errorf("%s not found (%v); install ffmpeg %d.%d or newer, or point %s at it", tool.name, err, minFFmpegVersion[0], minFFmpegVersion[1], tool.flag)
+		}
+	}
+
+	output, err := exec.Command(ffmpegPath, "-hide_banner", "-version").Output()
+	if err != nil {
+		return fmt.Errorf("running %s failed: %v", ffmpegPath, err)
+	}
+	firstLine, _, _ := strings.Cut(string(output), "\n")
+	if m := ffmpegVersionRe.FindStringSubmatch(firstLine); m != nil {
+		ffmpegVersion[0], _ = strconv.Atoi(m[1])
+		ffmpegVersion[1], _ = strconv.Atoi(m[2])
+		if ffmpegOlder(minFFmpegVersion) {
+			return fmt.Errorf("%s is version %d.%d, but %d.%d or newer is needed; use -ffmpeg-path to pick a newer build", ffmpegPath, ffmpegVersion[0], ffmpegVersion[1], minFFmpegVersion[0], minFFmpegVersion[1])
+		}
+	}
+	return nil
+}
+
+// ffmpegOlder reports whether the ffmpeg release is known to be older
+// than v.
+func ffmpegOlder(v [2]int) bool {
+	major, minor := ffmpegVersion[0], ffmpegVersion[1]
+	return major != 0 && (major < v[0] || major == v[0] && minor < v[1])
+}
+
+// checkCapabilities makes sure ffmpeg has the encoders and filters the
+// resolved settings need. It runs once the settings of a file are known,
+// as the configuration file, sidecars and -device may pick the codec.
+func checkCapabilities(opts Options) error {
+	if opts.Target == targetStreaming && ffmpegOlder(streamingFFmpegVersion) {
+		return fmt.Errorf("-target %s needs ffmpeg %d.%d or newer, %s is version %d.%d", targetStreaming, streamingFFmpegVersion[0], streamingFFmpegVersion[1], ffmpegPath, ffmpegVersion[0], ffmpegVersion[1])
+	}
+
+	encoders, err := listEncoders()
+	if err != nil {
+		return err
+	}
+	if encoder := lookupCodec(opts.AudioCodec).Encoder; !encoders[encoder] {
+		hint := "choose another -acodec (" + codecNames() + ")"
+		if encoder == "libopus" {
+			hint = "install an ffmpeg built with --enable-libopus, or " + hint
+		}
+		return fmt.Errorf("%s has no %s encoder; %s", ffmpegPath, encoder, hint)
+	}
+	if args := videoEncodeArgs(opts); args[1] != "copy" && !encoders[args[1]] {
+		return fmt.Errorf("%s has no %s video encoder; choose another -vcodec", ffmpegPath, args[1])
+	}
+
+	if ffmpegFilters == nil {
+		if ffmpegFilters, err = ffmpegCapabilities("-filters"); err != nil {
+			return err
+		}
+	}
+	if opts.TempoFilter == tempoRubberband && !ffmpegFilters["rubberband"] {
+		return fmt.Errorf("%s has no rubberband filter (needs --enable-librubberband); use -tempo-filter %s", ffmpegPath, tempoAtempo)
+	}
+	if opts.RNNModel != "" && !ffmpegFilters["arnndn"] {
+		return fmt.Errorf("%s has no arnndn filter, which -rnn-model needs", ffmpegPath)
+	}
+	return nil
+}
+
+// checkPlanEncoders makes sure ffmpeg has every encoder a loaded plan names.
+func checkPlanEncoders(plan *Plan) error {
+	encoders, err := listEncoders()
+	if err != nil {
+		return err
+	}
+	lists := [][]string{plan.VideoArgs}
+	for _, enc := range plan.Encodes {
+		lists = append(lists, enc.EncoderArgs)
+	}
+	for _, args := range lists {
+		for i := 0; i+1 < len(args); i++ {
+			codec := args[i] == "-acodec" || args[i] == "-vcodec" || strings.HasPrefix(args[i], "-c:")
+			if codec && args[i+1] != "copy" && !encoders[args[i+1]] {
+				return fmt.Errorf("%s has no %s encoder, which the plan uses", ffmpegPath, args[i+1])
+			}
+		}
+	}
+	return nil
+}
+
+// listEncoders returns the encoders of ffmpeg, listing them on first use.
+func listEncoders() (map[string]bool, error) {
+	if ffmpegEncoders == nil {
+		encoders, err := ffmpegCapabilities("-encoders")
+		if err != nil {
+			return nil, err
+		}
+		ffmpegEncoders = encoders
+	}
+	return ffmpegEncoders, nil
+}
+
+// ffmpegCapabilities returns the names listed by "ffmpeg -encoders" or
+// "ffmpeg -filters". Entries are a flags column followed by the name; the
+// legend above them is separated by a dashed line.
+func ffmpegCapabilities(list string) (map[string]bool, error) {
+	output, err := exec.Command(ffmpegPath, "-hide_banner", list).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing ffmpeg %s failed: %v", strings.TrimPrefix(list, "-"), err)
+	}
+	names := make(map[string]bool)
+	entries := !strings.Contains(string(output), "------")
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) > 0 && strings.Trim(fields[0], "-") == "":
+			entries = true
+		case entries && len(fields) >= 2:
+			names[fields[1]] = true
+		}
+	}
+	return names, nil
+}
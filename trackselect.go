@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// commentaryTitleRe matches track titles of commentary tracks.
+var commentaryTitleRe = regexp.MustCompile(`(?i)\bcomment(ary|aire|ar)\b`)
+
+// isCommentary reports whether a track is a commentary, by its disposition
+// or its title.
+func isCommentary(track TrackInfo) bool {
+	return track.Disposition["comment"] == 1 || commentaryTitleRe.MatchString(track.Title)
+}
+
+// parseTrackList parses a -tracks value, a comma separated list of source
+// stream indices.
+func parseTrackList(value string) (map[int]bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	indices := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		index, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid -tracks entry %q: expected stream indices like 1,3", part)
+		}
+		indices[index] = true
+	}
+	return indices, nil
+}
+
+// parseLanguageList parses a -lang value into normalised language codes.
+func parseLanguageList(value string) map[string]bool {
+	if value == "" {
+		return nil
+	}
+	langs := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		if lang := normalizeLanguageCode(part); lang != "" {
+			langs[lang] = true
+		}
+	}
+	return langs
+}
+
+// selectTracks returns the tracks to downmix: surround tracks only, limited
+// by -tracks and -lang and without commentaries if -skip-commentary is set.
+// Every skipped track is reported with the reason.
+func selectTracks(tracks []TrackInfo, opts Options) ([]TrackInfo, error) {
+	indices, err := parseTrackList(opts.Tracks)
+	if err != nil {
+		return nil, err
+	}
+	langs := parseLanguageList(opts.Languages)
+
+	var selected []TrackInfo
+	for _, track := range tracks {
+		index, _ := strconv.Atoi(track.Index)
+		reason := ""
+		switch {
+		case !surroundLayoutRe.MatchString(track.Layout):
+			reason = "not surround (" + track.Layout + ")"
+		case indices != nil && !indices[index]:
+			reason = "not listed in -tracks"
+		case langs != nil && !langs[normalizeLanguageCode(track.Language)]:
+			reason = "language " + track.Language + " not in -lang"
+		case opts.SkipCommentary && isCommentary(track):
+			reason = "commentary"
+		}
+		if reason != "" {
+			fmt.Printf("Skipping track %s: %s\n", track.Index, reason)
+			continue
+		}
+		selected = append(selected, track)
+	}
+	return selected, nil
+}
+
+// dropOriginals drops the source tracks of downmixes from the output, all of
+// them without -keep-original and otherwise those listed in -drop-tracks or
+// in a -drop-lang language. Only downmixed tracks can be dropped, so every
+// language stays available. A dropped default track passes the default flag
+// on to its downmix.
+func dropOriginals(plan *Plan, opts Options) error {
+	indices, err := parseTrackList(opts.DropTracks)
+	if err != nil {
+		return fmt.Errorf("invalid -drop-tracks: %v", err)
+	}
+	langs := parseLanguageList(opts.DropLanguages)
+
+	downmixed := make(map[int]int) // Source index to its first encode
+	for i := len(plan.Encodes) - 1; i >= 0; i-- {
+		downmixed[plan.Encodes[i].SourceIndex] = i
+	}
+	for index := range indices {
+		if _, ok := downmixed[index]; !ok {
+			return fmt.Errorf("-drop-tracks: track %d isn't downmixed, so dropping it would lose it", index)
+		}
+	}
+
+	for i := range plan.Streams {
+		s := &plan.Streams[i]
+		enc, ok := downmixed[s.Index]
+		if !ok || s.Action != "keep" {
+			continue
+		}
+		if opts.KeepOriginal && !indices[s.Index] && !langs[normalizeLanguageCode(s.Language)] {
+			continue
+		}
+		s.Action = "drop"
+		if hasDisposition(s.Disposition, "default") {
+			plan.Encodes[enc].Disposition = setDisposition(plan.Encodes[enc].Disposition, "default", true)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// preserveTrackUIDs gives every copied track of the output the UID it had in
+// the source, so tools that reference tracks by UID (saved player
+// preferences, tags, chapters) keep working. It returns the UIDs of the
+// added tracks, keyed by output stream number.
+func preserveTrackUIDs(plan *Plan) (map[int]uint64, error) {
+	if _, err := exec.LookPath("mkvpropedit"); err != nil {
+		return nil, fmt.Errorf("mkvpropedit (MKVToolNix) is required to preserve track UIDs: %v", err)
+	}
+	source, err := readMatroskaInfo(plan.Input)
+	if err != nil {
+		return nil, fmt.Errorf("reading source tracks failed: %v", err)
+	}
+
+	// ffprobe stream indices follow the TrackEntry order
+	args := []string{plan.Output}
+	for i, out := range plan.outputStreams() {
+		if out.Encode >= 0 || out.Source >= len(source.Tracks) {
+			continue
+		}
+		uid := source.Tracks[out.Source].UID
+		if uid == 0 {
+			continue
+		}
+		args = append(args, "--edit", fmt.Sprintf("track:%d", i+1),
+			"--set", "track-uid="+strconv.FormatUint(uid, 10))
+	}
+
+	if len(args) > 1 {
+		cmd := exec.Command("mkvpropedit", args...)
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("mkvpropedit failed: %v\nOutput: %s", err, output.String())
+		}
+	}
+
+	result, err := readMatroskaInfo(plan.Output)
+	if err != nil {
+		return nil, fmt.Errorf("reading output tracks failed: %v", err)
+	}
+	added := make(map[int]uint64)
+	for i, out := range plan.outputStreams() {
+		if out.Encode >= 0 && i < len(result.Tracks) {
+			added[i] = result.Tracks[i].UID
+		}
+	}
+	return added, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// settingsTag is the track tag recording the settings an enhanced track was
+// made with, so outputs made with older settings can be found later.
+const settingsTag = "MKV21_SETTINGS"
+
+// settingsHash identifies everything that shapes an encode except the
+// source content: filter, encoder, external decoder and track metadata.
+func settingsHash(enc PlanEncode) string {
+	parts := append([]string{enc.Filter, enc.Language, enc.Title, enc.Decoder}, enc.EncoderArgs...)
+	if enc.Loudnorm != "" {
+		parts = append(parts, "loudnorm="+enc.Loudnorm)
+	}
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// outdatedReason compares the settings recorded in an existing output with
+// the ones the plan would use. It returns "" if the output is up to date.
+func outdatedReason(plan *Plan) (string, error) {
+	streams, err := probeStreams(plan.Output, "a")
+	if err != nil {
+		return "", err
+	}
+	var have, want []string
+	for _, s := range streams {
+		for key, value := range s.Tags {
+			if strings.EqualFold(key, settingsTag) {
+				have = append(have, value)
+			}
+		}
+	}
+	for _, enc := range plan.Encodes {
+		want = append(want, settingsHash(enc))
+	}
+	if len(have) == 0 && len(want) > 0 {
+		return "no recorded settings", nil
+	}
+	sort.Strings(have)
+	sort.Strings(want)
+	if strings.Join(have, ",") != strings.Join(want, ",") {
+		return "settings changed", nil
+	}
+	return "", nil
+}
+
+// runUpgrade re-processes the files below dir whose enhanced output was made
+// with different settings than the current ones. Files without an output
+// are left alone.
+func runUpgrade(ctx context.Context, dir string, flags *Options, explicit map[string]bool, dryRun bool) int {
+	if flags.MetadataOnly {
+		fmt.Println("Error: upgrade can't be combined with -metadata-only")
+		return exitFailed
+	}
+	files, err := findBatchInputs(dir, false)
+	if err != nil {
+		fmt.Println("Error scanning directory:", err)
+		return exitFailed
+	}
+
+	// Upgrades replace existing outputs by definition
+	forced := map[string]bool{"force": true}
+	for name := range explicit {
+		forced[name] = true
+	}
+	explicit = forced
+	flags.Force = true
+
+	var results []batchResult
+	for _, file := range files {
+		pauser.wait()
+		if ctx.Err() != nil {
+			reportUnprocessed(file, "failed", errInterrupted.Error())
+			results = append(results, batchResult{file, "failed", errInterrupted.Error()})
+			continue
+		}
+		output, err := outputPath(file, *flags)
+		if err != nil {
+			reportUnprocessed(file, "failed", err.Error())
+			results = append(results, batchResult{file, "failed", err.Error()})
+			continue
+		}
+		if _, err := os.Stat(output); err != nil {
+			continue
+		}
+		plan, opts, err := preparePlan(ctx, file, flags, explicit)
+		if err != nil {
+			reportUnprocessed(file, "failed", err.Error())
+			results = append(results, batchResult{file, "failed", err.Error()})
+			continue
+		}
+		reason, err := outdatedReason(plan)
+		if err != nil {
+			reportUnprocessed(file, "failed", err.Error())
+			results = append(results, batchResult{file, "failed", err.Error()})
+			continue
+		}
+		if reason == "" {
+			reportUnprocessed(file, "skipped", "up to date")
+			results = append(results, batchResult{file, "up to date", ""})
+			continue
+		}
+		if dryRun {
+			results = append(results, batchResult{file, "outdated", reason})
+			continue
+		}
+
+		fmt.Printf("Upgrading %s (%s)\n", file, reason)
+		if err := runPlan(ctx, plan, opts, nil); err != nil {
+			fmt.Println("Error:", err)
+			results = append(results, batchResult{file, "failed", err.Error()})
+			continue
+		}
+		results = append(results, batchResult{file, "upgraded", reason})
+	}
+	printBatchReport(results)
+	return batchExitCode(results, flags.JSON)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Output verification depths, from cheapest to most thorough.
+const (
+	verifyOff  = "off"  // Trust the merge
+	verifyFast = "fast" // Duration, stream counts, HDR, frame counts and the start of the new tracks
+	verifyFull = "full" // Also decode the new tracks completely
+)
+
+// verifyDecodeSeconds is how much of each new track the fast verification
+// decodes.
+const verifyDecodeSeconds = 60
+
+// verifyDurationTolerance is the allowed difference between the container
+// durations of source and output, in seconds. Audio encoders pad the last
+// frame, so this is looser than the per-stream video check.
+const verifyDurationTolerance = 1.0
+
+// validateVerify checks a -verify value.
+func validateVerify(depth string) error {
+	switch depth {
+	case "", verifyOff, verifyFast, verifyFull:
+		return nil
+	}
+	return fmt.Errorf("unknown verification %q (use %s, %s or %s)", depth, verifyOff, verifyFast, verifyFull)
+}
+
+// verifyOutput checks the merged output before temporary files are removed
+// or the original is replaced. Each depth includes the checks of the cheaper
+// ones.
+func verifyOutput(plan *Plan) error {
+	if plan.Verify == verifyOff {
+		return nil
+	}
+
+	if err := verifyDuration(plan); err != nil {
+		return err
+	}
+	if err := verifyStreamCounts(plan); err != nil {
+		return err
+	}
+
+	// Make sure HDR10/Dolby Vision metadata survived the remux; a re-encode
+	// was warned about when planning
+	if !plan.reencodesVideo() {
+		if err := validateHDRMetadata(plan); err != nil {
+			return fmt.Errorf("validating HDR metadata failed: %v", err)
+		}
+	}
+
+	// Make sure frame counts and durations match the source
+	if err := validateTimestamps(plan); err != nil {
+		return fmt.Errorf("validating timestamps failed: %v", err)
+	}
+
+	for i, out := range plan.outputStreams() {
+		if out.Encode < 0 {
+			continue
+		}
+		args := []string{"-v", "error"}
+		what := fmt.Sprintf("decoding new track %d", i)
+		if plan.Verify != verifyFull {
+			args = append(args, "-t", strconv.Itoa(verifyDecodeSeconds))
+			what = fmt.Sprintf("decoding the first %ds of new track %d", verifyDecodeSeconds, i)
+		}
+		args = append(args, "-i", plan.Output, "-map", fmt.Sprintf("0:%d", i), "-f", "null", "-")
+		if err := runSourceScan(plan.Output, what, args); err != nil {
+			return err
+		}
+	}
+
+	// A linear decode doesn't use the seek index players rely on
+	if plan.checksCues() {
+		if err := verifyCues(plan); err != nil {
+			return err
+		}
+	}
+	return seekTest(plan)
+}
+
+// verifyDuration compares the container durations of source and output.
+func verifyDuration(plan *Plan) error {
+	want, err := probeDuration(plan.Input)
+	if err != nil {
+		return nil // Nothing to compare against
+	}
+	want = plan.retimed(want)
+	got, err := probeDuration(plan.Output)
+	if err != nil {
+		return fmt.Errorf("output %s is unreadable: %v", plan.Output, err)
+	}
+	if math.Abs(got-want) > verifyDurationTolerance {
+		return fmt.Errorf("output lasts %.1fs but the source %.1fs", got, want)
+	}
+	return nil
+}
+
+// verifyStreamCounts checks that the output has as many streams of each type
+// as the plan maps into it.
+func verifyStreamCounts(plan *Plan) error {
+	want := make(map[string]int)
+	types := make(map[int]string)
+	for _, s := range plan.Streams {
+		types[s.Index] = s.Type
+	}
+	for _, out := range plan.outputStreams() {
+		if out.Encode >= 0 {
+			want["audio"]++
+		} else {
+			want[types[out.Source]]++
+		}
+	}
+
+	streams, err := probeStreams(plan.Output, "")
+	if err != nil {
+		return err
+	}
+	got := make(map[string]int)
+	for _, s := range streams {
+		got[s.CodecType]++
+	}
+	for _, streamType := range []string{"video", "audio", "subtitle"} {
+		if got[streamType] != want[streamType] {
+			return fmt.Errorf("output has %d %s streams, expected %d", got[streamType], streamType, want[streamType])
+		}
+	}
+	return nil
+}
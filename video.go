@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stereo3DKind returns a short description of the 3D format of a video
+// stream, or "" for regular 2D video.
+func stereo3DKind(s ffprobeStream) string {
+	profile := strings.ToLower(s.Profile)
+	switch {
+	case strings.Contains(profile, "multiview") || strings.Contains(profile, "stereo high"):
+		return "MVC 3D"
+	case strings.EqualFold(s.CodecTag, "mvc1") || strings.EqualFold(s.CodecTag, "mvc2"):
+		return "MVC 3D"
+	}
+	for _, sd := range s.SideData {
+		if strings.EqualFold(sd.Type, "Stereo 3D") {
+			return "stereo 3D"
+		}
+	}
+	if mode := s.Tags["stereo_mode"]; mode != "" && mode != "mono" {
+		return "stereo 3D (" + mode + ")"
+	}
+	return ""
+}
+
+// checkVideoStreams prints the video streams of the file and warns about
+// 3D streams whose dependent view may not survive a remux.
+func checkVideoStreams(file string) ([]Warning, error) {
+	streams, err := probeStreams(file, "v")
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []Warning
+	for _, s := range streams {
+		// Cover art is attached as a video stream but isn't relevant here
+		if s.Disposition["attached_pic"] == 1 {
+			continue
+		}
+		codec := s.CodecName
+		if codec == "" {
+			codec = "unknown (" + s.CodecTag + ")"
+		}
+		kind := stereo3DKind(s)
+		if kind == "" {
+			fmt.Printf("Video stream %d: %s\n", s.Index, codec)
+			continue
+		}
+		fmt.Printf("Video stream %d: %s [%s]\n", s.Index, codec, kind)
+		warnings = append(warnings, Warning{
+			Code: "3d-video",
+			Message: fmt.Sprintf("video stream %d is %s; remuxing with ffmpeg may drop the dependent (second eye) view, "+
+				"verify the output on a 3D-capable player before deleting the source", s.Index, kind),
+		})
+	}
+	return warnings, nil
+}
+
+// videoEncoderAliases maps short codec names to their default software encoder.
+var videoEncoderAliases = map[string]string{
+	"h264": "libx264",
+	"hevc": "libx265",
+	"h265": "libx265",
+	"av1":  "libsvtav1",
+}
+
+// vaapiDevice is the render node VA-API encoders run on.
+const vaapiDevice = "/dev/dri/renderD128"
+
+// videoEncodeArgs returns the ffmpeg output options for the video streams.
+// Video is copied unless a codec was explicitly requested; hardware encoders
+// (e.g. hevc_nvenc, hevc_qsv, hevc_vaapi) can be named directly.
+func videoEncodeArgs(opts Options) []string {
+	if opts.VideoCodec == "" || opts.VideoCodec == "copy" {
+		return []string{"-c:v", "copy"}
+	}
+
+	encoder := opts.VideoCodec
+	if alias, ok := videoEncoderAliases[encoder]; ok {
+		encoder = alias
+	}
+	args := []string{"-c:v", encoder}
+	if strings.HasSuffix(encoder, "_vaapi") {
+		args = append(args, "-vaapi_device", vaapiDevice)
+	}
+
+	// Each encoder family names its constant quality option differently
+	if opts.VideoCRF != "" {
+		switch {
+		case strings.HasSuffix(encoder, "_nvenc"):
+			args = append(args, "-rc", "vbr", "-cq", opts.VideoCRF)
+		case strings.HasSuffix(encoder, "_qsv"):
+			args = append(args, "-global_quality", opts.VideoCRF)
+		case strings.HasSuffix(encoder, "_vaapi"):
+			args = append(args, "-qp", opts.VideoCRF)
+		default:
+			args = append(args, "-crf", opts.VideoCRF)
+		}
+	}
+	if opts.VideoPreset != "" {
+		args = append(args, "-preset", opts.VideoPreset)
+	}
+	return args
+}
+
+// videoStreamArgs scopes a video re-encode to the main video streams of
+// the output: attached pictures such as cover art stay copied, and VA-API
+// encoders get their frames uploaded to the GPU.
+func (p *Plan) videoStreamArgs(outputs []outputStream) []string {
+	if !p.reencodesVideo() {
+		return nil
+	}
+	var args []string
+	for i, out := range outputs {
+		s, ok := p.stream(out.Source)
+		if out.Encode >= 0 || !ok || s.Type != "video" {
+			continue
+		}
+		switch {
+		case hasDisposition(s.Disposition, "attached_pic"):
+			args = append(args, fmt.Sprintf("-c:%d", i), "copy")
+		case strings.HasSuffix(p.VideoArgs[1], "_vaapi"):
+			args = append(args, fmt.Sprintf("-filter:%d", i), "format=nv12,hwupload")
+		}
+	}
+	return args
+}
+
+// checkVideoReencode warns about HDR metadata of the kept video streams a
+// re-encode can't carry over, such as Dolby Vision, before anything is
+// encoded. verifyOutput doesn't compare it for re-encoded video.
+func checkVideoReencode(plan *Plan) []Warning {
+	if !plan.reencodesVideo() {
+		return nil
+	}
+	metadata, err := videoHDRMetadata(plan.Input, plan.keeps)
+	if err != nil {
+		fmt.Println("Error checking HDR metadata:", err)
+		return nil
+	}
+	var warnings []Warning
+	for i, props := range metadata {
+		var names []string
+		for prop := range props {
+			names = append(names, prop)
+		}
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+		warnings = append(warnings, Warning{
+			Code: "reencode-hdr",
+			Message: fmt.Sprintf("video stream %d has %s; -vcodec %s may not carry it over, and the output isn't checked for it",
+				i, strings.Join(names, ", "), plan.VideoArgs[1]),
+		})
+	}
+	return warnings
+}
+
+// reencodesVideo reports whether the merge re-encodes the video instead of
+// copying it.
+func (p *Plan) reencodesVideo() bool {
+	return len(p.VideoArgs) > 1 && p.VideoArgs[1] != "copy"
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Warning is a structured, non-fatal finding about an input file.
+type Warning struct {
+	Code    string `json:"code"`    // Stable identifier, e.g. "default-audio-no-subtitles"
+	Message string `json:"message"` // Human readable explanation
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("Warning [%s]: %s", w.Code, w.Message)
+}
+
+// checkLanguageConsistency compares the audio tracks that end up in the
+// output, downmixes included, with the subtitles it keeps and warns about
+// combinations that leave foreign dialogue scenes without subtitles.
+// Languages are compared in their normalised form, so "en", "eng", "ger"
+// and "deu" match up.
+func checkLanguageConsistency(plan *Plan) []Warning {
+	keptLangs := make(map[string]bool)
+	subLangs := make(map[string]bool)
+	var forcedLangs []string
+	defaultLang, hasDefault := "", false
+	for _, out := range plan.outputStreams() {
+		var lang, kind string
+		if out.Encode >= 0 {
+			lang, kind = plan.Encodes[out.Encode].Language, "audio"
+		} else if s, ok := plan.stream(out.Source); ok {
+			lang, kind = s.Language, s.Type
+		}
+		lang = normalizeLanguageCode(lang)
+		switch kind {
+		case "audio":
+			keptLangs[lang] = true
+			if !hasDefault && hasDisposition(out.Disposition, "default") {
+				defaultLang, hasDefault = lang, true
+			}
+		case "subtitle":
+			subLangs[lang] = true
+			if hasDisposition(out.Disposition, "forced") {
+				forcedLangs = append(forcedLangs, lang)
+			}
+		}
+	}
+
+	var warnings []Warning
+	if hasDefault && defaultLang != "" && defaultLang != "und" && !subLangs[defaultLang] {
+		warnings = append(warnings, Warning{
+			Code:    "default-audio-no-subtitles",
+			Message: fmt.Sprintf("default audio language %q has no matching subtitle track; forced foreign-dialogue subtitles may be missing", defaultLang),
+		})
+	}
+
+	if len(forcedLangs) > 0 {
+		matched := false
+		for _, lang := range forcedLangs {
+			if keptLangs[lang] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			warnings = append(warnings, Warning{
+				Code:    "forced-subtitles-orphaned",
+				Message: fmt.Sprintf("forced subtitles exist only for languages without a kept audio track (%s)", strings.Join(forcedLangs, ", ")),
+			})
+		}
+	}
+	return warnings
+}
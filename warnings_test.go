@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestCheckLanguageConsistency(t *testing.T) {
+	tests := []struct {
+		name string
+		plan *Plan
+		want []string
+	}{
+		{"equivalent codes match", &Plan{
+			Streams: []PlanStream{
+				{Index: 1, Type: "audio", Language: "ger", Action: "keep", Disposition: "default"},
+				{Index: 2, Type: "subtitle", Language: "deu", Action: "keep", Disposition: "forced"},
+				{Index: 3, Type: "subtitle", Language: "en", Action: "keep"},
+			},
+			Encodes: []PlanEncode{{SourceIndex: 1, Language: "eng"}},
+		}, nil},
+		{"dropped default uses the downmix", &Plan{
+			Streams: []PlanStream{
+				{Index: 1, Type: "audio", Language: "fre", Action: "drop", Disposition: "default"},
+				{Index: 2, Type: "audio", Language: "eng", Action: "keep"},
+				{Index: 3, Type: "subtitle", Language: "fra", Action: "keep"},
+			},
+			Encodes: []PlanEncode{{SourceIndex: 1, Language: "fre", Disposition: "default"}},
+		}, nil},
+		{"default without subtitles", &Plan{
+			Streams: []PlanStream{
+				{Index: 1, Type: "audio", Language: "eng", Action: "keep"},
+				{Index: 2, Type: "audio", Language: "jpn", Action: "keep", Disposition: "default"},
+				{Index: 3, Type: "subtitle", Language: "eng", Action: "keep"},
+			},
+		}, []string{"default-audio-no-subtitles"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, w := range checkLanguageConsistency(tt.plan) {
+			got = append(got, w.Code)
+		}
+		if len(got) != len(tt.want) || len(got) > 0 && got[0] != tt.want[0] {
+			t.Errorf("%s: got warnings %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
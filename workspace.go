@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// newJobID returns a random UUID identifying one execution of a plan. It
+// namespaces temporary files, so runs of other users, tools or machines, and
+// parallel files within a batch, never write to the same file even if their
+// inputs share a name.
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Extremely unlikely; the PID in temp names still separates processes
+		panic(fmt.Sprintf("reading random job ID failed: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// jobFileName names a temporary file of a job after its ID and the PID.
+func jobFileName(jobID, name string) string {
+	return fmt.Sprintf("mkv21_%s_%d_%s", jobID, os.Getpid(), name)
+}
+
+// workspaceDir returns the directory jobs keep their temporary files in:
+// -temp-dir, or the system temp directory.
+func (p *Plan) workspaceDir() string {
+	if p.TempDir != "" {
+		return p.TempDir
+	}
+	return os.TempDir()
+}
+
+// jobDir returns this job's own subdirectory of the workspace directory.
+func (p *Plan) jobDir() string {
+	return filepath.Join(p.workspaceDir(), "mkv21_"+p.JobID)
+}
+
+// workPath returns a temporary file for this job in its subdirectory of the
+// workspace, creating the subdirectory on first use.
+func (p *Plan) workPath(name string) string {
+	dir := p.jobDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Println("Warning: creating the job directory failed:", err)
+	}
+	return filepath.Join(dir, jobFileName(p.JobID, name))
+}
+
+// removeJobDir removes the job's subdirectory once it is empty. Files left
+// in it, such as an output whose publishing failed, keep it in place.
+func (p *Plan) removeJobDir() {
+	os.Remove(p.jobDir())
+}